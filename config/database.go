@@ -25,7 +25,7 @@ func ConnectDatabase() {
 			log.Fatal("Failed to connect to database:", err)
 		}
 
-		if err := DB.AutoMigrate(&models.User{}, &models.Task{}); err != nil {
+		if err := DB.AutoMigrate(models.All()...); err != nil {
 			log.Fatal("Failed to migrate database:", err)
 		}
 
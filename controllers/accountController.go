@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"dtms/config"
+	"dtms/mailer"
+	"dtms/models"
+	"dtms/problem"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// sendInBackground runs a mail job after the response, so that requests for
+// registered and unknown emails take the same time.
+var sendInBackground = func(job func()) { go job() }
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueUserToken creates a new token for purpose, revoking any earlier
+// unused ones, and returns the raw value to mail to the user.
+func issueUserToken(userID uint, purpose string, ttl time.Duration) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(buf)
+
+	now := time.Now()
+	if err := config.DB.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", now).Error; err != nil {
+		return "", err
+	}
+
+	token := models.UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashToken(raw),
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := config.DB.Create(&token).Error; err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// consumeUserToken marks the token as used. The conditional update makes
+// concurrent attempts to redeem the same token fail for all but one.
+func consumeUserToken(raw, purpose string) (*models.UserToken, error) {
+	var token models.UserToken
+	if err := config.DB.Where("token_hash = ? AND purpose = ?", hashToken(raw), purpose).First(&token).Error; err != nil {
+		return nil, errInvalidToken
+	}
+
+	now := time.Now()
+	if token.UsedAt != nil || now.After(token.ExpiresAt) {
+		return nil, errInvalidToken
+	}
+
+	result := config.DB.Model(&models.UserToken{}).
+		Where("id = ? AND used_at IS NULL", token.ID).
+		Update("used_at", now)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return nil, errInvalidToken
+	}
+	return &token, nil
+}
+
+func appURL(path, token string) string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return fmt.Sprintf("%s%s?token=%s", base, path, token)
+}
+
+func sendVerificationEmail(user models.User) error {
+	raw, err := issueUserToken(user.ID, models.TokenEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	return mailer.GetMailer().Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your DTMS email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening:\n\n%s\n\nThe link expires in %s.\n",
+			user.Username, appURL("/auth/verify-email", raw), emailVerificationTTL),
+	})
+}
+
+func sendPasswordResetEmail(user models.User) error {
+	raw, err := issueUserToken(user.ID, models.TokenPasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	return mailer.GetMailer().Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your DTMS password",
+		Body: fmt.Sprintf("Hi %s,\n\nReset your password by opening:\n\n%s\n\nThe link expires in %s. If you did not ask for this, ignore this email.\n",
+			user.Username, appURL("/auth/password/reset", raw), passwordResetTTL),
+	})
+}
+
+// RequestPasswordReset always answers the same way so it cannot be used to
+// discover which emails are registered.
+func RequestPasswordReset(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	sendInBackground(func() {
+		var user models.User
+		if err := config.DB.Where("email = ?", input.Email).First(&user).Error; err != nil {
+			return
+		}
+		if err := sendPasswordResetEmail(user); err != nil {
+			log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+		}
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email is registered, a reset link has been sent"})
+}
+
+func ResetPassword(c *gin.Context) {
+	var input struct {
+		Token           string `json:"token" binding:"required"`
+		Password        string `json:"password" binding:"required,min=8"`
+		ConfirmPassword string `json:"confirm_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if input.Password != input.ConfirmPassword {
+		problem.Respond(c, http.StatusBadRequest, "password_mismatch", "Passwords do not match")
+		return
+	}
+
+	token, err := consumeUserToken(input.Token, models.TokenPasswordReset)
+	if err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), passwordHashCost)
+	if err != nil {
+		problem.Internal(c, "Failed to hash password", err)
+		return
+	}
+
+	// Sessions from before the reset are revoked, in case the password was
+	// reset because someone else knew it.
+	if err := config.DB.Model(&models.User{}).Where("id = ?", token.UserID).Updates(map[string]interface{}{
+		"password":           string(hashedPassword),
+		"session_generation": gorm.Expr("session_generation + 1"),
+	}).Error; err != nil {
+		problem.Internal(c, "Failed to reset password", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
+
+// CheckPasswordResetToken is where the emailed reset link points. It reports
+// whether the token can still be used, without using it; the new password is
+// then sent to POST /auth/password/reset.
+func CheckPasswordResetToken(c *gin.Context) {
+	var token models.UserToken
+	err := config.DB.Where("token_hash = ? AND purpose = ?", hashToken(c.Query("token")), models.TokenPasswordReset).First(&token).Error
+	if err != nil || token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+		problem.Respond(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Send the token with the new password to POST /auth/password/reset",
+		"expires_at": token.ExpiresAt,
+	})
+}
+
+func RequestEmailVerification(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	sendInBackground(func() {
+		var user models.User
+		if err := config.DB.Where("email = ?", input.Email).First(&user).Error; err != nil || user.EmailVerifiedAt != nil {
+			return
+		}
+		if err := sendVerificationEmail(user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email is registered and unverified, a verification link has been sent"})
+}
+
+func VerifyEmail(c *gin.Context) {
+	var input struct {
+		Token string `json:"token" form:"token" binding:"required"`
+	}
+	if err := c.ShouldBind(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	token, err := consumeUserToken(input.Token, models.TokenEmailVerification)
+	if err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, token.UserID).Error; err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_token", "Invalid or expired token")
+		return
+	}
+	updates := map[string]interface{}{"email_verified_at": time.Now()}
+	promoted := user.Role == models.RoleMember && bootstrapAdmin(user.Email)
+	if promoted {
+		updates["role"] = models.RoleAdmin
+	}
+	if err := config.DB.Model(&user).Updates(updates).Error; err != nil {
+		problem.Internal(c, "Failed to verify email", err)
+		return
+	}
+	if promoted {
+		log.Printf("User %d verified %s and became an administrator", user.ID, user.Email)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
@@ -0,0 +1,335 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	attachmentDownloadPurpose = "attachment_download"
+	defaultAttachmentMaxBytes = 10 << 20
+	defaultAttachmentTypes    = "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain,application/zip"
+	attachmentURLTTL          = 15 * time.Minute
+)
+
+// attachmentMaxBytes is ATTACHMENT_MAX_BYTES, default 10 MiB.
+func attachmentMaxBytes() int64 {
+	if value, err := strconv.ParseInt(os.Getenv("ATTACHMENT_MAX_BYTES"), 10, 64); err == nil && value > 0 {
+		return value
+	}
+	return defaultAttachmentMaxBytes
+}
+
+// attachmentTypeAllowed checks a sniffed content type against
+// ATTACHMENT_ALLOWED_TYPES, a comma separated list that may contain
+// wildcards such as "image/*".
+func attachmentTypeAllowed(contentType string) bool {
+	allowed := os.Getenv("ATTACHMENT_ALLOWED_TYPES")
+	if allowed == "" {
+		allowed = defaultAttachmentTypes
+	}
+	for _, pattern := range strings.Split(allowed, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == contentType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// blobMu serializes finding or storing a blob together with attaching it,
+// and checking a blob for references together with deleting it. Otherwise
+// an upload could match a blob whose object a concurrent delete is about to
+// remove.
+var blobMu sync.Mutex
+
+// attachBlob saves attachment with data as its content. The content is
+// stored once per distinct hash and shared by every attachment of it.
+func attachBlob(c *gin.Context, attachment *models.Attachment, data []byte, contentType string) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	var blob models.Blob
+	if err := config.DB.Where("sha256 = ?", hash).Limit(1).Find(&blob).Error; err != nil {
+		return err
+	}
+	if blob.ID == 0 {
+		blob = models.Blob{
+			SHA256:      hash,
+			Size:        int64(len(data)),
+			ContentType: contentType,
+			StorageKey:  "sha256/" + hash[:2] + "/" + hash,
+		}
+		if err := storage.GetBackend().Put(c.Request.Context(), blob.StorageKey, data, contentType); err != nil {
+			return err
+		}
+	}
+
+	return config.DB.Transaction(func(tx *gorm.DB) error {
+		if blob.ID == 0 {
+			if err := tx.Create(&blob).Error; err != nil {
+				return err
+			}
+		}
+		attachment.BlobID = blob.ID
+		if err := tx.Omit("Blob").Create(attachment).Error; err != nil {
+			return err
+		}
+		attachment.Blob = &blob
+		return nil
+	})
+}
+
+// releaseBlobs deletes the given blobs, and their stored objects, once no
+// attachment refers to them any more.
+func releaseBlobs(c *gin.Context, blobIDs []uint) {
+	if len(blobIDs) == 0 {
+		return
+	}
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	var orphans []models.Blob
+	err := config.DB.Where("id IN ? AND id NOT IN (SELECT blob_id FROM attachments)", blobIDs).Find(&orphans).Error
+	if err != nil {
+		log.Printf("Failed to find unused attachment blobs: %v", err)
+		return
+	}
+
+	for _, blob := range orphans {
+		if err := storage.GetBackend().Delete(c.Request.Context(), blob.StorageKey); err != nil {
+			log.Printf("Failed to delete stored object %s: %v", blob.StorageKey, err)
+			continue
+		}
+		config.DB.Delete(&blob)
+	}
+}
+
+// removeTaskAttachments deletes the attachments of deleted tasks.
+func removeTaskAttachments(c *gin.Context, taskIDs []uint) {
+	var attachments []models.Attachment
+	if err := config.DB.Where("task_id IN ?", taskIDs).Find(&attachments).Error; err != nil || len(attachments) == 0 {
+		return
+	}
+
+	blobIDs := make([]uint, len(attachments))
+	for i, attachment := range attachments {
+		blobIDs[i] = attachment.BlobID
+	}
+	if err := config.DB.Where("task_id IN ?", taskIDs).Delete(&models.Attachment{}).Error; err != nil {
+		log.Printf("Failed to delete attachments of tasks %v: %v", taskIDs, err)
+		return
+	}
+	releaseBlobs(c, blobIDs)
+}
+
+// attachmentDownloadURL is a link that downloads the attachment without
+// further authentication until it expires.
+func attachmentDownloadURL(attachment models.Attachment) (string, time.Time, error) {
+	expires := time.Now().Add(attachmentURLTTL)
+	token, err := config.Keys.Sign(jwt.MapClaims{
+		"purpose":       attachmentDownloadPurpose,
+		"attachment_id": attachment.ID,
+		"exp":           expires.Unix(),
+	})
+	if err != nil {
+		return "", expires, err
+	}
+	return appURL("/attachments/download", token), expires, nil
+}
+
+type attachmentResponse struct {
+	models.Attachment
+	DownloadURL string    `json:"download_url"`
+	ExpiresAt   time.Time `json:"download_url_expires_at"`
+}
+
+func withDownloadURL(attachment models.Attachment) (attachmentResponse, error) {
+	url, expires, err := attachmentDownloadURL(attachment)
+	return attachmentResponse{Attachment: attachment, DownloadURL: url, ExpiresAt: expires}, err
+}
+
+// UploadAttachment attaches the multipart "file" to the task in the
+// "task_id" form field. The content type is sniffed from the content, not
+// taken from the client.
+func UploadAttachment(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+	maxBytes := attachmentMaxBytes()
+
+	// Leave room for the multipart framing around the file.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+1<<20)
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			problem.Respond(c, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("File exceeds the %d byte limit", maxBytes))
+			return
+		}
+		problem.Invalid(c, "Failed to get file", problem.FieldError{Field: "file", Code: "required", Message: "upload a file"})
+		return
+	}
+	if header.Size > maxBytes {
+		problem.Respond(c, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("File exceeds the %d byte limit", maxBytes))
+		return
+	}
+
+	var task models.Task
+	taskID := c.Param("task_id")
+	if taskID == "" {
+		taskID = c.PostForm("task_id")
+	}
+	if err := config.DB.First(&task, taskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		problem.Internal(c, "Failed to open file", err)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		problem.Internal(c, "Failed to read file", err)
+		return
+	}
+	if int64(len(data)) > maxBytes {
+		problem.Respond(c, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("File exceeds the %d byte limit", maxBytes))
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !attachmentTypeAllowed(contentType) {
+		problem.Respond(c, http.StatusUnsupportedMediaType, "file_type_not_allowed", fmt.Sprintf("File type %s is not allowed", contentType))
+		return
+	}
+
+	attachment := models.Attachment{
+		TaskID:     task.ID,
+		FileName:   filepath.Base(header.Filename),
+		UploaderID: user.ID,
+	}
+	if err := attachBlob(c, &attachment, data, contentType); err != nil {
+		log.Printf("Failed to store attachment: %v", err)
+		problem.Internal(c, "Failed to store file", nil)
+		return
+	}
+
+	response, err := withDownloadURL(attachment)
+	if err != nil {
+		problem.Internal(c, "Failed to sign download URL", err)
+		return
+	}
+
+	respondCreated(c, "", gin.H{"message": "File attached successfully", "attachment": response})
+}
+
+func GetAttachments(c *gin.Context) {
+	var task models.Task
+	if err := config.DB.First(&task, idParam(c, "task_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	var attachments []models.Attachment
+	if err := config.DB.Preload("Blob").Where("task_id = ?", task.ID).Order("id").Find(&attachments).Error; err != nil {
+		problem.Internal(c, "Failed to fetch attachments", err)
+		return
+	}
+
+	responses := make([]attachmentResponse, 0, len(attachments))
+	for _, attachment := range attachments {
+		response, err := withDownloadURL(attachment)
+		if err != nil {
+			problem.Internal(c, "Failed to sign download URL", err)
+			return
+		}
+		responses = append(responses, response)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"attachments": responses})
+}
+
+// DeleteAttachment removes an attachment. The uploader, admins and managers
+// may delete it; the stored file goes once nothing else refers to it.
+func DeleteAttachment(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var attachment models.Attachment
+	if err := config.DB.First(&attachment, idParam(c, "attachment_id")).Error; err != nil || !inPathTask(c, attachment.TaskID) {
+		problem.Respond(c, http.StatusNotFound, "attachment_not_found", "Attachment not found")
+		return
+	}
+	if attachment.UploaderID != user.ID && user.Role != models.RoleAdmin && user.Role != models.RoleManager {
+		problem.Respond(c, http.StatusForbidden, "insufficient_permissions", "Insufficient permissions")
+		return
+	}
+
+	if err := config.DB.Delete(&attachment).Error; err != nil {
+		problem.Internal(c, "Failed to delete attachment", err)
+		return
+	}
+	releaseBlobs(c, []uint{attachment.BlobID})
+
+	respondDeleted(c, gin.H{"message": "Attachment deleted successfully"})
+}
+
+// DownloadAttachment serves a file for a signed download URL.
+func DownloadAttachment(c *gin.Context) {
+	token, err := jwt.Parse(c.Query("token"), config.Keys.Keyfunc)
+	if err != nil || !token.Valid {
+		problem.Respond(c, http.StatusForbidden, "invalid_download_link", "Invalid or expired download link")
+		return
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if claims["purpose"] != attachmentDownloadPurpose {
+		problem.Respond(c, http.StatusForbidden, "invalid_download_link", "Invalid or expired download link")
+		return
+	}
+
+	var attachment models.Attachment
+	if err := config.DB.Preload("Blob").First(&attachment, "id = ?", claims["attachment_id"]).Error; err != nil || attachment.Blob == nil {
+		problem.Respond(c, http.StatusNotFound, "attachment_not_found", "Attachment not found")
+		return
+	}
+
+	body, err := storage.GetBackend().Get(c.Request.Context(), attachment.Blob.StorageKey)
+	if err != nil {
+		log.Printf("Failed to read stored object %s: %v", attachment.Blob.StorageKey, err)
+		problem.Internal(c, "Failed to read file", nil)
+		return
+	}
+	defer body.Close()
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(http.StatusOK, attachment.Blob.Size, attachment.Blob.ContentType, body, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}),
+	})
+}
@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"dtms/config"
+	"dtms/models"
+	"dtms/storage"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockS3 is a local stand-in for an S3-compatible store such as MinIO. It
+// keeps objects in memory and rejects requests with a bad signature.
+type mockS3 struct {
+	server    *httptest.Server
+	accessKey string
+	secretKey string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMockS3(t *testing.T) *mockS3 {
+	s3 := &mockS3{accessKey: "minio", secretKey: "minio-secret", objects: map[string][]byte{}}
+	s3.server = httptest.NewServer(http.HandlerFunc(s3.handle))
+	t.Cleanup(s3.server.Close)
+	return s3
+}
+
+func (s3 *mockS3) backend() *storage.S3Backend {
+	return &storage.S3Backend{
+		Endpoint:  s3.server.URL,
+		Region:    "us-east-1",
+		Bucket:    "dtms",
+		AccessKey: s3.accessKey,
+		SecretKey: s3.secretKey,
+	}
+}
+
+func (s3 *mockS3) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		http.Error(w, "missing date", http.StatusForbidden)
+		return
+	}
+	expected := httptest.NewRequest(r.Method, "http://"+r.Host+r.URL.EscapedPath(), bytes.NewReader(body))
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		expected.Header.Set("Content-Type", contentType)
+	}
+	storage.Sign(expected, body, s3.accessKey, s3.secretKey, "us-east-1", date)
+	if r.Header.Get("Authorization") != expected.Header.Get("Authorization") {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		s3.objects[r.URL.Path] = body
+	case http.MethodGet:
+		data, ok := s3.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(s3.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s3 *mockS3) count() int {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	return len(s3.objects)
+}
+
+var pngData = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1, 2, 3}, 100)...)
+
+func uploadAttachment(router *gin.Engine, user models.User, taskID uint, name string, data []byte) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("task_id", fmt.Sprint(taskID))
+	part, _ := form.CreateFormFile("file", name)
+	part.Write(data)
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "/task/attachments", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Test-User", fmt.Sprint(user.ID))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func downloadPath(t *testing.T, w *httptest.ResponseRecorder) string {
+	var resp struct {
+		Attachment attachmentResponse `json:"attachment"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	link, err := url.Parse(resp.Attachment.DownloadURL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return link.RequestURI()
+}
+
+func TestAttachmentsS3(t *testing.T) {
+	setup()
+	router := setupRouter()
+	s3 := newMockS3(t)
+	storage.InitBackend(s3.backend())
+	user := createNamedUser("uploader")
+	first, second := CreateTestTask(), CreateTestTask()
+
+	w := uploadAttachment(router, user, first.ID, "diagram.png", pngData)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	link := downloadPath(t, w)
+	w = uploadAttachment(router, user, second.ID, "copy.png", pngData)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, s3.count(), "Expected identical content to be stored once")
+
+	w = uploadAttachment(router, user, first.ID, "page.html", []byte("<html><script>alert(1)</script></html>"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	t.Setenv("ATTACHMENT_MAX_BYTES", "100")
+	w = uploadAttachment(router, user, first.ID, "big.png", pngData)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	os.Unsetenv("ATTACHMENT_MAX_BYTES")
+
+	req, _ := http.NewRequest("GET", link, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "diagram.png")
+	assert.Equal(t, pngData, w.Body.Bytes())
+
+	req, _ = http.NewRequest("GET", strings.Replace(link, "token=", "token=x", 1), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("/task/delete?task_id=%d", first.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, s3.count(), "Expected content still attached elsewhere to be kept")
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("/task/delete?task_id=%d", second.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, s3.count())
+
+	var blobs int64
+	config.DB.Model(&models.Blob{}).Count(&blobs)
+	assert.Equal(t, int64(0), blobs)
+
+	forged := s3.backend()
+	forged.SecretKey = "wrong"
+	storage.InitBackend(forged)
+	w = uploadAttachment(router, user, CreateTestTask().ID, "other.png", append(pngData, 9))
+	assert.Equal(t, http.StatusInternalServerError, w.Code, "Expected the store to reject a bad signature")
+}
+
+func TestAttachmentsLocalBackend(t *testing.T) {
+	setup()
+	router := setupRouter()
+	dir := t.TempDir()
+	storage.InitBackend(&storage.LocalBackend{Dir: dir})
+	owner, other := createNamedUser("owner"), createNamedUser("other")
+	task := CreateTestTask()
+
+	w := uploadAttachment(router, owner, task.ID, "notes.txt", []byte("plain notes"))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	files, _ := filepath.Glob(filepath.Join(dir, "sha256", "*", "*"))
+	assert.Len(t, files, 1)
+
+	w = requestAs(router, owner, "GET", fmt.Sprintf("/task/attachments?task_id=%d", task.ID), nil)
+	var list struct {
+		Attachments []attachmentResponse `json:"attachments"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if assert.Len(t, list.Attachments, 1) {
+		assert.Equal(t, "text/plain", list.Attachments[0].Blob.ContentType)
+		assert.NotEmpty(t, list.Attachments[0].DownloadURL)
+	}
+
+	w = requestAs(router, other, "DELETE", fmt.Sprintf("/task/attachments?attachment_id=%d", list.Attachments[0].ID), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = requestAs(router, owner, "DELETE", fmt.Sprintf("/task/attachments?attachment_id=%d", list.Attachments[0].ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	files, _ = filepath.Glob(filepath.Join(dir, "sha256", "*", "*"))
+	assert.Empty(t, files)
+}
+
+// deleteHook is a backend that runs a hook before each delete.
+type deleteHook struct {
+	storage.Backend
+	beforeDelete func()
+}
+
+func (d deleteHook) Delete(ctx context.Context, key string) error {
+	d.beforeDelete()
+	return d.Backend.Delete(ctx, key)
+}
+
+func TestAttachmentUploadDuringDelete(t *testing.T) {
+	setup()
+	router := setupRouter()
+	dir := t.TempDir()
+	user := createNamedUser("uploader")
+	task := CreateTestTask()
+	data := []byte("shared notes")
+
+	// The same content is uploaded again just as its last attachment is
+	// being removed. The upload must wait and store the content afresh
+	// rather than attach to the object about to be deleted.
+	var reupload *httptest.ResponseRecorder
+	var once sync.Once
+	done := make(chan struct{})
+	storage.InitBackend(deleteHook{
+		Backend: &storage.LocalBackend{Dir: dir},
+		beforeDelete: func() {
+			once.Do(func() {
+				go func() {
+					reupload = uploadAttachment(router, user, task.ID, "notes.txt", data)
+					close(done)
+				}()
+				select {
+				case <-done:
+				case <-time.After(200 * time.Millisecond):
+				}
+			})
+		},
+	})
+
+	w := uploadAttachment(router, user, task.ID, "notes.txt", data)
+	var created struct {
+		Attachment attachmentResponse `json:"attachment"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("/task/attachments?attachment_id=%d", created.Attachment.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	<-done
+	assert.Equal(t, http.StatusOK, reupload.Code)
+
+	req, _ := http.NewRequest("GET", downloadPath(t, reupload), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+}
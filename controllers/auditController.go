@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// newAuditEvent starts an event with the acting user, client IP and request
+// ID of c. c is nil for background jobs.
+func newAuditEvent(c *gin.Context, action string) models.AuditEvent {
+	event := models.AuditEvent{Action: action, CreatedAt: time.Now().UTC()}
+	if c == nil {
+		return event
+	}
+
+	event.IP = c.ClientIP()
+	event.RequestID = c.GetString("request_id")
+	if value, ok := c.Get("user"); ok {
+		actor := value.(models.User)
+		event.ActorID = &actor.ID
+	}
+	return event
+}
+
+// saveAuditEvent stores an event. A failure is logged rather than failing
+// the request, which has already taken effect.
+func saveAuditEvent(event models.AuditEvent) {
+	if err := config.DB.Create(&event).Error; err != nil {
+		log.Printf("Failed to record audit event %s: %v", event.Action, err)
+	}
+}
+
+func recordAuditEvent(c *gin.Context, action, subject, details string) {
+	event := newAuditEvent(c, action)
+	event.Subject = subject
+	event.Details = details
+	saveAuditEvent(event)
+}
+
+// recordTaskAudit records an action on a task with the fields it changed.
+func recordTaskAudit(c *gin.Context, action string, taskID uint, changes models.FieldChanges, details string) {
+	event := newAuditEvent(c, action)
+	event.Subject = fmt.Sprintf("task:%d", taskID)
+	event.TaskID = &taskID
+	event.Changes = changes
+	event.Details = details
+	saveAuditEvent(event)
+}
+
+// auditIgnoredFields are left out of task diffs: bookkeeping columns,
+// preloaded associations and values derived from other tasks.
+var auditIgnoredFields = map[string]bool{
+	"ID": true, "CreatedAt": true, "UpdatedAt": true, "DeletedAt": true,
+	"user": true, "team": true, "assignees": true, "reviewers": true, "children": true,
+	"labels": true, "checklist": true, "rollup_seconds": true, "progress": true, "version": true,
+}
+
+// taskChanges lists the fields that differ between two versions of a task,
+// by their JSON names and in alphabetical order.
+func taskChanges(before, after models.Task) models.FieldChanges {
+	old, current := auditFields(before), auditFields(after)
+
+	var names []string
+	for name := range current {
+		if !auditIgnoredFields[name] && !reflect.DeepEqual(old[name], current[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make(models.FieldChanges, 0, len(names))
+	for _, name := range names {
+		changes = append(changes, models.FieldChange{Field: name, Before: old[name], After: current[name]})
+	}
+	return changes
+}
+
+// participantChanges lists changes to a task's primary assignee, assignees
+// and reviewers, which must be preloaded on both versions.
+func participantChanges(before, after models.Task) models.FieldChanges {
+	changes := taskChanges(before, after)
+	for _, list := range []struct {
+		field         string
+		before, after []models.User
+	}{
+		{"assignees", before.Assignees, after.Assignees},
+		{"reviewers", before.Reviewers, after.Reviewers},
+	} {
+		old, current := auditUserIDs(list.before), auditUserIDs(list.after)
+		if !reflect.DeepEqual(old, current) {
+			changes = append(changes, models.FieldChange{Field: list.field, Before: old, After: current})
+		}
+	}
+	return changes
+}
+
+// auditID records a missing ID, stored as 0, as null.
+func auditID(id uint) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+func auditUserIDs(users []models.User) []uint {
+	ids := make([]uint, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func auditFields(task models.Task) map[string]interface{} {
+	fields := map[string]interface{}{}
+	data, _ := json.Marshal(task)
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// GetTaskHistory lists every recorded change to a task, oldest first. The
+// history outlives the task.
+func GetTaskHistory(c *gin.Context) {
+	var task models.Task
+	if err := config.DB.Unscoped().Select("id").First(&task, idParam(c, "task_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	var events []models.AuditEvent
+	if err := config.DB.Where("task_id = ?", task.ID).Order("id").Find(&events).Error; err != nil {
+		problem.Internal(c, "Failed to fetch task history", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"task_id": task.ID, "events": events})
+}
+
+// GetAuditEvents searches the audit log, newest first. Results are paged
+// with limit and before_id, the next_before_id of the previous page.
+func GetAuditEvents(c *gin.Context) {
+	query := config.DB.Order("id DESC")
+	for _, field := range []string{"actor_id", "task_id", "request_id", "ip", "subject"} {
+		if value := c.Query(field); value != "" {
+			query = query.Where(field+" = ?", value)
+		}
+	}
+	if actions := c.Query("action"); actions != "" {
+		query = query.Where("action IN ?", strings.Split(actions, ","))
+	}
+
+	for name, op := range map[string]string{"from": ">=", "to": "<"} {
+		if value := c.Query(name); value != "" {
+			bound, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				problem.Respond(c, http.StatusBadRequest, "invalid_time", fmt.Sprintf("Invalid %s: use RFC 3339", name))
+				return
+			}
+			// Events are stored in UTC so that their text form sorts by time.
+			query = query.Where("created_at "+op+" ?", bound.UTC())
+		}
+	}
+
+	limit := defaultAuditLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxAuditLimit {
+			problem.Invalid(c, fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit))
+			return
+		}
+		limit = parsed
+	}
+	if value := c.Query("before_id"); value != "" {
+		query = query.Where("id < ?", value)
+	}
+
+	var events []models.AuditEvent
+	if err := query.Limit(limit).Find(&events).Error; err != nil {
+		problem.Internal(c, "Failed to fetch audit events", err)
+		return
+	}
+
+	response := gin.H{"events": events}
+	if len(events) == limit {
+		response["next_before_id"] = events[len(events)-1].ID
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -3,8 +3,12 @@ package controllers
 import (
 	"dtms/config"
 	"dtms/models"
+	"dtms/problem"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -12,6 +16,8 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+const passwordHashCost = 14
+
 type LoginInput struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=8"`
@@ -26,24 +32,24 @@ func Register(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		problem.Bind(c, err)
 		return
 	}
 
 	if input.Password != input.ConfirmPassword {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords do not match"})
+		problem.Respond(c, http.StatusBadRequest, "password_mismatch", "Passwords do not match")
 		return
 	}
 
 	var existingUser models.User
 	if err := config.DB.Where("email = ?", input.Email).First(&existingUser).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Email already registered"})
+		problem.Respond(c, http.StatusBadRequest, "email_taken", "Email already registered")
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), 14)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), passwordHashCost)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		problem.Internal(c, "Failed to hash password", err)
 		return
 	}
 
@@ -51,43 +57,143 @@ func Register(c *gin.Context) {
 		Email:    input.Email,
 		Password: string(hashedPassword),
 		Username: input.Username,
+		Role:     models.RoleMember,
 	}
 
 	if err := config.DB.Create(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		problem.Internal(c, "Failed to register user", err)
 		return
 	}
 
+	if err := sendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "User registered successfully!"})
 }
 
 func Login(c *gin.Context) {
 	var input LoginInput
 	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input format"})
+		problem.Bind(c, err)
+		return
+	}
+
+	accountKey := accountThrottleKey(input.Email)
+	ip := throttledKey{ipThrottleKey(c.ClientIP()), ipThrottle}
+	wait, lockedOut := reserveAttempt(time.Now(), throttledKey{accountKey, accountThrottle}, ip)
+	if wait > 0 {
+		respondThrottled(c, wait)
 		return
 	}
 
+	// Unknown emails still pay for a bcrypt comparison and are throttled by
+	// email, so they are indistinguishable from wrong passwords.
 	var user models.User
+	var passwordErr error
 	if err := config.DB.Where("email = ?", input.Email).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		compareDummyPassword(input.Password)
+		passwordErr = err
+	} else {
+		passwordErr = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password))
+	}
+
+	if passwordErr != nil {
+		recordLoginFailure(c, accountKey, "wrong email or password", lockedOut)
+		problem.Respond(c, http.StatusUnauthorized, "invalid_credentials", "Invalid email or password")
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+	// Other accounts' failures from the same IP still count, so that logging
+	// into an own account now and then does not lift the IP's limit.
+	clearThrottle(accountKey)
+	undoFailure(ip, lockedOut)
+
+	if !user.Active() {
+		problem.Respond(c, http.StatusForbidden, "account_deactivated", "Account is deactivated")
 		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+
+	completeLogin(c, user)
+}
+
+// completeLogin finishes a login whose first factor has been checked, by
+// password or by single sign-on. Users with 2FA get a challenge to answer
+// at /auth/login/2fa instead of a session.
+func completeLogin(c *gin.Context, user models.User) {
+	if !user.TwoFactorEnabled {
+		issueSession(c, user)
+		return
+	}
+
+	challenge, err := config.Keys.Sign(jwt.MapClaims{
 		"user_id": user.ID,
-		"exp":     time.Now().Add(time.Hour * 72).Unix(),
+		"purpose": twoFactorChallengePurpose,
+		"exp":     time.Now().Add(twoFactorChallengeTTL).Unix(),
 	})
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		problem.Internal(c, "Failed to generate token", err)
 		return
 	}
-	c.SetCookie("jwt", tokenString, 3600*72, "/", "", false, true)
+	c.JSON(http.StatusOK, gin.H{
+		"message":             "Two-factor authentication required",
+		"two_factor_required": true,
+		"challenge":           challenge,
+	})
+}
+
+// issueSession signs a session token for user, sets it as a cookie and
+// writes the login response.
+func issueSession(c *gin.Context, user models.User) {
+	if !user.Active() {
+		problem.Respond(c, http.StatusForbidden, "account_deactivated", "Account is deactivated")
+		return
+	}
+
+	tokenString, err := signSession(c, user)
+	if err != nil {
+		problem.Internal(c, "Failed to generate token", err)
+		return
+	}
+
+	event := newAuditEvent(c, models.AuditLogin)
+	event.ActorID = &user.ID
+	event.Subject = fmt.Sprintf("user:%d", user.ID)
+	saveAuditEvent(event)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Login successful!", "token": tokenString})
 }
+
+// signSession signs a session token for user's current session generation
+// and sets it as the jwt cookie.
+func signSession(c *gin.Context, user models.User) (string, error) {
+	tokenString, err := config.Keys.Sign(jwt.MapClaims{
+		"user_id":    user.ID,
+		"generation": user.SessionGeneration,
+		"exp":        time.Now().Add(time.Hour * 72).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	c.SetCookie("jwt", tokenString, 3600*72, "/", "", false, true)
+	return tokenString, nil
+}
+
+// bootstrapAdmin reports whether email is listed in ADMIN_EMAILS. Such
+// accounts become administrators once they have verified the address, so a
+// fresh deployment can be bootstrapped without letting whoever registers a
+// listed address first take the role.
+func bootstrapAdmin(email string) bool {
+	for _, admin := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// JWKS publishes the public halves of the JWT keys so other services can
+// verify DTMS tokens.
+func JWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, config.Keys.JWKS())
+}
@@ -0,0 +1,340 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/schedule"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errNoPlannedWindow    = errors.New("task needs planned start and end times to be auto-assigned")
+	errNoEligibleAssignee = errors.New("no candidate has the skills and free capacity for this task")
+)
+
+// utilizationBucket groups candidates whose utilization after assignment is
+// this close together, so that round-robin decides between them instead of
+// tiny differences in load.
+const utilizationBucket = 0.1
+
+type assignmentCandidate struct {
+	UserID          uint       `json:"user_id"`
+	Name            string     `json:"name"`
+	Eligible        bool       `json:"eligible"`
+	CapacityMinutes int64      `json:"capacity_minutes"`
+	LoadMinutes     int64      `json:"load_minutes"`
+	RequiredMinutes int64      `json:"required_minutes"`
+	FreeMinutes     int64      `json:"free_minutes"`
+	Utilization     float64    `json:"utilization"`
+	MissingSkills   []string   `json:"missing_skills,omitempty"`
+	LastAssignedAt  *time.Time `json:"last_assigned_at"`
+	Reason          string     `json:"reason"`
+}
+
+type assignmentExplanation struct {
+	ChosenUserID *uint                 `json:"chosen_user_id"`
+	Summary      string                `json:"summary"`
+	Candidates   []assignmentCandidate `json:"candidates"`
+}
+
+type autoAssignOptions struct {
+	TeamID       *uint
+	CandidateIDs []uint
+}
+
+// autoAssignPool returns the users considered for task: the given
+// candidates, else the members of the task's team, else every active user.
+func autoAssignPool(task models.Task, opts autoAssignOptions) ([]models.User, error) {
+	var users []models.User
+
+	teamID := opts.TeamID
+	if teamID == nil {
+		teamID = task.TeamID
+	}
+
+	query := config.DB.Where("deactivated_at IS NULL")
+	switch {
+	case len(opts.CandidateIDs) > 0:
+		query = query.Where("id IN ?", opts.CandidateIDs)
+	case teamID != nil:
+		query = query.Where("id IN (SELECT user_id FROM team_members WHERE team_id = ?)", *teamID)
+	}
+
+	err := query.Order("id").Find(&users).Error
+	return users, err
+}
+
+// plannedTasks returns, for each of userIDs, the other tasks they are
+// assigned to, either as the assignee or as a co-assignee. It runs the same
+// two queries however many users are asked about.
+func plannedTasks(userIDs []uint, excludeTaskID uint) (map[uint][]models.Task, error) {
+	var tasks []models.Task
+	err := config.DB.
+		Preload("Assignees", "id IN ?", userIDs).
+		Where("assigned_to IN ? OR id IN (SELECT task_id FROM task_assignees WHERE user_id IN ?)", userIDs, userIDs).
+		Where("id <> ?", excludeTaskID).
+		Find(&tasks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[uint][]models.Task, len(userIDs))
+	for _, task := range tasks {
+		seen := map[uint]bool{}
+		if task.AssignedTo != nil {
+			seen[*task.AssignedTo] = true
+		}
+		for _, assignee := range task.Assignees {
+			seen[assignee.ID] = true
+		}
+		for id := range seen {
+			byUser[id] = append(byUser[id], task)
+		}
+	}
+	return byUser, nil
+}
+
+// plannedLoad is the working time within [from, to) taken up by tasks. A
+// task whose Seconds estimate is smaller than its planned window only
+// counts in proportion.
+func plannedLoad(tasks []models.Task, hours schedule.WorkingHours, from, to time.Time) time.Duration {
+	var load time.Duration
+	for _, other := range tasks {
+		if !other.ActualEndTime.IsZero() {
+			continue
+		}
+		start, end := other.PlannedStartTime, other.PlannedEndTime
+		if !start.Before(to) || !end.After(from) {
+			continue
+		}
+
+		overlapStart, overlapEnd := start, end
+		if overlapStart.Before(from) {
+			overlapStart = from
+		}
+		if overlapEnd.After(to) {
+			overlapEnd = to
+		}
+		overlap := hours.Overlap(overlapStart, overlapEnd)
+
+		if other.Seconds > 0 {
+			if window := hours.Overlap(start, end); window > 0 {
+				share := math.Min(1, float64(time.Duration(other.Seconds)*time.Second)/float64(window))
+				overlap = time.Duration(float64(overlap) * share)
+			}
+		}
+		load += overlap
+	}
+	return load
+}
+
+// evaluateCandidate checks whether user can take task on top of planned,
+// the other tasks they are assigned to.
+func evaluateCandidate(task models.Task, user models.User, planned []models.Task) (assignmentCandidate, error) {
+	candidate := assignmentCandidate{
+		UserID:         user.ID,
+		Name:           user.Username,
+		LastAssignedAt: user.LastAssignedAt,
+	}
+
+	for _, skill := range task.RequiredSkills {
+		if !user.Skills.Contains(skill) {
+			candidate.MissingSkills = append(candidate.MissingSkills, skill)
+		}
+	}
+
+	hours, err := userCalendar(user)
+	if err != nil {
+		candidate.Reason = "invalid working calendar: " + err.Error()
+		return candidate, nil
+	}
+
+	capacity := hours.Overlap(task.PlannedStartTime, task.PlannedEndTime)
+	load := plannedLoad(planned, hours, task.PlannedStartTime, task.PlannedEndTime)
+
+	required := capacity
+	if task.Seconds > 0 {
+		required = time.Duration(task.Seconds) * time.Second
+	}
+
+	candidate.CapacityMinutes = int64(capacity / time.Minute)
+	candidate.LoadMinutes = int64(load / time.Minute)
+	candidate.RequiredMinutes = int64(required / time.Minute)
+	candidate.FreeMinutes = candidate.CapacityMinutes - candidate.LoadMinutes
+	if capacity > 0 {
+		candidate.Utilization = math.Round(float64(load+required)/float64(capacity)*100) / 100
+	}
+
+	switch {
+	case len(candidate.MissingSkills) > 0:
+		candidate.Reason = "missing skills: " + strings.Join(candidate.MissingSkills, ", ")
+	case capacity == 0:
+		candidate.Reason = "no working hours within the planned window"
+	case load+required > capacity:
+		candidate.Reason = fmt.Sprintf("needs %d minutes but only %d are free", candidate.RequiredMinutes, candidate.FreeMinutes)
+	default:
+		candidate.Eligible = true
+		candidate.Reason = fmt.Sprintf("has the required skills and %d of %d working minutes free", candidate.FreeMinutes, candidate.CapacityMinutes)
+	}
+	return candidate, nil
+}
+
+// pickAssignee chooses who should work on task. Eligible candidates have
+// every required skill and enough free working time in the planned window;
+// among them the least utilized wins, and near-ties go to whoever was
+// auto-assigned least recently.
+func pickAssignee(task models.Task, opts autoAssignOptions) (*models.User, assignmentExplanation, error) {
+	var explanation assignmentExplanation
+
+	if task.PlannedStartTime.IsZero() || !task.PlannedStartTime.Before(task.PlannedEndTime) {
+		return nil, explanation, errNoPlannedWindow
+	}
+
+	users, err := autoAssignPool(task, opts)
+	if err != nil {
+		return nil, explanation, err
+	}
+
+	ids := make([]uint, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	planned, err := plannedTasks(ids, task.ID)
+	if err != nil {
+		return nil, explanation, err
+	}
+
+	byID := make(map[uint]models.User, len(users))
+	for _, user := range users {
+		candidate, err := evaluateCandidate(task, user, planned[user.ID])
+		if err != nil {
+			return nil, explanation, err
+		}
+		explanation.Candidates = append(explanation.Candidates, candidate)
+		byID[user.ID] = user
+	}
+
+	sort.SliceStable(explanation.Candidates, func(i, j int) bool {
+		a, b := explanation.Candidates[i], explanation.Candidates[j]
+		if a.Eligible != b.Eligible {
+			return a.Eligible
+		}
+		bucketA := math.Floor(a.Utilization / utilizationBucket)
+		bucketB := math.Floor(b.Utilization / utilizationBucket)
+		if bucketA != bucketB {
+			return bucketA < bucketB
+		}
+		if (a.LastAssignedAt == nil) != (b.LastAssignedAt == nil) {
+			return a.LastAssignedAt == nil
+		}
+		if a.LastAssignedAt != nil && !a.LastAssignedAt.Equal(*b.LastAssignedAt) {
+			return a.LastAssignedAt.Before(*b.LastAssignedAt)
+		}
+		return a.UserID < b.UserID
+	})
+
+	if len(explanation.Candidates) == 0 || !explanation.Candidates[0].Eligible {
+		explanation.Summary = errNoEligibleAssignee.Error()
+		return nil, explanation, errNoEligibleAssignee
+	}
+
+	chosen := explanation.Candidates[0]
+	explanation.ChosenUserID = &chosen.UserID
+	explanation.Summary = fmt.Sprintf("%s %s; utilization in the planned window would be %.0f%%",
+		chosen.Name, chosen.Reason, chosen.Utilization*100)
+	if len(explanation.Candidates) > 1 && explanation.Candidates[1].Eligible &&
+		math.Floor(explanation.Candidates[1].Utilization/utilizationBucket) == math.Floor(chosen.Utilization/utilizationBucket) {
+		explanation.Summary += fmt.Sprintf(", and was picked over %s by round-robin", explanation.Candidates[1].Name)
+	}
+
+	user := byID[chosen.UserID]
+	return &user, explanation, nil
+}
+
+// applyAutoAssignment assigns task to user and records the assignment for
+// round-robin.
+func applyAutoAssignment(task *models.Task, user *models.User) error {
+	now := time.Now()
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := setPrimaryAssignee(tx, task.ID, derefUint(task.AssignedTo), user); err != nil {
+			return err
+		}
+		if err := tx.Model(user).Update("last_assigned_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Select("version").First(task, task.ID).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	task.AssignedTo = &user.ID
+	task.User = user
+	user.LastAssignedAt = &now
+	return nil
+}
+
+// AutoAssignTask picks an assignee for a task based on working hours,
+// planned workload, skills and round-robin fairness, and explains the
+// choice. With dry_run the task is left unchanged.
+func AutoAssignTask(c *gin.Context) {
+	var input struct {
+		TaskID       uint   `json:"task_id"`
+		TeamID       *uint  `json:"team_id"`
+		CandidateIDs []uint `json:"candidate_ids"`
+		DryRun       bool   `json:"dry_run"`
+	}
+	if err := bindTaskInput(c, &input, &input.TaskID); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	var task models.Task
+	if err := config.DB.First(&task, input.TaskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	user, explanation, err := pickAssignee(task, autoAssignOptions{TeamID: input.TeamID, CandidateIDs: input.CandidateIDs})
+	switch {
+	case errors.Is(err, errNoPlannedWindow):
+		problem.Validation(c, err)
+		return
+	case errors.Is(err, errNoEligibleAssignee):
+		problem.Respond(c, http.StatusConflict, "no_eligible_assignee", err.Error(), gin.H{"explanation": explanation})
+		return
+	case err != nil:
+		problem.Internal(c, "Failed to evaluate candidates", err)
+		return
+	}
+
+	if input.DryRun {
+		c.JSON(http.StatusOK, gin.H{"message": "Dry run: task not assigned", "task": task, "explanation": explanation})
+		return
+	}
+
+	previous := derefUint(task.AssignedTo)
+	if err := applyAutoAssignment(&task, user); err != nil {
+		problem.Internal(c, "Failed to assign task", err)
+		return
+	}
+	recordTaskAudit(c, models.AuditTaskAssigned, task.ID, models.FieldChanges{
+		{Field: "assigned_to", Before: auditID(previous), After: user.ID},
+	}, explanation.Summary)
+
+	if loaded, err := loadTaskWithParticipants(task.ID); err == nil {
+		notifyUsers(c, taskParticipantIDs(*loaded), "task_assigned", fmt.Sprintf("Task %q was assigned to %s", task.Title, user.Username), loaded)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Task assigned successfully", "task": task, "explanation": explanation})
+}
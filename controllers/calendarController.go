@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/schedule"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// holidaySet loads the global holidays plus, when userID is set, that
+// user's personal days off.
+func holidaySet(userID *uint) (map[string]bool, error) {
+	query := config.DB.Model(&models.Holiday{})
+	if userID != nil {
+		query = query.Where("user_id IS NULL OR user_id = ?", *userID)
+	} else {
+		query = query.Where("user_id IS NULL")
+	}
+
+	var dates []string
+	if err := query.Pluck("date", &dates).Error; err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool, len(dates))
+	for _, date := range dates {
+		set[date] = true
+	}
+	return set, nil
+}
+
+// userCalendar is the user's working hours in their time zone, minus
+// holidays.
+func userCalendar(user models.User) (schedule.WorkingHours, error) {
+	hours, err := schedule.Parse(user.WorkStart, user.WorkEnd, user.WorkDays)
+	if err != nil {
+		return hours, err
+	}
+	if hours.Location, err = schedule.LoadLocation(user.TimeZone); err != nil {
+		return hours, err
+	}
+	hours.Holidays, err = holidaySet(&user.ID)
+	return hours, err
+}
+
+// defaultCalendar applies to tasks without an assignee: standard working
+// hours in DEFAULT_TIME_ZONE, minus global holidays.
+func defaultCalendar() (schedule.WorkingHours, error) {
+	hours, err := schedule.Parse("", "", "")
+	if err != nil {
+		return hours, err
+	}
+	if hours.Location, err = schedule.LoadLocation(os.Getenv("DEFAULT_TIME_ZONE")); err != nil {
+		return hours, err
+	}
+	hours.Holidays, err = holidaySet(nil)
+	return hours, err
+}
+
+// taskCalendar is the calendar of the task's assignee, or the default one.
+func taskCalendar(assignedTo *uint) (schedule.WorkingHours, error) {
+	if assignedTo != nil {
+		var user models.User
+		if err := config.DB.First(&user, *assignedTo).Error; err == nil {
+			return userCalendar(user)
+		}
+	}
+	return defaultCalendar()
+}
+
+// fillPlannedEnd sets a missing planned end to the point where the task's
+// Seconds estimate of working time has elapsed on the assignee's calendar.
+func fillPlannedEnd(task *models.Task) error {
+	if !task.PlannedEndTime.IsZero() || task.PlannedStartTime.IsZero() || task.Seconds <= 0 {
+		return nil
+	}
+
+	calendar, err := taskCalendar(task.AssignedTo)
+	if err != nil {
+		return err
+	}
+	end, err := calendar.AddWorkingTime(task.PlannedStartTime, time.Duration(task.Seconds)*time.Second)
+	if err != nil {
+		return err
+	}
+	task.PlannedEndTime = end
+	return nil
+}
+
+func GetHolidays(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var holidays []models.Holiday
+	if err := config.DB.Where("user_id IS NULL OR user_id = ?", user.ID).Order("date").Find(&holidays).Error; err != nil {
+		problem.Internal(c, "Failed to fetch holidays", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"holidays": holidays})
+}
+
+// CreateHoliday adds a day off. Personal days off are recorded for the
+// current user; global holidays need an admin or manager.
+func CreateHoliday(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		Date     string `json:"date" binding:"required"`
+		Name     string `json:"name"`
+		Personal bool   `json:"personal"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if _, err := time.Parse(schedule.DateLayout, input.Date); err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_date", "Invalid date: use YYYY-MM-DD")
+		return
+	}
+
+	holiday := models.Holiday{Date: input.Date, Name: input.Name}
+	if input.Personal {
+		holiday.UserID = &user.ID
+	} else if user.Role != models.RoleAdmin && user.Role != models.RoleManager {
+		problem.Respond(c, http.StatusForbidden, "insufficient_permissions", "Only admins and managers can add global holidays")
+		return
+	}
+
+	if err := config.DB.Create(&holiday).Error; err != nil {
+		problem.Internal(c, "Failed to create holiday", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Holiday created successfully", "holiday": holiday})
+}
+
+func DeleteHoliday(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var holiday models.Holiday
+	if err := config.DB.First(&holiday, c.Query("holiday_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "holiday_not_found", "Holiday not found")
+		return
+	}
+
+	personal := holiday.UserID != nil && *holiday.UserID == user.ID
+	if !personal && user.Role != models.RoleAdmin && user.Role != models.RoleManager {
+		problem.Respond(c, http.StatusForbidden, "insufficient_permissions", "Insufficient permissions")
+		return
+	}
+
+	if err := config.DB.Delete(&holiday).Error; err != nil {
+		problem.Internal(c, "Failed to delete holiday", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Holiday deleted successfully"})
+}
+
+// GetWorkingTime answers calendar questions for a user (default: the
+// current one): how much working time lies between start and end, and when
+// seconds of work starting at start will be done.
+func GetWorkingTime(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		UserID  uint   `form:"user_id"`
+		Start   string `form:"start" binding:"required"`
+		End     string `form:"end"`
+		Seconds int64  `form:"seconds"`
+	}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if input.UserID != 0 && input.UserID != user.ID {
+		if err := config.DB.First(&user, input.UserID).Error; err != nil {
+			problem.Respond(c, http.StatusNotFound, "user_not_found", "User not found")
+			return
+		}
+	}
+
+	calendar, err := userCalendar(user)
+	if err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_calendar", "Invalid calendar: "+err.Error())
+		return
+	}
+
+	start, err := time.Parse(time.RFC3339, input.Start)
+	if err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_time", "Invalid start: use RFC 3339")
+		return
+	}
+
+	result := gin.H{"user_id": user.ID, "time_zone": calendar.Location.String(), "start": start.In(calendar.Location)}
+
+	if input.End != "" {
+		end, err := time.Parse(time.RFC3339, input.End)
+		if err != nil {
+			problem.Respond(c, http.StatusBadRequest, "invalid_time", "Invalid end: use RFC 3339")
+			return
+		}
+		result["end"] = end.In(calendar.Location)
+		result["working_seconds"] = int64(calendar.Overlap(start, end) / time.Second)
+	}
+
+	if input.Seconds > 0 {
+		due, err := calendar.AddWorkingTime(start, time.Duration(input.Seconds)*time.Second)
+		if err != nil {
+			problem.Validation(c, err)
+			return
+		}
+		result["due_at"] = due
+	}
+
+	c.JSON(http.StatusOK, result)
+}
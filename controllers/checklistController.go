@@ -0,0 +1,346 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/websocket"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxChecklistTextLength = 500
+
+func validateChecklistText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || len(text) > maxChecklistTextLength {
+		return "", problem.FieldError{Field: "text", Code: "length", Message: fmt.Sprintf("checklist text must be 1 to %d characters", maxChecklistTextLength)}
+	}
+	return text, nil
+}
+
+// moveChecklistItem places itemID at position among its task's items and
+// renumbers the others; position -1 puts it last. With itemID 0 it only
+// closes the gaps left by deleted items.
+func moveChecklistItem(tx *gorm.DB, taskID, itemID uint, position int) error {
+	var items []models.ChecklistItem
+	if err := tx.Where("task_id = ?", taskID).Order("position, id").Find(&items).Error; err != nil {
+		return err
+	}
+
+	var moved *models.ChecklistItem
+	ordered := make([]models.ChecklistItem, 0, len(items))
+	for i := range items {
+		if items[i].ID == itemID {
+			moved = &items[i]
+		} else {
+			ordered = append(ordered, items[i])
+		}
+	}
+	if moved != nil {
+		if position < 0 || position > len(ordered) {
+			position = len(ordered)
+		}
+		ordered = append(ordered[:position], append([]models.ChecklistItem{*moved}, ordered[position:]...)...)
+	}
+
+	for i, item := range ordered {
+		if item.Position != i {
+			if err := tx.Model(&models.ChecklistItem{}).Where("id = ?", item.ID).Update("position", i).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// broadcastTaskUpdated sends a task_updated event with the task's checklist.
+func broadcastTaskUpdated(taskID uint) {
+	var task models.Task
+	if err := config.DB.Preload("Checklist", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).First(&task, taskID).Error; err == nil {
+		websocket.GetManager().SendNotification("task_updated", task)
+	}
+}
+
+// checklistSnapshot lists a task's items as "[x] text" or "[ ] text", in
+// order, for the audit log.
+func checklistSnapshot(taskID uint) []string {
+	var items []models.ChecklistItem
+	config.DB.Where("task_id = ?", taskID).Order("position").Find(&items)
+	snapshot := make([]string, 0, len(items))
+	for _, item := range items {
+		mark := "[ ] "
+		if item.Done {
+			mark = "[x] "
+		}
+		snapshot = append(snapshot, mark+item.Text)
+	}
+	return snapshot
+}
+
+// recordChecklistAudit records a checklist change of a task, if any.
+func recordChecklistAudit(c *gin.Context, taskID uint, before []string) {
+	after := checklistSnapshot(taskID)
+	if !reflect.DeepEqual(before, after) {
+		recordTaskAudit(c, models.AuditTaskUpdated, taskID, models.FieldChanges{
+			{Field: "checklist", Before: before, After: after},
+		}, "")
+	}
+}
+
+// checklistResponse returns a task's items in order with its progress.
+func checklistResponse(c *gin.Context, status int, message string, taskID uint) {
+	var task models.Task
+	if err := config.DB.Preload("Checklist", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).First(&task, taskID).Error; err != nil {
+		problem.Internal(c, "Failed to fetch checklist", err)
+		return
+	}
+
+	done := 0
+	for _, item := range task.Checklist {
+		if item.Done {
+			done++
+		}
+	}
+	response := gin.H{
+		"task_id":   task.ID,
+		"checklist": task.Checklist,
+		"done":      done,
+		"total":     len(task.Checklist),
+		"progress":  task.Progress,
+	}
+	if message != "" {
+		response["message"] = message
+	}
+	c.JSON(status, response)
+}
+
+func GetChecklist(c *gin.Context) {
+	var task models.Task
+	if err := config.DB.Select("id").First(&task, idParam(c, "task_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	checklistResponse(c, http.StatusOK, "", task.ID)
+}
+
+// AddChecklistItem appends an item to a task's checklist, or inserts it at
+// position.
+func AddChecklistItem(c *gin.Context) {
+	var input struct {
+		TaskID   uint   `json:"task_id"`
+		Text     string `json:"text"`
+		Position *int   `json:"position"`
+	}
+	if err := bindTaskInput(c, &input, &input.TaskID); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+	text, err := validateChecklistText(input.Text)
+	if err != nil {
+		problem.Validation(c, err)
+		return
+	}
+
+	var task models.Task
+	if err := config.DB.First(&task, input.TaskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	before := checklistSnapshot(task.ID)
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.ChecklistItem{}).Where("task_id = ?", task.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		item := models.ChecklistItem{TaskID: task.ID, Position: int(count), Text: text}
+		if err := tx.Create(&item).Error; err != nil {
+			return err
+		}
+		if input.Position != nil {
+			if err := moveChecklistItem(tx, task.ID, item.ID, *input.Position); err != nil {
+				return err
+			}
+		}
+		if err := refreshRollup(tx, &task.ID); err != nil {
+			return err
+		}
+		return bumpVersion(tx, task.ID)
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to add checklist item", err)
+		return
+	}
+	recordChecklistAudit(c, task.ID, before)
+	broadcastTaskUpdated(task.ID)
+
+	checklistResponse(c, createdStatus(c), "Checklist item added successfully", task.ID)
+}
+
+// UpdateChecklistItem changes an item's text, completion or position.
+func UpdateChecklistItem(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var item models.ChecklistItem
+	if err := config.DB.First(&item, idParam(c, "item_id")).Error; err != nil || !inPathTask(c, item.TaskID) {
+		problem.Respond(c, http.StatusNotFound, "checklist_item_not_found", "Checklist item not found")
+		return
+	}
+
+	var input struct {
+		Text     *string `json:"text"`
+		Done     *bool   `json:"done"`
+		Position *int    `json:"position"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	changes := map[string]interface{}{}
+	if input.Text != nil {
+		text, err := validateChecklistText(*input.Text)
+		if err != nil {
+			problem.Validation(c, err)
+			return
+		}
+		changes["text"] = text
+	}
+	if input.Done != nil && *input.Done != item.Done {
+		changes["done"] = *input.Done
+		if *input.Done {
+			changes["done_at"], changes["done_by_id"] = time.Now(), user.ID
+		} else {
+			changes["done_at"], changes["done_by_id"] = nil, nil
+		}
+	}
+
+	before := checklistSnapshot(item.TaskID)
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if len(changes) > 0 {
+			if err := tx.Model(&item).Updates(changes).Error; err != nil {
+				return err
+			}
+		}
+		if input.Position != nil {
+			if err := moveChecklistItem(tx, item.TaskID, item.ID, *input.Position); err != nil {
+				return err
+			}
+		}
+		if err := refreshRollup(tx, &item.TaskID); err != nil {
+			return err
+		}
+		return bumpVersion(tx, item.TaskID)
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to update checklist item", err)
+		return
+	}
+	recordChecklistAudit(c, item.TaskID, before)
+	broadcastTaskUpdated(item.TaskID)
+
+	checklistResponse(c, http.StatusOK, "Checklist item updated successfully", item.TaskID)
+}
+
+func DeleteChecklistItem(c *gin.Context) {
+	var item models.ChecklistItem
+	if err := config.DB.First(&item, idParam(c, "item_id")).Error; err != nil || !inPathTask(c, item.TaskID) {
+		problem.Respond(c, http.StatusNotFound, "checklist_item_not_found", "Checklist item not found")
+		return
+	}
+
+	before := checklistSnapshot(item.TaskID)
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&item).Error; err != nil {
+			return err
+		}
+		if err := moveChecklistItem(tx, item.TaskID, 0, 0); err != nil {
+			return err
+		}
+		if err := refreshRollup(tx, &item.TaskID); err != nil {
+			return err
+		}
+		return bumpVersion(tx, item.TaskID)
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to delete checklist item", err)
+		return
+	}
+	recordChecklistAudit(c, item.TaskID, before)
+	broadcastTaskUpdated(item.TaskID)
+
+	if versionedAPI(c) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	checklistResponse(c, http.StatusOK, "Checklist item deleted successfully", item.TaskID)
+}
+
+// ConvertChecklistItem turns an item into a subtask of its task. The subtask
+// takes the item's text as title, is done when the item was, and inherits
+// the task's project, priority and custom field values.
+func ConvertChecklistItem(c *gin.Context) {
+	var item models.ChecklistItem
+	if err := config.DB.First(&item, idParam(c, "item_id")).Error; err != nil || !inPathTask(c, item.TaskID) {
+		problem.Respond(c, http.StatusNotFound, "checklist_item_not_found", "Checklist item not found")
+		return
+	}
+
+	var task models.Task
+	if err := config.DB.First(&task, item.TaskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	subtask := models.Task{
+		Title:        item.Text,
+		ParentID:     &task.ID,
+		Project:      task.Project,
+		Priority:     task.Priority,
+		Status:       models.TaskStatusOpen,
+		CustomFields: task.CustomFields,
+	}
+	if item.Done {
+		subtask.Status = models.TaskStatusDone
+	}
+
+	before := checklistSnapshot(task.ID)
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Team", "Assignees", "Reviewers", "Children", "Labels", "Checklist").Create(&subtask).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&item).Error; err != nil {
+			return err
+		}
+		if err := moveChecklistItem(tx, task.ID, 0, 0); err != nil {
+			return err
+		}
+		if err := bumpVersion(tx, task.ID); err != nil {
+			return err
+		}
+		if err := refreshRollup(tx, &subtask.ID); err != nil {
+			return err
+		}
+		return tx.First(&subtask, subtask.ID).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to convert checklist item", err)
+		return
+	}
+	trackTaskSLA(subtask)
+	recordTaskAudit(c, models.AuditTaskCreated, subtask.ID, nil, fmt.Sprintf("Converted from a checklist item of task %d", task.ID))
+	recordChecklistAudit(c, task.ID, before)
+
+	websocket.GetManager().SendNotification("task_created", subtask)
+	broadcastTaskUpdated(task.ID)
+
+	respondCreated(c, fmt.Sprintf("/api/v1/tasks/%d", subtask.ID), gin.H{"message": "Checklist item converted to a subtask", "task": subtask})
+}
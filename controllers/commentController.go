@@ -0,0 +1,311 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/websocket"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxCommentLength = 10000
+
+var (
+	mentionPattern   = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9][A-Za-z0-9._-]*)`)
+	codeBlockPattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+)
+
+// mentionedUsers resolves the @name mentions in a markdown body to active
+// users by name, ignoring mentions inside code.
+func mentionedUsers(body string) ([]models.User, error) {
+	text := codeBlockPattern.ReplaceAllString(body, " ")
+
+	seen := map[string]bool{}
+	var names []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(strings.TrimRight(match[1], "._-"))
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	var users []models.User
+	if len(names) == 0 {
+		return users, nil
+	}
+	err := config.DB.Where("LOWER(username) IN ? AND deactivated_at IS NULL", names).Order("id").Find(&users).Error
+	return users, err
+}
+
+func validateCommentBody(body string) error {
+	if strings.TrimSpace(body) == "" {
+		return problem.FieldError{Field: "body", Code: "required", Message: "comment body is required"}
+	}
+	if len(body) > maxCommentLength {
+		return problem.FieldError{Field: "body", Code: "length", Message: fmt.Sprintf("comment body must be at most %d characters", maxCommentLength)}
+	}
+	return nil
+}
+
+// commentThreads nests comments into threads, oldest first.
+func commentThreads(comments []models.Comment) []models.Comment {
+	children := map[uint][]int{}
+	var roots []int
+	ids := map[uint]bool{}
+	for _, comment := range comments {
+		ids[comment.ID] = true
+	}
+	for i, comment := range comments {
+		if comment.ParentID != nil && ids[*comment.ParentID] {
+			children[*comment.ParentID] = append(children[*comment.ParentID], i)
+		} else {
+			roots = append(roots, i)
+		}
+	}
+
+	var build func(i int) models.Comment
+	build = func(i int) models.Comment {
+		comment := comments[i]
+		comment.Replies = nil
+		for _, child := range children[comment.ID] {
+			comment.Replies = append(comment.Replies, build(child))
+		}
+		return comment
+	}
+
+	threads := make([]models.Comment, 0, len(roots))
+	for _, i := range roots {
+		threads = append(threads, build(i))
+	}
+	return threads
+}
+
+// notifyMentions tells mentioned users about a comment on task.
+func notifyMentions(c *gin.Context, mentioned []models.User, task models.Task) {
+	author := c.MustGet("user").(models.User)
+
+	var ids []uint
+	for _, user := range mentioned {
+		ids = append(ids, user.ID)
+	}
+	notifyUsers(c, ids, "comment_mention", fmt.Sprintf("%s mentioned you on task %q", author.Username, task.Title), &task)
+}
+
+// GetComments returns a task's comments as threads.
+func GetComments(c *gin.Context) {
+	var task models.Task
+	if err := config.DB.First(&task, idParam(c, "task_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	var comments []models.Comment
+	if err := config.DB.Preload("Author").Preload("Mentions").Where("task_id = ?", task.ID).Order("id").Find(&comments).Error; err != nil {
+		problem.Internal(c, "Failed to fetch comments", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"comments": commentThreads(comments)})
+}
+
+// CreateComment adds a comment to a task, or a reply when parent_id is set.
+func CreateComment(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		TaskID   uint   `json:"task_id"`
+		ParentID *uint  `json:"parent_id"`
+		Body     string `json:"body"`
+	}
+	if err := bindTaskInput(c, &input, &input.TaskID); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+	if err := validateCommentBody(input.Body); err != nil {
+		problem.Validation(c, err)
+		return
+	}
+
+	var task models.Task
+	if err := config.DB.First(&task, input.TaskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	var parent *models.Comment
+	if input.ParentID != nil {
+		parent = &models.Comment{}
+		if err := config.DB.Where("task_id = ?", task.ID).First(parent, *input.ParentID).Error; err != nil {
+			problem.Respond(c, http.StatusNotFound, "parent_comment_not_found", "Parent comment not found")
+			return
+		}
+	}
+
+	mentioned, err := mentionedUsers(input.Body)
+	if err != nil {
+		problem.Internal(c, "Failed to resolve mentions", err)
+		return
+	}
+
+	comment := models.Comment{
+		TaskID:   task.ID,
+		ParentID: input.ParentID,
+		AuthorID: user.ID,
+		Body:     input.Body,
+		Mentions: mentioned,
+	}
+	if err := config.DB.Omit("Mentions.*").Create(&comment).Error; err != nil {
+		problem.Internal(c, "Failed to create comment", err)
+		return
+	}
+	comment.Author = &user
+
+	websocket.GetManager().SendAuthenticatedNotification("comment_created", comment)
+	notifyMentions(c, mentioned, task)
+	if parent != nil {
+		notifyUsers(c, []uint{parent.AuthorID}, "comment_reply", fmt.Sprintf("%s replied to your comment on task %q", user.Username, task.Title), &task)
+	}
+
+	respondCreated(c, "", gin.H{"message": "Comment created successfully", "comment": comment})
+}
+
+// UpdateComment lets the author edit a comment. The previous body is kept
+// in the history and users mentioned for the first time are notified.
+func UpdateComment(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var comment models.Comment
+	if err := config.DB.Preload("Mentions").First(&comment, idParam(c, "comment_id")).Error; err != nil || comment.DeletedAt != nil || !inPathTask(c, comment.TaskID) {
+		problem.Respond(c, http.StatusNotFound, "comment_not_found", "Comment not found")
+		return
+	}
+	if comment.AuthorID != user.ID {
+		problem.Respond(c, http.StatusForbidden, "not_comment_author", "Only the author can edit a comment")
+		return
+	}
+
+	var input struct {
+		Body string `json:"body"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+	if err := validateCommentBody(input.Body); err != nil {
+		problem.Validation(c, err)
+		return
+	}
+
+	mentioned, err := mentionedUsers(input.Body)
+	if err != nil {
+		problem.Internal(c, "Failed to resolve mentions", err)
+		return
+	}
+
+	known := map[uint]bool{}
+	for _, previous := range comment.Mentions {
+		known[previous.ID] = true
+	}
+	var added []models.User
+	for _, mention := range mentioned {
+		if !known[mention.ID] {
+			added = append(added, mention)
+		}
+	}
+
+	now := time.Now()
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		revision := models.CommentRevision{CommentID: comment.ID, Action: models.CommentEdited, Body: comment.Body, EditorID: user.ID}
+		if err := tx.Create(&revision).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&comment).Updates(map[string]interface{}{"body": input.Body, "edited_at": now}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&comment).Association("Mentions").Replace(mentioned)
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to update comment", err)
+		return
+	}
+	comment.Body, comment.EditedAt, comment.Mentions = input.Body, &now, mentioned
+
+	var task models.Task
+	config.DB.First(&task, comment.TaskID)
+
+	websocket.GetManager().SendAuthenticatedNotification("comment_updated", comment)
+	notifyMentions(c, added, task)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Comment updated successfully", "comment": comment})
+}
+
+// DeleteComment removes a comment's body but keeps its place in the thread
+// so replies stay readable. Authors can delete their own comments, admins
+// and managers any comment.
+func DeleteComment(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var comment models.Comment
+	if err := config.DB.First(&comment, idParam(c, "comment_id")).Error; err != nil || comment.DeletedAt != nil || !inPathTask(c, comment.TaskID) {
+		problem.Respond(c, http.StatusNotFound, "comment_not_found", "Comment not found")
+		return
+	}
+	if comment.AuthorID != user.ID && user.Role != models.RoleAdmin && user.Role != models.RoleManager {
+		problem.Respond(c, http.StatusForbidden, "insufficient_permissions", "Insufficient permissions")
+		return
+	}
+
+	now := time.Now()
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		revision := models.CommentRevision{CommentID: comment.ID, Action: models.CommentDeleted, Body: comment.Body, EditorID: user.ID}
+		if err := tx.Create(&revision).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&comment).Updates(map[string]interface{}{"body": "", "deleted_at": now}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&comment).Association("Mentions").Clear()
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to delete comment", err)
+		return
+	}
+	comment.Body, comment.DeletedAt = "", &now
+
+	websocket.GetManager().SendAuthenticatedNotification("comment_deleted", comment)
+
+	respondDeleted(c, gin.H{"message": "Comment deleted successfully"})
+}
+
+// GetCommentHistory lists the earlier versions of a comment, oldest first.
+// The history of a deleted comment holds the removed body, so only its
+// author and admins may read it.
+func GetCommentHistory(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var comment models.Comment
+	if err := config.DB.First(&comment, idParam(c, "comment_id")).Error; err != nil || !inPathTask(c, comment.TaskID) {
+		problem.Respond(c, http.StatusNotFound, "comment_not_found", "Comment not found")
+		return
+	}
+	if comment.DeletedAt != nil && comment.AuthorID != user.ID && user.Role != models.RoleAdmin {
+		problem.Respond(c, http.StatusForbidden, "insufficient_permissions", "Only the author and admins can see the history of a deleted comment")
+		return
+	}
+
+	var revisions []models.CommentRevision
+	if err := config.DB.Where("comment_id = ?", comment.ID).Order("id").Find(&revisions).Error; err != nil {
+		problem.Internal(c, "Failed to fetch comment history", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"comment": comment, "revisions": revisions})
+}
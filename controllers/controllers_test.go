@@ -3,16 +3,29 @@ package controllers
 import (
 	"bytes"
 	"dtms/config"
+	"dtms/mailer"
+	"dtms/middleware"
 	"dtms/models"
+	"dtms/problem"
+	"dtms/totp"
 	"dtms/websocket"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/bcrypt"
@@ -22,33 +35,274 @@ func setup() {
 	gin.SetMode(gin.TestMode)
 
 	websocket.InitWebSocketManager()
+	mailer.InitMailer(sentMail)
+	sentMail.messages = nil
+	sendInBackground = func(job func()) { job() }
 
 	config.ConnectDatabase()
 
-	if err := config.DB.AutoMigrate(&models.User{}, &models.Task{}); err != nil {
+	key, err := config.GenerateSigningKey("test-key", "EdDSA")
+	if err != nil {
+		panic(fmt.Sprintf("Failed to generate signing key: %v", err))
+	}
+	config.Keys = config.NewKeySet(key)
+
+	if err := config.DB.AutoMigrate(models.All()...); err != nil {
 		panic(fmt.Sprintf("Failed to migrate the test database: %v", err))
 	}
 	config.DB.Exec("DELETE FROM users")
 	config.DB.Exec("DELETE FROM tasks")
+	config.DB.Exec("DELETE FROM user_tokens")
+	config.DB.Exec("DELETE FROM organizations")
+	config.DB.Exec("DELETE FROM recovery_codes")
+	config.DB.Exec("DELETE FROM login_throttles")
+	config.DB.Exec("DELETE FROM audit_events")
+	config.DB.Exec("DELETE FROM teams")
+	config.DB.Exec("DELETE FROM team_members")
+	config.DB.Exec("DELETE FROM task_assignees")
+	config.DB.Exec("DELETE FROM task_reviewers")
+	config.DB.Exec("DELETE FROM notifications")
+	config.DB.Exec("DELETE FROM holidays")
+	config.DB.Exec("DELETE FROM task_reminders")
+	config.DB.Exec("DELETE FROM sla_policies")
+	config.DB.Exec("DELETE FROM sla_escalation_steps")
+	config.DB.Exec("DELETE FROM task_slas")
+	config.DB.Exec("DELETE FROM sla_escalations")
+	config.DB.Exec("DELETE FROM sla_breaches")
+	config.DB.Exec("DELETE FROM comments")
+	config.DB.Exec("DELETE FROM comment_mentions")
+	config.DB.Exec("DELETE FROM comment_revisions")
+	config.DB.Exec("DELETE FROM blobs")
+	config.DB.Exec("DELETE FROM attachments")
+	config.DB.Exec("DELETE FROM custom_fields")
+	config.DB.Exec("DELETE FROM labels")
+	config.DB.Exec("DELETE FROM task_labels")
+	config.DB.Exec("DELETE FROM checklist_items")
+	config.DB.Exec("DELETE FROM idempotency_keys")
+}
+
+type capturingMailer struct {
+	messages []mailer.Message
+}
+
+func (m *capturingMailer) Send(msg mailer.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+var sentMail = &capturingMailer{}
+
+var mailTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+func lastMailedToken(t *testing.T) string {
+	if !assert.NotEmpty(t, sentMail.messages, "Expected an email to be sent") {
+		t.FailNow()
+	}
+	match := mailTokenPattern.FindStringSubmatch(sentMail.messages[len(sentMail.messages)-1].Body)
+	if !assert.Len(t, match, 2, "Expected a token link in the email") {
+		t.FailNow()
+	}
+	return match[1]
+}
+
+func postJSON(r *gin.Engine, path string, payload interface{}) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(payload)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// testAuth stands in for AuthMiddleware: requests carrying an X-Test-User
+// header run as that user.
+func testAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id := c.GetHeader("X-Test-User"); id != "" {
+			var user models.User
+			if err := config.DB.First(&user, id).Error; err != nil {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			c.Set("user", user)
+		}
+		c.Next()
+	}
+}
+
+func postJSONAs(r *gin.Engine, user models.User, path string, payload interface{}) *httptest.ResponseRecorder {
+	return requestAs(r, user, "POST", path, payload)
+}
+
+func requestAs(r *gin.Engine, user models.User, method, path string, payload interface{}) *httptest.ResponseRecorder {
+	var body io.Reader
+	if payload != nil {
+		jsonData, _ := json.Marshal(payload)
+		body = bytes.NewBuffer(jsonData)
+	}
+	req, _ := http.NewRequest(method, path, body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Test-User", fmt.Sprint(user.ID))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
 }
 
 func setupRouter() *gin.Engine {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(middleware.RequestID(), gin.Logger(), gin.CustomRecovery(problem.Recover))
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(problem.NotFound)
+	r.NoMethod(problem.MethodNotAllowed)
 
 	auth := r.Group("/auth")
 	{
 		auth.POST("/register", Register)
 		auth.POST("/login", Login)
+		auth.POST("/login/2fa", LoginTwoFactor)
+		auth.POST("/password/forgot", RequestPasswordReset)
+		auth.GET("/password/reset", CheckPasswordResetToken)
+		auth.POST("/password/reset", ResetPassword)
+		auth.POST("/verify-email/request", RequestEmailVerification)
+		auth.POST("/verify-email", VerifyEmail)
+	}
+	r.GET("/.well-known/jwks.json", JWKS)
+
+	twoFactor := r.Group("/auth/2fa", testAuth())
+	{
+		twoFactor.POST("/enroll", EnrollTwoFactor)
+		twoFactor.POST("/confirm", ConfirmTwoFactor)
+		twoFactor.POST("/disable", DisableTwoFactor)
+	}
+
+	users := r.Group("/users", testAuth())
+	{
+		users.GET("/", GetUsers)
+		users.GET("/me", GetProfile)
+		users.PUT("/me", UpdateProfile)
+		users.PUT("/me/password", ChangePassword)
 	}
 
-	tasks := r.Group("/task")
+	admin := r.Group("/admin", testAuth())
 	{
-		tasks.POST("/create", CreateTask)
-		tasks.POST("/bulkupload", CreateTaskBulk)
+		admin.PUT("/users/deactivate", DeactivateUser)
+		admin.PUT("/users/activate", ActivateUser)
+		admin.GET("/audit", GetAuditEvents)
+	}
+
+	tasks := r.Group("/task", testAuth(), middleware.Deprecated("/api/v1/tasks"))
+	{
+		tasks.POST("/create", middleware.Idempotent(), CreateTask)
+		tasks.POST("/bulkupload", middleware.Idempotent(), CreateTaskBulk)
 		tasks.GET("/", GetTasks)
+		tasks.GET("/export", ExportTasks)
+		tasks.GET("/overdue", GetOverdueReport)
 		tasks.PUT("/update", UpdateTask)
-		tasks.PUT("/assign", AssignTask)
-		tasks.DELETE("/delete", DeleteTask)
+		tasks.PATCH("/update", PatchTask)
+		tasks.PUT("/assign", middleware.Idempotent(), AssignTask)
+		tasks.PUT("/assign/team", middleware.Idempotent(), AssignTaskToTeam)
+		tasks.PUT("/assign/auto", middleware.Idempotent(), AutoAssignTask)
+		tasks.PUT("/participants", SetTaskParticipants)
+		tasks.PUT("/claim", ClaimTask)
+		tasks.PUT("/parent", SetTaskParent)
+		tasks.GET("/tree", GetTaskTree)
+		tasks.GET("/history", GetTaskHistory)
+		tasks.PUT("/labels", UpdateTaskLabels)
+		tasks.GET("/checklist", GetChecklist)
+		tasks.POST("/checklist", AddChecklistItem)
+		tasks.PUT("/checklist", UpdateChecklistItem)
+		tasks.DELETE("/checklist", DeleteChecklistItem)
+		tasks.POST("/checklist/convert", ConvertChecklistItem)
+		tasks.GET("/comments", GetComments)
+		tasks.POST("/comments", CreateComment)
+		tasks.PUT("/comments", UpdateComment)
+		tasks.DELETE("/comments", DeleteComment)
+		tasks.GET("/comments/history", GetCommentHistory)
+		tasks.GET("/attachments", GetAttachments)
+		tasks.POST("/attachments", UploadAttachment)
+		tasks.DELETE("/attachments", DeleteAttachment)
+		tasks.DELETE("/delete", middleware.Idempotent(), DeleteTask)
+	}
+
+	v1 := r.Group("/api/v1", testAuth(), middleware.APIVersion("v1"), middleware.NumericIDs())
+	v1Tasks := v1.Group("/tasks")
+	{
+		v1Tasks.GET("", GetTasks)
+		v1Tasks.POST("", middleware.Idempotent(), CreateTask)
+		v1Tasks.POST("/bulk", middleware.Idempotent(), CreateTaskBulk)
+		v1Tasks.POST("/batch", middleware.Idempotent(), BatchTasks)
+		v1Tasks.GET("/export", ExportTasks)
+		v1Tasks.GET("/overdue", GetOverdueReport)
+		v1Tasks.GET("/tree", GetTaskTree)
+		v1Tasks.PUT("/labels", UpdateTaskLabels)
+
+		v1Tasks.GET("/:task_id", GetTask)
+		v1Tasks.PUT("/:task_id", UpdateTask)
+		v1Tasks.PATCH("/:task_id", PatchTask)
+		v1Tasks.DELETE("/:task_id", middleware.Idempotent(), DeleteTask)
+
+		v1Tasks.PUT("/:task_id/assignee", middleware.Idempotent(), AssignTask)
+		v1Tasks.PUT("/:task_id/team", middleware.Idempotent(), AssignTaskToTeam)
+		v1Tasks.POST("/:task_id/auto-assign", middleware.Idempotent(), AutoAssignTask)
+		v1Tasks.PUT("/:task_id/participants", SetTaskParticipants)
+		v1Tasks.POST("/:task_id/claim", ClaimTask)
+		v1Tasks.PUT("/:task_id/parent", SetTaskParent)
+		v1Tasks.GET("/:task_id/tree", GetTaskTree)
+		v1Tasks.GET("/:task_id/history", GetTaskHistory)
+		v1Tasks.GET("/:task_id/sla", GetTaskSLA)
+
+		v1Tasks.GET("/:task_id/checklist", GetChecklist)
+		v1Tasks.POST("/:task_id/checklist", AddChecklistItem)
+		v1Tasks.PUT("/:task_id/checklist/:item_id", UpdateChecklistItem)
+		v1Tasks.DELETE("/:task_id/checklist/:item_id", DeleteChecklistItem)
+		v1Tasks.POST("/:task_id/checklist/:item_id/convert", ConvertChecklistItem)
+
+		v1Tasks.GET("/:task_id/comments", GetComments)
+		v1Tasks.POST("/:task_id/comments", CreateComment)
+		v1Tasks.PUT("/:task_id/comments/:comment_id", UpdateComment)
+		v1Tasks.DELETE("/:task_id/comments/:comment_id", DeleteComment)
+		v1Tasks.GET("/:task_id/comments/:comment_id/history", GetCommentHistory)
+
+		v1Tasks.GET("/:task_id/attachments", GetAttachments)
+		v1Tasks.POST("/:task_id/attachments", UploadAttachment)
+		v1Tasks.DELETE("/:task_id/attachments/:attachment_id", DeleteAttachment)
+	}
+
+	sla := r.Group("/sla", testAuth())
+	{
+		sla.GET("/policies", GetSLAPolicies)
+		sla.POST("/policies", CreateSLAPolicy)
+		sla.PUT("/policies", UpdateSLAPolicy)
+		sla.DELETE("/policies", DeleteSLAPolicy)
+		sla.GET("/task", GetTaskSLA)
+		sla.GET("/breaches", GetSLABreaches)
+	}
+
+	projects := r.Group("/projects", testAuth())
+	{
+		projects.GET("/fields", GetCustomFields)
+		projects.POST("/fields", CreateCustomField)
+		projects.PUT("/fields", UpdateCustomField)
+		projects.DELETE("/fields", DeleteCustomField)
+	}
+
+	labels := r.Group("/labels", testAuth())
+	{
+		labels.GET("/", GetLabels)
+		labels.POST("/", CreateLabel)
+		labels.GET("/stats", GetLabelStats)
+		labels.PUT("/", UpdateLabel)
+		labels.DELETE("/", DeleteLabel)
+	}
+
+	r.GET("/attachments/download", DownloadAttachment)
+
+	calendar := r.Group("/calendar", testAuth())
+	{
+		calendar.GET("/holidays", GetHolidays)
+		calendar.POST("/holidays", CreateHoliday)
+		calendar.DELETE("/holidays", DeleteHoliday)
+		calendar.GET("/working-time", GetWorkingTime)
 	}
 	return r
 }
@@ -120,6 +374,442 @@ func TestLogin(t *testing.T) {
 	})
 }
 
+func TestPasswordReset(t *testing.T) {
+	setup()
+	router := setupRouter()
+	_ = RegisterUserForTest()
+
+	w := postJSON(router, "/auth/password/forgot", map[string]string{"email": "nobody@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, sentMail.messages, "Expected no email for an unknown address")
+	unknownBody := w.Body.String()
+
+	w = postJSON(router, "/auth/password/forgot", map[string]string{"email": "testuser@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, unknownBody, w.Body.String(), "Expected identical responses for known and unknown emails")
+	assert.Contains(t, sentMail.messages[0].Body, "/auth/password/reset?token=")
+	token := lastMailedToken(t)
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/auth/password/reset?token="+token, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "Expected the emailed link to lead to a route")
+
+	// Sessions from before the reset are revoked.
+	w = postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "Password123"})
+	var session struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &session)
+	me := gin.New()
+	me.GET("/me", middleware.AuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	sessionStatus := func(token string) int {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		me.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNoContent, sessionStatus(session.Token))
+
+	reset := map[string]string{"token": token, "password": "NewPassword456", "confirm_password": "NewPassword456"}
+	w = postJSON(router, "/auth/password/reset", reset)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Password reset successfully")
+	assert.Equal(t, http.StatusUnauthorized, sessionStatus(session.Token))
+
+	w = postJSON(router, "/auth/password/reset", reset)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Expected a used token to be rejected")
+
+	w = postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "NewPassword456"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &session)
+	assert.Equal(t, http.StatusNoContent, sessionStatus(session.Token))
+}
+
+func TestEmailVerification(t *testing.T) {
+	setup()
+	router := setupRouter()
+	t.Setenv("ADMIN_EMAILS", "verify@example.com")
+
+	w := postJSON(router, "/auth/register", map[string]string{
+		"email":            "verify@example.com",
+		"password":         "Password123",
+		"confirm_password": "Password123",
+		"username":         "verify",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	first := lastMailedToken(t)
+
+	// Listed addresses only become administrators once they are verified.
+	var user models.User
+	config.DB.Where("email = ?", "verify@example.com").First(&user)
+	assert.Equal(t, models.RoleMember, user.Role)
+
+	w = postJSON(router, "/auth/verify-email/request", map[string]string{"email": "verify@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	second := lastMailedToken(t)
+
+	w = postJSON(router, "/auth/verify-email", map[string]string{"token": first})
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Expected a superseded token to be rejected")
+
+	w = postJSON(router, "/auth/verify-email", map[string]string{"token": second})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	config.DB.Where("email = ?", "verify@example.com").First(&user)
+	assert.NotNil(t, user.EmailVerifiedAt)
+	assert.Equal(t, models.RoleAdmin, user.Role)
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := RegisterUserForTest()
+
+	w := postJSONAs(router, user, "/auth/2fa/enroll", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var enrollment struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	assert.Contains(t, enrollment.OtpauthURI, "otpauth://totp/DTMS:")
+
+	code, _ := totp.Code(enrollment.Secret, time.Now())
+	w = postJSONAs(router, user, "/auth/2fa/confirm", map[string]string{"code": code})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &confirmation)
+	assert.Len(t, confirmation.RecoveryCodes, 10)
+
+	login := func() string {
+		w := postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "Password123"})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "Login successful!", "Expected a challenge instead of a session")
+		var resp struct {
+			Challenge string `json:"challenge"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Challenge
+	}
+
+	challenge := login()
+	w = postJSON(router, "/auth/login/2fa", map[string]string{"challenge": challenge, "code": code})
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "Expected an already used code to be rejected")
+
+	w = postJSON(router, "/auth/login/2fa", map[string]string{"challenge": challenge, "recovery_code": confirmation.RecoveryCodes[0]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Login successful!")
+
+	w = postJSON(router, "/auth/login/2fa", map[string]string{"challenge": login(), "recovery_code": confirmation.RecoveryCodes[0]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "Expected a used recovery code to be rejected")
+
+	next, _ := totp.Code(enrollment.Secret, time.Now().Add(totp.Period*time.Second))
+	w = postJSON(router, "/auth/login/2fa", map[string]string{"challenge": login(), "code": next})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r := gin.New()
+	r.GET("/me", middleware.AuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+login())
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "Expected a challenge not to work as a session token")
+}
+
+func TestOrganizationEnforcedTwoFactor(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := RegisterUserForTest()
+
+	org := models.Organization{Name: "Acme", RequireTwoFactor: true}
+	config.DB.Create(&org)
+	config.DB.Model(&user).Update("organization_id", org.ID)
+
+	r := gin.New()
+	r.GET("/tasks", testAuth(), middleware.RequireTwoFactor(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	get := func() int {
+		req, _ := http.NewRequest("GET", "/tasks", nil)
+		req.Header.Set("X-Test-User", fmt.Sprint(user.ID))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, get())
+
+	w := postJSONAs(router, user, "/auth/2fa/enroll", nil)
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	code, _ := totp.Code(enrollment.Secret, time.Now())
+	w = postJSONAs(router, user, "/auth/2fa/confirm", map[string]string{"code": code})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusNoContent, get())
+
+	next, _ := totp.Code(enrollment.Secret, time.Now().Add(totp.Period*time.Second))
+	w = postJSONAs(router, user, "/auth/2fa/disable", map[string]string{"code": next})
+	assert.Equal(t, http.StatusForbidden, w.Code, "Expected disabling to be refused while the organization requires 2FA")
+}
+
+func TestLoginLockout(t *testing.T) {
+	setup()
+	router := setupRouter()
+	router.POST("/admin/lockouts/unlock", UnlockLogin)
+	_ = RegisterUserForTest()
+
+	defaultPolicy := accountThrottle
+	defer func() { accountThrottle = defaultPolicy }()
+	accountThrottle.FreeAttempts = 100
+	accountThrottle.LockoutAfter = 3
+
+	attempt := func(email, password string) *httptest.ResponseRecorder {
+		return postJSON(router, "/auth/login", map[string]string{"email": email, "password": password})
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, attempt("testuser@example.com", "WrongPassword").Code)
+		assert.Equal(t, http.StatusUnauthorized, attempt("ghost@example.com", "WrongPassword").Code)
+	}
+
+	known := attempt("testuser@example.com", "Password123")
+	unknown := attempt("ghost@example.com", "Password123")
+	assert.Equal(t, http.StatusTooManyRequests, known.Code, "Expected the account to be locked even with the right password")
+	assert.Equal(t, unknown.Code, known.Code, "Expected unknown emails to be locked the same way")
+	// Apart from the request ID, the two responses must be identical.
+	var knownBody, unknownBody map[string]interface{}
+	json.Unmarshal(known.Body.Bytes(), &knownBody)
+	json.Unmarshal(unknown.Body.Bytes(), &unknownBody)
+	delete(knownBody, "request_id")
+	delete(unknownBody, "request_id")
+	assert.Equal(t, unknownBody, knownBody)
+	assert.NotEmpty(t, known.Header().Get("Retry-After"))
+
+	var lockouts int64
+	config.DB.Model(&models.AuditEvent{}).Where("action = ? AND subject = ?", models.AuditLoginLockout, "account:testuser@example.com").Count(&lockouts)
+	assert.Equal(t, int64(1), lockouts)
+
+	w := postJSON(router, "/admin/lockouts/unlock", map[string]string{"email": "testuser@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, attempt("testuser@example.com", "Password123").Code)
+}
+
+func TestLoginProgressiveDelay(t *testing.T) {
+	setup()
+	router := setupRouter()
+	_ = RegisterUserForTest()
+
+	defaultPolicy := accountThrottle
+	defer func() { accountThrottle = defaultPolicy }()
+	accountThrottle.FreeAttempts = 1
+	accountThrottle.BaseDelay = time.Minute
+	accountThrottle.MaxDelay = time.Hour
+
+	w := postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "WrongPassword"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "WrongPassword"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "Password123"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "Expected attempts beyond the free ones to be delayed")
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
+
+func TestLoginThrottleParallelGuesses(t *testing.T) {
+	setup()
+	router := setupRouter()
+	_ = RegisterUserForTest()
+
+	defaultPolicy := accountThrottle
+	defer func() { accountThrottle = defaultPolicy }()
+	accountThrottle.FreeAttempts = 1
+	accountThrottle.BaseDelay = time.Minute
+	accountThrottle.MaxDelay = time.Hour
+
+	// Guesses sent at once are counted before any password is checked, so
+	// only the free attempt and the one that starts the delay get through.
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "WrongPassword"}).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	assert.Equal(t, 2, counts[http.StatusUnauthorized])
+	assert.Equal(t, 8, counts[http.StatusTooManyRequests])
+
+	// Once the account's delay is lifted, a successful login clears the
+	// account's failures and takes back only its own from the IP.
+	config.DB.Exec("DELETE FROM login_throttles WHERE key LIKE 'account:%'")
+	w := postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "Password123"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var throttles []models.LoginThrottle
+	config.DB.Find(&throttles)
+	if assert.Len(t, throttles, 1) {
+		assert.True(t, strings.HasPrefix(throttles[0].Key, "ip:"))
+		assert.Equal(t, 2, throttles[0].Failures)
+	}
+}
+
+func TestLoginSuccessKeepsIPFailures(t *testing.T) {
+	setup()
+	router := setupRouter()
+	_ = RegisterUserForTest()
+
+	defaultPolicy := ipThrottle
+	defer func() { ipThrottle = defaultPolicy }()
+	ipThrottle.FreeAttempts = 3
+	ipThrottle.BaseDelay = time.Minute
+	ipThrottle.MaxDelay = time.Hour
+
+	attempt := func(email, password string) int {
+		return postJSON(router, "/auth/login", map[string]string{"email": email, "password": password}).Code
+	}
+
+	// Spraying other accounts and logging into one's own in between does
+	// not reset the IP's count.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, attempt(fmt.Sprintf("victim%d@example.com", i), "WrongPassword"))
+	}
+	assert.Equal(t, http.StatusOK, attempt("testuser@example.com", "Password123"))
+	assert.Equal(t, http.StatusUnauthorized, attempt("victim3@example.com", "WrongPassword"))
+	assert.Equal(t, http.StatusTooManyRequests, attempt("victim4@example.com", "WrongPassword"))
+}
+
+func TestUserProfile(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := RegisterUserForTest()
+
+	w := requestAs(router, user, "PUT", "/users/me", map[string]string{"username": "renamed", "email": "renamed@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "renamed@example.com", sentMail.messages[len(sentMail.messages)-1].To, "Expected the new email to be verified")
+
+	w = requestAs(router, user, "PUT", "/users/me/password", map[string]string{
+		"current_password": "WrongPassword",
+		"password":         "NewPassword456",
+		"confirm_password": "NewPassword456",
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	w = postJSON(router, "/auth/login", map[string]string{"email": "renamed@example.com", "password": "Password123"})
+	json.Unmarshal(w.Body.Bytes(), &session)
+	oldToken := session.Token
+	me := gin.New()
+	me.GET("/me", middleware.AuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	sessionStatus := func(token string) int {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		me.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNoContent, sessionStatus(oldToken))
+
+	w = requestAs(router, user, "PUT", "/users/me/password", map[string]string{
+		"current_password": "Password123",
+		"password":         "NewPassword456",
+		"confirm_password": "NewPassword456",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Earlier sessions are revoked; the one that changed the password gets
+	// a fresh token.
+	json.Unmarshal(w.Body.Bytes(), &session)
+	assert.Equal(t, http.StatusUnauthorized, sessionStatus(oldToken))
+	assert.Equal(t, http.StatusNoContent, sessionStatus(session.Token))
+
+	w = postJSON(router, "/auth/login", map[string]string{"email": "renamed@example.com", "password": "NewPassword456"})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDeactivateUser(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := RegisterUserForTest()
+	admin := models.User{Username: "admin", Email: "admin@example.com", Role: models.RoleAdmin}
+	config.DB.Create(&admin)
+
+	w := requestAs(router, admin, "PUT", "/admin/users/deactivate", map[string]uint{"user_id": user.ID})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = requestAs(router, admin, "GET", "/users/", nil)
+	assert.NotContains(t, w.Body.String(), "testuser@example.com", "Expected deactivated users to be hidden")
+
+	w = postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "Password123"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	token, _ := config.Keys.Sign(jwt.MapClaims{"user_id": user.ID, "exp": time.Now().Add(time.Hour).Unix()})
+	r := gin.New()
+	r.GET("/me", middleware.AuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "Expected existing sessions of deactivated users to stop working")
+
+	w = requestAs(router, admin, "PUT", "/admin/users/activate", map[string]uint{"user_id": user.ID})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "Password123"})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestBearerTokenAndKeyRotation(t *testing.T) {
+	setup()
+	user := RegisterUserForTest()
+
+	r := gin.New()
+	r.GET("/me", middleware.AuthMiddleware(), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	request := func(token string) int {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	claims := jwt.MapClaims{"user_id": user.ID, "exp": time.Now().Add(time.Hour).Unix()}
+	oldToken, err := config.Keys.Sign(claims)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, request(oldToken))
+
+	rotated, err := config.GenerateSigningKey("z-rotated", "RS256")
+	assert.NoError(t, err)
+	previous, _ := config.GenerateSigningKey("test-key", "EdDSA")
+	config.Keys = config.NewKeySet(previous, rotated)
+
+	newToken, err := config.Keys.Sign(claims)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, request(newToken), "Expected token from rotated key to verify")
+	assert.Equal(t, http.StatusUnauthorized, request(oldToken), "Expected token signed by a replaced key to be rejected")
+	assert.Equal(t, http.StatusUnauthorized, request("not-a-token"))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	setupRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"kid":"z-rotated"`)
+	assert.Contains(t, w.Body.String(), `"crv":"Ed25519"`)
+}
+
 func TestCreateTask(t *testing.T) {
 
 	setup()
@@ -193,6 +883,7 @@ func TestUpdateTask(t *testing.T) {
 			"planned_end_time":   updatedEndTime.Unix(),
 			"actual_start_time":  updatedActualStartTime.Unix(),
 			"actual_end_time":    updatedActualEndTime.Unix(),
+			"version":            taskVersion(task.ID),
 		}
 		jsonData, _ := json.Marshal(payload)
 		req, _ := http.NewRequest("PUT", fmt.Sprintf("/task/update?task_id=%d", task.ID), bytes.NewBuffer(jsonData))
@@ -272,6 +963,63 @@ func TestAssignTask(t *testing.T) {
 		assert.Contains(t, w.Body.String(), "Task assigned successfully")
 	})
 
+	t.Run("Reassignment", func(t *testing.T) {
+		task := CreateTestTask()
+		alice, bob := createNamedUser("alice"), createNamedUser("bob")
+
+		for _, user := range []models.User{alice, bob} {
+			w := requestAs(router, alice, "PUT", "/task/assign", map[string]uint{"user_id": user.ID, "task_id": task.ID})
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+
+		loaded, _ := loadTaskWithParticipants(task.ID)
+		assert.Equal(t, bob.ID, *loaded.AssignedTo)
+		if assert.Len(t, loaded.Assignees, 1, "Expected the previous assignee to be replaced") {
+			assert.Equal(t, bob.ID, loaded.Assignees[0].ID)
+		}
+	})
+
+	t.Run("Unknown User", func(t *testing.T) {
+		task := CreateTestTask()
+
+		payload := map[string]interface{}{
+			"user_id": 999,
+			"task_id": task.ID,
+		}
+		jsonData, _ := json.Marshal(payload)
+		req, _ := http.NewRequest("PUT", "/task/assign", bytes.NewBuffer(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "User not found")
+
+		var saved models.Task
+		config.DB.First(&saved, task.ID)
+		assert.Nil(t, saved.AssignedTo, "Expected the task to stay unassigned")
+	})
+
+	t.Run("Deactivated User", func(t *testing.T) {
+		task := CreateTestTask()
+		user := CreateTestUser()
+		config.DB.Model(&user).Update("deactivated_at", time.Now())
+
+		payload := map[string]interface{}{
+			"user_id": user.ID,
+			"task_id": task.ID,
+		}
+		jsonData, _ := json.Marshal(payload)
+		req, _ := http.NewRequest("PUT", "/task/assign", bytes.NewBuffer(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
 	t.Run("Task Not Found", func(t *testing.T) {
 		payload := map[string]interface{}{
 			"user_id": 1,
@@ -289,6 +1037,1761 @@ func TestAssignTask(t *testing.T) {
 	})
 }
 
+func createNamedUser(name string) models.User {
+	user := models.User{Username: name, Email: name + "@example.com", Role: models.RoleMember}
+	if err := config.DB.Create(&user).Error; err != nil {
+		panic(fmt.Sprintf("Error creating user %s: %v", name, err))
+	}
+	return user
+}
+
+func taskVersion(taskID uint) uint {
+	var task models.Task
+	config.DB.Select("version").First(&task, taskID)
+	return task.Version
+}
+
+func notificationCount(user models.User, event string) int64 {
+	var count int64
+	config.DB.Model(&models.Notification{}).Where("user_id = ? AND event = ?", user.ID, event).Count(&count)
+	return count
+}
+
+func TestTeamAssignmentAndClaim(t *testing.T) {
+	setup()
+	router := setupRouter()
+	alice, bob, carol := createNamedUser("alice"), createNamedUser("bob"), createNamedUser("carol")
+
+	team := models.Team{Name: "Ops", Members: []models.User{alice, bob}}
+	config.DB.Create(&team)
+	task := CreateTestTask()
+	w := requestAs(router, carol, "PUT", "/task/assign", map[string]uint{"task_id": task.ID, "user_id": carol.ID})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Handing the task to the team unassigns it so that it can be claimed.
+	w = requestAs(router, carol, "PUT", "/task/assign/team", map[string]uint{"task_id": task.ID, "team_id": team.ID})
+	assert.Equal(t, http.StatusOK, w.Code)
+	loaded, _ := loadTaskWithParticipants(task.ID)
+	assert.Nil(t, loaded.AssignedTo)
+	assert.Empty(t, loaded.Assignees)
+	assert.Equal(t, int64(1), notificationCount(alice, "task_assigned_to_team"))
+	assert.Equal(t, int64(1), notificationCount(bob, "task_assigned_to_team"))
+
+	w = requestAs(router, carol, "PUT", "/task/claim", map[string]uint{"task_id": task.ID})
+	assert.Equal(t, http.StatusForbidden, w.Code, "Expected non-members to be unable to claim")
+
+	w = requestAs(router, alice, "PUT", "/task/claim", map[string]uint{"task_id": task.ID})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), notificationCount(bob, "task_claimed"))
+	assert.Equal(t, int64(0), notificationCount(alice, "task_claimed"), "Expected the actor not to be notified")
+
+	w = requestAs(router, bob, "PUT", "/task/claim", map[string]uint{"task_id": task.ID})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	var saved models.Task
+	config.DB.First(&saved, task.ID)
+	assert.Equal(t, alice.ID, *saved.AssignedTo)
+}
+
+func TestSetTaskParticipants(t *testing.T) {
+	setup()
+	router := setupRouter()
+	alice, bob, carol := createNamedUser("alice"), createNamedUser("bob"), createNamedUser("carol")
+	task := CreateTestTask()
+
+	w := requestAs(router, carol, "PUT", "/task/participants", map[string]interface{}{
+		"task_id":      task.ID,
+		"assignee_ids": []uint{bob.ID, alice.ID},
+		"reviewer_ids": []uint{carol.ID},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	loaded, _ := loadTaskWithParticipants(task.ID)
+	assert.Equal(t, bob.ID, *loaded.AssignedTo)
+	assert.Len(t, loaded.Assignees, 2)
+	assert.Len(t, loaded.Reviewers, 1)
+	assert.Equal(t, int64(1), notificationCount(alice, "task_participants_updated"))
+
+	w = requestAs(router, carol, "PUT", "/task/participants", map[string]interface{}{
+		"task_id":      task.ID,
+		"assignee_ids": []uint{alice.ID, 999},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = requestAs(router, carol, "PUT", "/task/participants", map[string]interface{}{
+		"task_id":      task.ID,
+		"assignee_ids": []uint{alice.ID},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(2), notificationCount(bob, "task_participants_updated"), "Expected removed assignees to be told")
+}
+
+func createPlannedTask(title string, start time.Time, hours int, seconds int64, skills ...string) models.Task {
+	task := models.Task{
+		Title:            title,
+		PlannedStartTime: start,
+		PlannedEndTime:   start.Add(time.Duration(hours) * time.Hour),
+		Seconds:          seconds,
+		RequiredSkills:   skills,
+	}
+	if err := config.DB.Create(&task).Error; err != nil {
+		panic(fmt.Sprintf("Error creating task %s: %v", title, err))
+	}
+	return task
+}
+
+func TestAutoAssignTask(t *testing.T) {
+	setup()
+	router := setupRouter()
+	monday := time.Date(2025, 1, 27, 9, 0, 0, 0, time.UTC)
+
+	busy := createNamedUser("busy")
+	config.DB.Model(&busy).Update("skills", models.StringList{"go"})
+	free := createNamedUser("free")
+	config.DB.Model(&free).Update("skills", models.StringList{"go", "sql"})
+	unskilled := createNamedUser("unskilled")
+
+	existing := createPlannedTask("Existing", monday, 8, 0)
+	config.DB.Model(&existing).Update("assigned_to", busy.ID)
+
+	task := createPlannedTask("Needs Go", monday, 8, 4*3600, "go")
+	w := requestAs(router, unskilled, "PUT", "/task/assign/auto", map[string]interface{}{"task_id": task.ID})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Explanation assignmentExplanation `json:"explanation"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if assert.NotNil(t, resp.Explanation.ChosenUserID) {
+		assert.Equal(t, free.ID, *resp.Explanation.ChosenUserID)
+	}
+	assert.Contains(t, resp.Explanation.Summary, "free")
+	for _, candidate := range resp.Explanation.Candidates {
+		switch candidate.UserID {
+		case busy.ID:
+			assert.False(t, candidate.Eligible)
+			assert.Equal(t, int64(480), candidate.LoadMinutes)
+		case unskilled.ID:
+			assert.Equal(t, []string{"go"}, candidate.MissingSkills)
+		}
+	}
+
+	var saved models.Task
+	config.DB.First(&saved, task.ID)
+	assert.Equal(t, free.ID, *saved.AssignedTo)
+
+	impossible := createPlannedTask("Needs Rust", monday, 8, 3600, "rust")
+	w = requestAs(router, unskilled, "PUT", "/task/assign/auto", map[string]interface{}{"task_id": impossible.ID})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "missing skills: rust")
+}
+
+func TestAutoAssignRoundRobin(t *testing.T) {
+	setup()
+	router := setupRouter()
+	monday := time.Date(2025, 1, 27, 9, 0, 0, 0, time.UTC)
+	alice, bob := createNamedUser("alice"), createNamedUser("bob")
+
+	var assignees []uint
+	for i := 0; i < 4; i++ {
+		task := createPlannedTask(fmt.Sprintf("Small %d", i), monday, 8, 600)
+		w := requestAs(router, alice, "PUT", "/task/assign/auto", map[string]interface{}{"task_id": task.ID})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var saved models.Task
+		config.DB.First(&saved, task.ID)
+		assignees = append(assignees, *saved.AssignedTo)
+	}
+	assert.Equal(t, []uint{alice.ID, bob.ID, alice.ID, bob.ID}, assignees)
+}
+
+func TestCreateTaskBulkAutoAssign(t *testing.T) {
+	setup()
+	router := setupRouter()
+	worker := createNamedUser("worker")
+	config.DB.Model(&worker).Update("skills", models.StringList{"csv"})
+	createNamedUser("other")
+
+	csvData := "title,description,start_date,start_time,end_date,end_time,seconds,skills\n" +
+		"Import,From CSV,2025-01-27,09:00:00,2025-01-27,12:00:00,3600,csv\n" +
+		"Weld,Nobody can,2025-01-27,09:00:00,2025-01-27,12:00:00,3600,welding\n"
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile("taskBulkUpload", "tasks.csv")
+	part.Write([]byte(csvData))
+	form.WriteField("auto_assign", "true")
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "/task/bulkupload", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "auto-assigned 1")
+	assert.Contains(t, w.Body.String(), errNoEligibleAssignee.Error())
+
+	var task models.Task
+	config.DB.Where("title = ?", "Import").First(&task)
+	assert.Equal(t, models.StringList{"csv"}, task.RequiredSkills)
+	if assert.NotNil(t, task.AssignedTo) {
+		assert.Equal(t, worker.ID, *task.AssignedTo)
+	}
+}
+
+func TestCreateTaskBulkTimeZone(t *testing.T) {
+	setup()
+	router := setupRouter()
+
+	csvData := "title,description,start_date,start_time,end_date,end_time,seconds\n" +
+		"Zoned,Berlin time,2025-01-27,09:00:00,2025-01-27,12:00:00,3600\n" +
+		"Open ended,No end given,2025-01-27,09:00:00,,,36000\n"
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile("taskBulkUpload", "tasks.csv")
+	part.Write([]byte(csvData))
+	form.WriteField("time_zone", "Europe/Berlin")
+	form.Close()
+
+	req, _ := http.NewRequest("POST", "/task/bulkupload", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var zoned models.Task
+	config.DB.Where("title = ?", "Zoned").First(&zoned)
+	assert.True(t, zoned.PlannedStartTime.Equal(time.Date(2025, 1, 27, 8, 0, 0, 0, time.UTC)))
+	assert.Equal(t, uint(1), zoned.Version)
+
+	// Ten working hours on the default UTC calendar: all of Monday plus two
+	// hours on Tuesday.
+	var openEnded models.Task
+	config.DB.Where("title = ?", "Open ended").First(&openEnded)
+	assert.True(t, openEnded.PlannedEndTime.Equal(time.Date(2025, 1, 28, 11, 0, 0, 0, time.UTC)), "got %v", openEnded.PlannedEndTime)
+}
+
+func TestWorkingCalendar(t *testing.T) {
+	setup()
+	router := setupRouter()
+	monday := time.Date(2025, 1, 27, 9, 0, 0, 0, time.UTC)
+
+	member := createNamedUser("member")
+	manager := createNamedUser("manager")
+	config.DB.Model(&manager).Update("role", models.RoleManager)
+	manager.Role = models.RoleManager
+
+	w := requestAs(router, member, "PUT", "/users/me", map[string]interface{}{"time_zone": "Mars/Olympus"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = requestAs(router, member, "PUT", "/users/me", map[string]interface{}{"time_zone": "America/New_York"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = requestAs(router, member, "POST", "/calendar/holidays", map[string]interface{}{"date": "2025-01-28", "name": "Company day"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = requestAs(router, manager, "POST", "/calendar/holidays", map[string]interface{}{"date": "2025-01-28", "name": "Company day"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(router, member, "POST", "/calendar/holidays", map[string]interface{}{"date": "2025-01-29", "name": "Dentist", "personal": true})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(router, member, "POST", "/calendar/holidays", map[string]interface{}{"date": "28/01/2025"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = requestAs(router, manager, "GET", "/calendar/holidays", nil)
+	assert.NotContains(t, w.Body.String(), "Dentist", "Expected personal days off to stay private")
+
+	// 9:00 in New York on Monday; 16 working hours skip Tuesday's company
+	// holiday and Wednesday's personal day.
+	start := time.Date(2025, 1, 27, 9, 0, 0, 0, time.FixedZone("EST", -5*3600))
+	w = requestAs(router, member, "GET", "/calendar/working-time?start="+url.QueryEscape(start.Format(time.RFC3339))+"&seconds=57600", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		DueAt time.Time `json:"due_at"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.True(t, resp.DueAt.Equal(time.Date(2025, 1, 30, 22, 0, 0, 0, time.UTC)), "got %v", resp.DueAt)
+
+	// A huge range is counted only up to the search limit.
+	w = requestAs(router, member, "GET", "/calendar/working-time?start=0001-01-01T00:00:00Z&end=9999-12-31T00:00:00Z", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var span struct {
+		WorkingSeconds int64 `json:"working_seconds"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &span)
+	assert.Greater(t, span.WorkingSeconds, int64(0))
+	assert.Less(t, span.WorkingSeconds, int64(6*366*24*3600))
+
+	// The holiday leaves the member no capacity on Tuesday.
+	task := createPlannedTask("Tuesday work", monday.Add(24*time.Hour), 8, 3600)
+	w = requestAs(router, member, "PUT", "/task/assign/auto", map[string]interface{}{
+		"task_id":       task.ID,
+		"candidate_ids": []uint{member.ID},
+	})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "no working hours within the planned window")
+}
+
+func TestReminderScheduler(t *testing.T) {
+	setup()
+	now := time.Date(2025, 1, 27, 12, 0, 0, 0, time.UTC)
+	worker := createNamedUser("worker")
+
+	task := createPlannedTask("Due soon", now.Add(-7*time.Hour), 7, 0)
+	task.PlannedEndTime = now.Add(30 * time.Minute)
+	config.DB.Model(&task).Updates(map[string]interface{}{"assigned_to": worker.ID, "planned_end_time": task.PlannedEndTime})
+	done := createPlannedTask("Done", now.Add(-8*time.Hour), 1, 0)
+	config.DB.Model(&done).Updates(map[string]interface{}{"assigned_to": worker.ID, "actual_end_time": now.Add(-7 * time.Hour)})
+
+	scheduler := &ReminderScheduler{
+		Before:    []time.Duration{24 * time.Hour, time.Hour},
+		After:     []time.Duration{0, 24 * time.Hour},
+		Notifiers: []ReminderNotifier{WebSocketReminderNotifier{}, EmailReminderNotifier{}},
+	}
+
+	sent, err := scheduler.RunOnce(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent, "Expected only the nearest upcoming reminder, and none for finished tasks")
+	assert.Equal(t, int64(1), notificationCount(worker, "task_due_soon"))
+	if assert.NotEmpty(t, sentMail.messages) {
+		assert.Equal(t, worker.Email, sentMail.messages[len(sentMail.messages)-1].To)
+	}
+
+	// A restarted scheduler must not repeat the reminder.
+	sent, _ = (&ReminderScheduler{Before: scheduler.Before, After: scheduler.After, Notifiers: scheduler.Notifiers}).RunOnce(now.Add(time.Minute))
+	assert.Equal(t, 0, sent)
+
+	sent, _ = scheduler.RunOnce(now.Add(time.Hour))
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, int64(1), notificationCount(worker, "task_overdue"))
+
+	// Down for two days: only the latest overdue stage is sent.
+	sent, _ = scheduler.RunOnce(now.Add(48 * time.Hour))
+	assert.Equal(t, 1, sent)
+	var reminders []models.TaskReminder
+	config.DB.Where("task_id = ? AND channel = ?", task.ID, "email").Order("id").Find(&reminders)
+	if assert.Len(t, reminders, 3) {
+		assert.Equal(t, int64(24*3600), reminders[2].OffsetSeconds)
+		assert.NotNil(t, reminders[2].SentAt)
+	}
+
+	// A task long past its last reminder is not even loaded.
+	stale := createPlannedTask("Stale", now.Add(-30*24*time.Hour), 1, 0)
+	config.DB.Model(&stale).Update("assigned_to", worker.ID)
+	sent, _ = scheduler.RunOnce(now.Add(48 * time.Hour))
+	assert.Equal(t, 0, sent)
+}
+
+// failingMailer rejects every message.
+type failingMailer struct{}
+
+func (failingMailer) Send(mailer.Message) error { return errors.New("mail server unavailable") }
+
+func TestReminderRetriedAfterFailedSend(t *testing.T) {
+	setup()
+	now := time.Date(2025, 1, 27, 12, 0, 0, 0, time.UTC)
+	worker := createNamedUser("worker")
+	task := createPlannedTask("Due soon", now.Add(-time.Hour), 1, 0)
+	config.DB.Model(&task).Update("assigned_to", worker.ID)
+
+	scheduler := &ReminderScheduler{
+		After:     []time.Duration{0},
+		Notifiers: []ReminderNotifier{WebSocketReminderNotifier{}, EmailReminderNotifier{}},
+	}
+
+	mailer.InitMailer(failingMailer{})
+	sent, err := scheduler.RunOnce(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	var emailed int64
+	config.DB.Model(&models.TaskReminder{}).Where("task_id = ? AND channel = ?", task.ID, "email").Count(&emailed)
+	assert.Equal(t, int64(0), emailed, "Expected a failed email not to be recorded as sent")
+
+	// Once mail works again only the email is sent.
+	mailer.InitMailer(sentMail)
+	sent, err = scheduler.RunOnce(now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Len(t, sentMail.messages, 1)
+	assert.Equal(t, int64(1), notificationCount(worker, "task_overdue"))
+
+	sent, _ = scheduler.RunOnce(now.Add(2 * time.Minute))
+	assert.Equal(t, 0, sent)
+}
+
+func TestOverdueReport(t *testing.T) {
+	setup()
+	router := setupRouter()
+	worker := createNamedUser("worker")
+
+	late := createPlannedTask("Late", time.Now().Add(-3*time.Hour), 1, 0)
+	config.DB.Model(&late).Update("assigned_to", worker.ID)
+	createPlannedTask("Later", time.Now().Add(-5*time.Hour), 1, 0)
+	createPlannedTask("Upcoming", time.Now(), 1, 0)
+	closed := createPlannedTask("Closed", time.Now().Add(-6*time.Hour), 1, 0)
+	config.DB.Model(&closed).Update("status", models.TaskStatusDone)
+	finished := createPlannedTask("Finished", time.Now().Add(-6*time.Hour), 1, 0)
+	config.DB.Model(&finished).Update("actual_end_time", time.Now().Add(-5*time.Hour))
+
+	w := requestAs(router, worker, "GET", "/task/overdue", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report struct {
+		Count int `json:"count"`
+		Tasks []struct {
+			Title          string `json:"title"`
+			OverdueSeconds int64  `json:"overdue_seconds"`
+		} `json:"tasks"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 2, report.Count)
+	if assert.Len(t, report.Tasks, 2) {
+		assert.Equal(t, "Later", report.Tasks[0].Title)
+		assert.Greater(t, report.Tasks[0].OverdueSeconds, report.Tasks[1].OverdueSeconds)
+	}
+
+	w = requestAs(router, worker, "GET", fmt.Sprintf("/task/overdue?user_id=%d", worker.ID), nil)
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 1, report.Count)
+}
+
+func TestSLAPolicies(t *testing.T) {
+	setup()
+	router := setupRouter()
+	manager := createNamedUser("manager")
+	config.DB.Model(&manager).Update("role", models.RoleManager)
+	worker := createNamedUser("worker")
+
+	w := requestAs(router, manager, "POST", "/sla/policies", map[string]interface{}{
+		"name": "Broken", "priority": "critical", "resolution_minutes": 60,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = requestAs(router, manager, "POST", "/sla/policies", map[string]interface{}{
+		"name": "Default", "response_minutes": 600, "resolution_minutes": 6000,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(router, manager, "POST", "/sla/policies", map[string]interface{}{
+		"name":               "Urgent",
+		"priority":           "urgent",
+		"response_minutes":   30,
+		"resolution_minutes": 120,
+		"escalations": []map[string]interface{}{
+			{"target": "resolution", "threshold_percent": 50, "role": "manager"},
+		},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = requestAs(router, worker, "POST", "/task/create", map[string]interface{}{"title": "Outage", "priority": "urgent"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var created struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	task := created.Task
+	config.DB.Model(&task).Update("assigned_to", worker.ID)
+
+	var sla models.TaskSLA
+	assert.NoError(t, config.DB.First(&sla, "task_id = ?", task.ID).Error)
+	var urgent models.SLAPolicy
+	config.DB.Where("name = ?", "Urgent").First(&urgent)
+	assert.Equal(t, urgent.ID, sla.PolicyID, "Expected the priority-specific policy to win")
+
+	// Start the clock two hours ago with an hour and a half spent blocked.
+	start := time.Now().Add(-2 * time.Hour)
+	blockedAt := start.Add(10 * time.Minute)
+	config.DB.Model(&sla).Updates(map[string]interface{}{"started_at": start, "paused_at": blockedAt})
+	config.DB.Model(&task).Update("status", models.TaskStatusBlocked)
+
+	monitor := &SLAMonitor{}
+	assert.NoError(t, monitor.RunOnce(time.Now()))
+	var breaches int64
+	config.DB.Model(&models.SLABreach{}).Count(&breaches)
+	assert.Equal(t, int64(0), breaches, "Expected no breach while the task is blocked")
+
+	w = requestAs(router, worker, "PUT", fmt.Sprintf("/task/update?task_id=%d", task.ID), map[string]interface{}{"status": "in_progress", "version": taskVersion(task.ID)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	sla = models.TaskSLA{}
+	config.DB.First(&sla, "task_id = ?", task.ID)
+	assert.Nil(t, sla.PausedAt)
+	assert.InDelta(t, 110*60, sla.PausedSeconds, 5)
+	assert.Equal(t, int64(0), notificationCount(manager, "sla_escalation"), "Expected escalation to wait for half the target")
+
+	// 90 of 120 minutes used: escalate once, however often the monitor runs.
+	config.DB.Model(&sla).Update("started_at", start.Add(-80*time.Minute))
+	assert.NoError(t, monitor.RunOnce(time.Now()))
+	assert.NoError(t, monitor.RunOnce(time.Now()))
+	assert.Equal(t, int64(1), notificationCount(manager, "sla_escalation"))
+	assert.Equal(t, int64(0), notificationCount(worker, "sla_breached"), "Expected the response target to have been met")
+
+	// Editing the policy keeps its steps, so the fired escalation stays fired.
+	w = requestAs(router, manager, "PUT", fmt.Sprintf("/sla/policies?policy_id=%d", urgent.ID), map[string]interface{}{
+		"name":               "Urgent (edited)",
+		"priority":           "urgent",
+		"response_minutes":   30,
+		"resolution_minutes": 120,
+		"escalations": []map[string]interface{}{
+			{"target": "resolution", "threshold_percent": 50, "role": "admin"},
+		},
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, monitor.RunOnce(time.Now()))
+	assert.Equal(t, int64(1), notificationCount(manager, "sla_escalation"), "Expected no repeat escalation after the edit")
+	var steps []models.SLAEscalationStep
+	config.DB.Where("policy_id = ?", urgent.ID).Find(&steps)
+	if assert.Len(t, steps, 1) {
+		assert.Equal(t, models.RoleAdmin, steps[0].Role)
+	}
+
+	w = requestAs(router, worker, "GET", fmt.Sprintf("/sla/task?task_id=%d", task.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"remaining_seconds"`)
+
+	config.DB.Model(&sla).Update("started_at", start.Add(-3*time.Hour))
+	assert.NoError(t, monitor.RunOnce(time.Now()))
+	assert.Equal(t, int64(1), notificationCount(worker, "sla_breached"))
+	w = requestAs(router, manager, "GET", "/sla/breaches?priority=urgent", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report struct {
+		Count    int            `json:"count"`
+		ByTarget map[string]int `json:"by_target"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 1, report.Count)
+	assert.Equal(t, 1, report.ByTarget["resolution"])
+
+	w = requestAs(router, manager, "GET", "/sla/breaches?to="+url.QueryEscape(time.Now().Add(-24*time.Hour).Format(time.RFC3339)), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 0, report.Count)
+	w = requestAs(router, manager, "GET", "/sla/breaches?from="+url.QueryEscape(time.Now().Add(-24*time.Hour).Format(time.RFC3339)), nil)
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 1, report.Count)
+}
+
+func createSubtask(t *testing.T, router *gin.Engine, user models.User, title string, seconds int64, parentID *uint) models.Task {
+	w := requestAs(router, user, "POST", "/task/create", map[string]interface{}{"title": title, "seconds": seconds, "parent_id": parentID})
+	if !assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+		t.FailNow()
+	}
+	var resp struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Task
+}
+
+func TestSubtasks(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := createNamedUser("planner")
+
+	root := createSubtask(t, router, user, "Release", 0, nil)
+	build := createSubtask(t, router, user, "Build", 3600, &root.ID)
+	docs := createSubtask(t, router, user, "Docs", 1800, &root.ID)
+	compile := createSubtask(t, router, user, "Compile", 1200, &build.ID)
+
+	missing := uint(999)
+	w := requestAs(router, user, "POST", "/task/create", map[string]interface{}{"title": "Lost", "parent_id": missing})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = requestAs(router, user, "PUT", "/task/parent", map[string]interface{}{"task_id": build.ID, "parent_id": compile.ID})
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Expected cycles to be rejected")
+
+	var saved models.Task
+	config.DB.First(&saved, root.ID)
+	assert.Equal(t, int64(3600+1800+1200), saved.RollupSeconds)
+
+	w = requestAs(router, user, "PUT", fmt.Sprintf("/task/update?task_id=%d", docs.ID), map[string]interface{}{"status": "done", "version": taskVersion(docs.ID)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	saved = models.Task{}
+	config.DB.First(&saved, root.ID)
+	assert.InDelta(t, 1800.0/6600, saved.Progress, 0.001)
+
+	w = requestAs(router, user, "PUT", fmt.Sprintf("/task/update?task_id=%d", root.ID), map[string]interface{}{"status": "done", "version": taskVersion(root.ID)})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "open_subtasks")
+
+	w = requestAs(router, user, "GET", fmt.Sprintf("/task/tree?task_id=%d", root.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tree struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &tree)
+	if assert.Len(t, tree.Task.Children, 2) {
+		assert.Equal(t, "Build", tree.Task.Children[0].Title)
+		assert.Len(t, tree.Task.Children[0].Children, 1)
+	}
+
+	w = requestAs(router, user, "PUT", fmt.Sprintf("/task/update?task_id=%d", build.ID), map[string]interface{}{"status": "done", "complete_subtasks": true, "version": taskVersion(build.ID)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	saved = models.Task{}
+	config.DB.First(&saved, compile.ID)
+	assert.Equal(t, models.TaskStatusDone, saved.Status)
+	saved = models.Task{}
+	config.DB.First(&saved, root.ID)
+	assert.Equal(t, 1.0, saved.Progress)
+
+	// Deleting Build moves Compile up to Release; cascading removes the rest.
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("/task/delete?task_id=%d", build.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	saved = models.Task{}
+	config.DB.First(&saved, compile.ID)
+	if assert.NotNil(t, saved.ParentID) {
+		assert.Equal(t, root.ID, *saved.ParentID)
+	}
+	saved = models.Task{}
+	config.DB.First(&saved, root.ID)
+	assert.Equal(t, int64(1800+1200), saved.RollupSeconds)
+
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("/task/delete?task_id=%d&subtasks=cascade", root.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var remaining int64
+	config.DB.Model(&models.Task{}).Count(&remaining)
+	assert.Equal(t, int64(0), remaining)
+}
+
+func TestComments(t *testing.T) {
+	setup()
+	router := setupRouter()
+	alice, bob, carol := createNamedUser("alice"), createNamedUser("bob"), createNamedUser("carol")
+	task := CreateTestTask()
+
+	w := requestAs(router, alice, "POST", "/task/comments", map[string]interface{}{
+		"task_id": task.ID,
+		"body":    "Hey @Bob, see `@carol` and **@nobody**.",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var created struct {
+		Comment models.Comment `json:"comment"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if assert.Len(t, created.Comment.Mentions, 1) {
+		assert.Equal(t, bob.ID, created.Comment.Mentions[0].ID)
+	}
+	assert.Equal(t, int64(1), notificationCount(bob, "comment_mention"))
+	assert.Equal(t, int64(0), notificationCount(carol, "comment_mention"), "Expected mentions in code to be ignored")
+
+	w = requestAs(router, bob, "POST", "/task/comments", map[string]interface{}{
+		"task_id":   task.ID,
+		"parent_id": created.Comment.ID,
+		"body":      "On it.",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), notificationCount(alice, "comment_reply"))
+
+	w = requestAs(router, bob, "PUT", fmt.Sprintf("/task/comments?comment_id=%d", created.Comment.ID), map[string]interface{}{"body": "Mine now"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = requestAs(router, alice, "PUT", fmt.Sprintf("/task/comments?comment_id=%d", created.Comment.ID), map[string]interface{}{
+		"body": "Hey @bob and @carol",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), notificationCount(bob, "comment_mention"), "Expected existing mentions not to be notified again")
+	assert.Equal(t, int64(1), notificationCount(carol, "comment_mention"))
+
+	w = requestAs(router, alice, "DELETE", fmt.Sprintf("/task/comments?comment_id=%d", created.Comment.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = requestAs(router, alice, "GET", fmt.Sprintf("/task/comments?task_id=%d", task.ID), nil)
+	var threads struct {
+		Comments []models.Comment `json:"comments"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &threads)
+	if assert.Len(t, threads.Comments, 1) {
+		assert.Empty(t, threads.Comments[0].Body)
+		assert.NotNil(t, threads.Comments[0].DeletedAt)
+		assert.Len(t, threads.Comments[0].Replies, 1, "Expected replies to survive deletion")
+	}
+
+	w = requestAs(router, alice, "GET", fmt.Sprintf("/task/comments/history?comment_id=%d", created.Comment.ID), nil)
+	var history struct {
+		Revisions []models.CommentRevision `json:"revisions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if assert.Len(t, history.Revisions, 2) {
+		assert.Equal(t, models.CommentEdited, history.Revisions[0].Action)
+		assert.Contains(t, history.Revisions[0].Body, "`@carol`")
+		assert.Equal(t, "Hey @bob and @carol", history.Revisions[1].Body)
+	}
+
+	w = requestAs(router, bob, "GET", fmt.Sprintf("/task/comments/history?comment_id=%d", created.Comment.ID), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code, "Expected a deleted comment's history to be hidden from other users")
+}
+
+func TestCustomFields(t *testing.T) {
+	setup()
+	router := setupRouter()
+	manager, dana := createNamedUser("manager"), createNamedUser("dana")
+
+	define := func(field map[string]interface{}) int {
+		field["project"] = "apollo"
+		return requestAs(router, manager, "POST", "/projects/fields", field).Code
+	}
+	assert.Equal(t, http.StatusOK, define(map[string]interface{}{"key": "severity", "type": "enum", "options": []string{"low", "high", "critical"}, "required": true}))
+	assert.Equal(t, http.StatusOK, define(map[string]interface{}{"key": "estimate", "type": "number"}))
+	assert.Equal(t, http.StatusOK, define(map[string]interface{}{"key": "due", "type": "date"}))
+	assert.Equal(t, http.StatusOK, define(map[string]interface{}{"key": "owner", "type": "user"}))
+	assert.Equal(t, http.StatusOK, define(map[string]interface{}{"key": "note", "type": "text"}))
+	assert.Equal(t, http.StatusConflict, define(map[string]interface{}{"key": "note", "type": "text"}))
+	assert.Equal(t, http.StatusBadRequest, define(map[string]interface{}{"key": "Bad Key", "type": "text"}))
+	assert.Equal(t, http.StatusBadRequest, define(map[string]interface{}{"key": "stage", "type": "enum"}))
+
+	create := func(title string, values map[string]interface{}) *httptest.ResponseRecorder {
+		return requestAs(router, manager, "POST", "/task/create", map[string]interface{}{"title": title, "project": "apollo", "custom_fields": values})
+	}
+	assert.Equal(t, http.StatusBadRequest, create("Missing", map[string]interface{}{"estimate": 1}).Code)
+	assert.Equal(t, http.StatusBadRequest, create("Unknown", map[string]interface{}{"severity": "low", "color": "red"}).Code)
+	assert.Equal(t, http.StatusBadRequest, create("Bad number", map[string]interface{}{"severity": "low", "estimate": "many"}).Code)
+	assert.Equal(t, http.StatusBadRequest, create("Bad option", map[string]interface{}{"severity": "extreme"}).Code)
+
+	w := create("Launch", map[string]interface{}{"severity": "HIGH", "estimate": 5, "due": "2026-03-01", "owner": dana.ID, "note": "go"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	assert.Equal(t, "high", created.Task.CustomFields["severity"])
+	assert.Equal(t, float64(dana.ID), created.Task.CustomFields["owner"])
+	assert.Equal(t, http.StatusOK, create("Fuel", map[string]interface{}{"severity": "critical", "estimate": 2}).Code)
+	assert.Equal(t, http.StatusOK, create("Paint", map[string]interface{}{"severity": "low"}).Code)
+
+	list := func(query string) []string {
+		w := requestAs(router, manager, "GET", "/task/?"+query, nil)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Tasks []models.Task `json:"tasks"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		titles := []string{}
+		for _, task := range resp.Tasks {
+			titles = append(titles, task.Title)
+		}
+		return titles
+	}
+	assert.Equal(t, []string{"Launch"}, list("project=apollo&field.severity=high"))
+	assert.Equal(t, []string{"Launch"}, list("field.owner=dana"))
+	assert.Equal(t, []string{"Fuel", "Launch"}, list("field.estimate.min=2&field.estimate.max=5&sort=field.estimate"))
+	assert.Equal(t, []string{"Launch", "Fuel", "Paint"}, list("project=apollo&sort=-field.estimate"))
+	assert.Equal(t, []string{"Paint", "Launch", "Fuel"}, list("project=apollo&sort=field.severity"))
+
+	// Another project's estimate is text: tasks sort by field type first.
+	gemini := map[string]interface{}{"key": "estimate", "type": "text", "project": "gemini"}
+	assert.Equal(t, http.StatusOK, requestAs(router, manager, "POST", "/projects/fields", gemini).Code)
+	for title, estimate := range map[string]string{"Dock": "b", "Orbit": "a"} {
+		w := requestAs(router, manager, "POST", "/task/create", map[string]interface{}{"title": title, "project": "gemini", "custom_fields": map[string]interface{}{"estimate": estimate}})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	assert.Equal(t, []string{"Fuel", "Launch", "Orbit", "Dock", "Paint"}, list("sort=field.estimate"))
+	assert.Equal(t, []string{"Dock", "Orbit", "Launch", "Fuel", "Paint"}, list("sort=-field.estimate"))
+	assert.Equal(t, http.StatusBadRequest, requestAs(router, manager, "GET", "/task/?sort=title", nil).Code)
+
+	w = requestAs(router, manager, "PUT", fmt.Sprintf("/task/update?task_id=%d", created.Task.ID), map[string]interface{}{
+		"custom_fields": map[string]interface{}{"note": nil, "estimate": "7.5"},
+		"version":       taskVersion(created.Task.ID),
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var updated models.Task
+	config.DB.First(&updated, created.Task.ID)
+	assert.Equal(t, 7.5, updated.CustomFields["estimate"])
+	assert.NotContains(t, updated.CustomFields, "note")
+
+	upload := func(csvData string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, _ := form.CreateFormFile("taskBulkUpload", "tasks.csv")
+		part.Write([]byte(csvData))
+		form.WriteField("project", "apollo")
+		form.Close()
+		req, _ := http.NewRequest("POST", "/task/bulkupload", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	header := "title,description,start_date,start_time,end_date,end_time,seconds,skills,severity,owner,due\n"
+	w = upload(header + "Bad,,2026-01-05,09:00:00,2026-01-05,10:00:00,3600,,high,nobody,\n")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Row 2")
+	w = upload(header + "Imported,,2026-01-05,09:00:00,2026-01-05,10:00:00,3600,,low,dana,2026-02-01\n")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"Imported"}, list("field.due.max=2026-02-01"))
+
+	w = requestAs(router, manager, "GET", "/task/export?project=apollo&field.owner=dana&sort=field.severity", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	assert.NoError(t, err)
+	if assert.Len(t, rows, 3) {
+		assert.Equal(t, []string{"severity", "estimate", "due", "owner", "note"}, rows[0][8:])
+		assert.Equal(t, []string{"Imported", "", "2026-01-05", "09:00:00", "2026-01-05", "10:00:00", "3600", "", "low", "", "2026-02-01", fmt.Sprint(dana.ID), ""}, rows[1])
+		assert.Equal(t, "7.5", rows[2][9])
+	}
+
+	var severity models.CustomField
+	config.DB.Where("key = ?", "severity").First(&severity)
+	w = requestAs(router, manager, "PUT", fmt.Sprintf("/projects/fields?field_id=%d", severity.ID), map[string]interface{}{"options": []string{"high", "critical"}})
+	assert.Equal(t, http.StatusConflict, w.Code, "Expected an option in use to be kept")
+
+	var owner models.CustomField
+	config.DB.Where("key = ?", "owner").First(&owner)
+	w = requestAs(router, manager, "DELETE", fmt.Sprintf("/projects/fields?field_id=%d", owner.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, list("field.owner=dana"))
+	config.DB.First(&updated, created.Task.ID)
+	assert.NotContains(t, updated.CustomFields, "owner")
+}
+
+func TestLabels(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := createNamedUser("tagger")
+
+	label := func(name, color string) models.Label {
+		w := requestAs(router, user, "POST", "/labels/", map[string]interface{}{"name": name, "color": color})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Label models.Label `json:"label"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Label
+	}
+	bug, ui, docs := label("bug", "#FF0000"), label("ui", ""), label("docs", "#00aa00")
+	assert.Equal(t, "#ff0000", bug.Color)
+	assert.Equal(t, "#808080", ui.Color)
+	assert.Equal(t, http.StatusConflict, requestAs(router, user, "POST", "/labels/", map[string]interface{}{"name": "BUG"}).Code)
+	assert.Equal(t, http.StatusConflict, requestAs(router, user, "PUT", fmt.Sprintf("/labels/?label_id=%d", ui.ID), map[string]interface{}{"name": "Bug"}).Code)
+	assert.Error(t, config.DB.Create(&models.Label{Name: "Docs"}).Error, "Expected the database to enforce unique names regardless of case")
+	assert.Equal(t, http.StatusBadRequest, requestAs(router, user, "POST", "/labels/", map[string]interface{}{"name": "a,b"}).Code)
+	assert.Equal(t, http.StatusBadRequest, requestAs(router, user, "POST", "/labels/", map[string]interface{}{"name": "red", "color": "red"}).Code)
+
+	first, second, third := CreateTestTask(), CreateTestTask(), CreateTestTask()
+	config.DB.Model(first).Update("title", "First")
+	config.DB.Model(second).Update("title", "Second")
+	config.DB.Model(third).Update("title", "Third")
+	config.DB.Model(third).Update("status", models.TaskStatusDone)
+
+	w := requestAs(router, user, "PUT", "/task/labels", map[string]interface{}{"task_ids": []uint{first.ID, second.ID, third.ID}, "add": []uint{bug.ID, ui.ID}})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = requestAs(router, user, "PUT", "/task/labels", map[string]interface{}{"task_ids": []uint{second.ID}, "add": []uint{docs.ID}, "remove": []uint{bug.ID}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(router, user, "PUT", "/task/labels", map[string]interface{}{"task_ids": []uint{third.ID}, "remove": []uint{ui.ID}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(router, user, "PUT", "/task/labels", map[string]interface{}{"task_ids": []uint{first.ID}, "add": []uint{bug.ID}})
+	assert.Equal(t, http.StatusOK, w.Code, "Expected adding a label twice to be harmless")
+	w = requestAs(router, user, "PUT", "/task/labels", map[string]interface{}{"task_ids": []uint{first.ID, 99999}, "add": []uint{bug.ID}})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "99999")
+
+	list := func(query string) []string {
+		w := requestAs(router, user, "GET", "/task/?"+query, nil)
+		var resp struct {
+			Tasks []models.Task `json:"tasks"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		titles := []string{}
+		for _, task := range resp.Tasks {
+			titles = append(titles, task.Title)
+		}
+		return titles
+	}
+	// first: bug, ui; second: ui, docs; third: bug
+	assert.ElementsMatch(t, []string{"First", "Second"}, list("labels.any=UI"))
+	assert.ElementsMatch(t, []string{"First", "Third"}, list("labels.all=bug"))
+	assert.ElementsMatch(t, []string{"First"}, list("labels.all=bug,ui"))
+	assert.ElementsMatch(t, []string{"Second"}, list("labels.any=docs,bug&labels.none=bug"))
+	assert.Empty(t, list("labels.all=bug,missing"))
+
+	w = requestAs(router, user, "GET", "/labels/stats", nil)
+	var stats struct {
+		Labels []struct {
+			Name      string `json:"name"`
+			Tasks     int64  `json:"tasks"`
+			OpenTasks int64  `json:"open_tasks"`
+			DoneTasks int64  `json:"done_tasks"`
+		} `json:"labels"`
+		Unlabeled int64 `json:"unlabeled_tasks"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if assert.Len(t, stats.Labels, 3) {
+		assert.Equal(t, "bug", stats.Labels[0].Name)
+		assert.Equal(t, int64(2), stats.Labels[0].Tasks)
+		assert.Equal(t, int64(1), stats.Labels[0].OpenTasks)
+		assert.Equal(t, int64(1), stats.Labels[0].DoneTasks)
+		assert.Equal(t, "docs", stats.Labels[2].Name)
+		assert.Equal(t, int64(1), stats.Labels[2].Tasks)
+	}
+	assert.Equal(t, int64(0), stats.Unlabeled)
+
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("/labels/?label_id=%d", bug.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.ElementsMatch(t, []string{"Third"}, list("labels.none=ui,docs"))
+	var links int64
+	config.DB.Table("task_labels").Where("label_id = ?", bug.ID).Count(&links)
+	assert.Equal(t, int64(0), links)
+}
+
+func TestChecklists(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := createNamedUser("checker")
+	task := CreateTestTask()
+	config.DB.Model(task).Updates(map[string]interface{}{"project": "apollo", "priority": models.PriorityHigh})
+
+	type checklist struct {
+		Checklist []models.ChecklistItem `json:"checklist"`
+		Done      int                    `json:"done"`
+		Total     int                    `json:"total"`
+		Progress  float64                `json:"progress"`
+	}
+	read := func(w *httptest.ResponseRecorder) checklist {
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp checklist
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+	texts := func(list checklist) []string {
+		var texts []string
+		for i, item := range list.Checklist {
+			assert.Equal(t, i, item.Position)
+			texts = append(texts, item.Text)
+		}
+		return texts
+	}
+
+	requestAs(router, user, "POST", "/task/checklist", map[string]interface{}{"task_id": task.ID, "text": "Write"})
+	requestAs(router, user, "POST", "/task/checklist", map[string]interface{}{"task_id": task.ID, "text": "Review"})
+	list := read(requestAs(router, user, "POST", "/task/checklist", map[string]interface{}{"task_id": task.ID, "text": "Plan", "position": 0}))
+	assert.Equal(t, []string{"Plan", "Write", "Review"}, texts(list))
+	assert.Equal(t, http.StatusBadRequest, requestAs(router, user, "POST", "/task/checklist", map[string]interface{}{"task_id": task.ID, "text": " "}).Code)
+	plan, write, review := list.Checklist[0], list.Checklist[1], list.Checklist[2]
+
+	list = read(requestAs(router, user, "PUT", fmt.Sprintf("/task/checklist?item_id=%d", write.ID), map[string]interface{}{"done": true}))
+	assert.Equal(t, 1, list.Done)
+	assert.Equal(t, 3, list.Total)
+	assert.Equal(t, 0.333, list.Progress)
+	assert.NotNil(t, list.Checklist[1].DoneAt)
+
+	list = read(requestAs(router, user, "PUT", fmt.Sprintf("/task/checklist?item_id=%d", review.ID), map[string]interface{}{"position": 0}))
+	assert.Equal(t, []string{"Review", "Plan", "Write"}, texts(list))
+
+	w := requestAs(router, user, "POST", fmt.Sprintf("/task/checklist/convert?item_id=%d", write.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var converted struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &converted)
+	assert.Equal(t, "Write", converted.Task.Title)
+	assert.Equal(t, models.TaskStatusDone, converted.Task.Status)
+	assert.Equal(t, "apollo", converted.Task.Project)
+	assert.Equal(t, models.PriorityHigh, converted.Task.Priority)
+	if assert.NotNil(t, converted.Task.ParentID) {
+		assert.Equal(t, task.ID, *converted.Task.ParentID)
+	}
+
+	// The remaining checklist is the task's own work and outweighs the
+	// unestimated subtask.
+	list = read(requestAs(router, user, "GET", fmt.Sprintf("/task/checklist?task_id=%d", task.ID), nil))
+	assert.Equal(t, []string{"Review", "Plan"}, texts(list))
+	assert.Equal(t, 0.0, list.Progress)
+	list = read(requestAs(router, user, "PUT", fmt.Sprintf("/task/checklist?item_id=%d", plan.ID), map[string]interface{}{"done": true}))
+	assert.Equal(t, 0.5, list.Progress)
+
+	list = read(requestAs(router, user, "DELETE", fmt.Sprintf("/task/checklist?item_id=%d", review.ID), nil))
+	assert.Equal(t, []string{"Plan"}, texts(list))
+	assert.Equal(t, 1.0, list.Progress)
+
+	w = requestAs(router, user, "PUT", fmt.Sprintf("/task/update?task_id=%d", task.ID), map[string]interface{}{"title": "Renamed", "version": taskVersion(task.ID)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"checklist":[`)
+
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("/task/delete?task_id=%d&subtasks=cascade", task.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var items int64
+	config.DB.Model(&models.ChecklistItem{}).Count(&items)
+	assert.Equal(t, int64(0), items)
+}
+
+func TestAuditLog(t *testing.T) {
+	setup()
+	router := setupRouter()
+	admin := models.User{Username: "auditor", Email: "auditor@example.com", Role: models.RoleAdmin}
+	config.DB.Create(&admin)
+	worker := createNamedUser("worker")
+
+	jsonData, _ := json.Marshal(map[string]interface{}{"title": "Audited", "seconds": 3600})
+	req, _ := http.NewRequest("POST", "/task/create", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Test-User", fmt.Sprint(admin.ID))
+	req.Header.Set(middleware.RequestIDHeader, "create-request-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "create-request-1", w.Header().Get(middleware.RequestIDHeader))
+	var created struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	taskID := created.Task.ID
+
+	w = requestAs(router, admin, "PUT", fmt.Sprintf("/task/update?task_id=%d", taskID), map[string]interface{}{"title": "Audited again", "priority": "high", "version": taskVersion(taskID)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, w.Header().Get(middleware.RequestIDHeader), 32, "Expected a generated request ID")
+	w = requestAs(router, admin, "PUT", fmt.Sprintf("/task/update?task_id=%d", taskID), map[string]interface{}{"title": "Audited again", "version": taskVersion(taskID)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(router, admin, "PUT", "/task/assign", map[string]interface{}{"task_id": taskID, "user_id": worker.ID})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(router, admin, "DELETE", fmt.Sprintf("/task/delete?task_id=%d", taskID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = requestAs(router, worker, "GET", fmt.Sprintf("/task/history?task_id=%d", taskID), nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Expected the history to outlive the task")
+	var history struct {
+		Events []models.AuditEvent `json:"events"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if assert.Len(t, history.Events, 4, "Expected the no-op update to be skipped") {
+		assert.Equal(t, models.AuditTaskCreated, history.Events[0].Action)
+		assert.Equal(t, "create-request-1", history.Events[0].RequestID)
+		assert.Equal(t, admin.ID, *history.Events[0].ActorID)
+
+		assert.Equal(t, models.AuditTaskUpdated, history.Events[1].Action)
+		if assert.Len(t, history.Events[1].Changes, 2) {
+			assert.Equal(t, "priority", history.Events[1].Changes[0].Field)
+			assert.Equal(t, "title", history.Events[1].Changes[1].Field)
+			assert.Equal(t, "Audited", history.Events[1].Changes[1].Before)
+			assert.Equal(t, "Audited again", history.Events[1].Changes[1].After)
+		}
+
+		assert.Equal(t, models.AuditTaskAssigned, history.Events[2].Action)
+		if assert.Len(t, history.Events[2].Changes, 1) {
+			assert.Nil(t, history.Events[2].Changes[0].Before)
+			assert.Equal(t, float64(worker.ID), history.Events[2].Changes[0].After)
+		}
+		assert.Equal(t, models.AuditTaskDeleted, history.Events[3].Action)
+	}
+	assert.Equal(t, http.StatusNotFound, requestAs(router, worker, "GET", "/task/history?task_id=999999", nil).Code)
+
+	RegisterUserForTest()
+	w = postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "WrongPassword1"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postJSON(router, "/auth/login", map[string]string{"email": "testuser@example.com", "password": "Password123"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	search := func(query string) []models.AuditEvent {
+		w := requestAs(router, admin, "GET", "/admin/audit?"+query, nil)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Events []models.AuditEvent `json:"events"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Events
+	}
+	logins := search("action=" + models.AuditLogin + "," + models.AuditLoginFailed)
+	if assert.Len(t, logins, 2) {
+		assert.Equal(t, models.AuditLogin, logins[0].Action, "Expected the newest event first")
+		assert.Equal(t, models.AuditLoginFailed, logins[1].Action)
+	}
+	assert.Len(t, search("request_id=create-request-1"), 1)
+	assert.Len(t, search(fmt.Sprintf("task_id=%d&action=%s", taskID, models.AuditTaskUpdated)), 1)
+	assert.Len(t, search("from="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))), 0)
+
+	page := search(fmt.Sprintf("actor_id=%d&limit=3", admin.ID))
+	assert.Len(t, page, 3)
+	assert.Len(t, search(fmt.Sprintf("actor_id=%d&before_id=%d", admin.ID, page[2].ID)), 1)
+	assert.Equal(t, http.StatusBadRequest, requestAs(router, admin, "GET", "/admin/audit?limit=5000", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, requestAs(router, admin, "GET", "/admin/audit?from=yesterday", nil).Code)
+
+	event := history.Events[0]
+	assert.ErrorIs(t, config.DB.Model(&event).Update("details", "tampered").Error, models.ErrAuditImmutable)
+	assert.ErrorIs(t, config.DB.Delete(&event).Error, models.ErrAuditImmutable)
+	var stored models.AuditEvent
+	assert.NoError(t, config.DB.First(&stored, event.ID).Error)
+	assert.Equal(t, "Audited", stored.Details)
+}
+
+func TestTaskVersioning(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := createNamedUser("editor")
+
+	w := requestAs(router, user, "POST", "/task/create", map[string]interface{}{"title": "Shared", "seconds": 3600})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+	var created struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	assert.Equal(t, uint(1), created.Task.Version)
+	path := fmt.Sprintf("/task/update?task_id=%d", created.Task.ID)
+
+	update := func(ifMatch string, payload map[string]interface{}) *httptest.ResponseRecorder {
+		jsonData, _ := json.Marshal(payload)
+		req, _ := http.NewRequest("PUT", path, bytes.NewBuffer(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-User", fmt.Sprint(user.ID))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	type conflict struct {
+		Version uint        `json:"version"`
+		Task    models.Task `json:"task"`
+	}
+
+	assert.Equal(t, http.StatusPreconditionRequired, update("", map[string]interface{}{"title": "Unversioned"}).Code)
+	assert.Equal(t, http.StatusBadRequest, update("latest", map[string]interface{}{"title": "Bad tag"}).Code)
+
+	w = update(`"1"`, map[string]interface{}{"title": "First edit"})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	w = update(`"1"`, map[string]interface{}{"title": "Stale edit"})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+	var stale conflict
+	json.Unmarshal(w.Body.Bytes(), &stale)
+	assert.Equal(t, uint(2), stale.Version)
+	assert.Equal(t, "First edit", stale.Task.Title, "Expected the current state in the conflict")
+
+	// Assignments and checklist changes count as changes too.
+	worker := createNamedUser("worker")
+	w = requestAs(router, user, "PUT", "/task/assign", map[string]interface{}{"task_id": created.Task.ID, "user_id": worker.ID})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"version":3`)
+	w = requestAs(router, user, "POST", "/task/checklist", map[string]interface{}{"task_id": created.Task.ID, "text": "Review"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, uint(4), taskVersion(created.Task.ID))
+
+	w = update("", map[string]interface{}{"title": "Based on v2", "version": 2})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &stale)
+	assert.Equal(t, uint(4), stale.Version)
+	if assert.NotNil(t, stale.Task.AssignedTo) {
+		assert.Equal(t, worker.ID, *stale.Task.AssignedTo)
+	}
+
+	w = update("", map[string]interface{}{"title": "Based on v4", "version": 4})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var saved models.Task
+	config.DB.First(&saved, created.Task.ID)
+	assert.Equal(t, "Based on v4", saved.Title)
+	if assert.NotNil(t, saved.AssignedTo, "Expected the assignment to survive the update") {
+		assert.Equal(t, worker.ID, *saved.AssignedTo)
+	}
+
+	w = update(`W/"5"`, map[string]interface{}{"priority": "high"})
+	assert.Equal(t, http.StatusOK, w.Code, "Expected weak tags to match")
+	w = update("*", map[string]interface{}{"priority": "low"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"7"`, w.Header().Get("ETag"))
+
+	// Of two updates based on the same version, only the first is saved.
+	precondition := versionPrecondition{version: 7}
+	assert.NoError(t, precondition.claimVersion(config.DB, created.Task.ID))
+	assert.ErrorIs(t, precondition.claimVersion(config.DB, created.Task.ID), errVersionConflict)
+}
+
+func TestPatchTask(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := createNamedUser("patcher")
+	config.DB.Create(&models.CustomField{Project: "apollo", Key: "severity", Name: "Severity", Type: models.FieldTypeText})
+
+	w := requestAs(router, user, "POST", "/task/create", map[string]interface{}{
+		"title":              "Patchable",
+		"description":        "To be cleared",
+		"planned_start_time": "2025-01-27T09:00:00Z",
+		"actual_start_time":  "2025-01-27T09:30:00Z",
+		"seconds":            3600,
+		"project":            "apollo",
+		"custom_fields":      map[string]interface{}{"severity": "high"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	id := created.Task.ID
+	path := fmt.Sprintf("/task/update?task_id=%d", id)
+
+	patch := func(contentType, body, ifMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Test-User", fmt.Sprint(user.ID))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	load := func() models.Task {
+		var task models.Task
+		config.DB.First(&task, id)
+		return task
+	}
+
+	// PUT takes RFC 3339 as well as Unix seconds.
+	w = requestAs(router, user, "PUT", path, map[string]interface{}{"planned_end_time": "2025-01-27T17:00:00Z", "version": taskVersion(id)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, load().PlannedEndTime.Equal(time.Date(2025, 1, 27, 17, 0, 0, 0, time.UTC)))
+
+	w = patch("application/merge-patch+json", fmt.Sprintf(`{
+		"version": %d,
+		"description": null,
+		"seconds": 0,
+		"actual_start_time": null,
+		"custom_fields": {"severity": null},
+		"planned_start_time": "2025-01-27T10:00:00+01:00"
+	}`, taskVersion(id)), "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	task := load()
+	assert.Equal(t, "", task.Description)
+	assert.Equal(t, int64(0), task.Seconds)
+	assert.True(t, task.ActualStartTime.IsZero())
+	assert.Empty(t, task.CustomFields)
+	assert.True(t, task.PlannedStartTime.Equal(time.Date(2025, 1, 27, 9, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "Patchable", task.Title, "Expected fields left out of a merge patch to stay")
+
+	assert.Equal(t, http.StatusPreconditionRequired, patch("application/merge-patch+json", `{"title": "No version"}`, "").Code)
+	assert.Equal(t, http.StatusConflict, patch("application/merge-patch+json", `{"title": "Stale", "version": 1}`, "").Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, patch("text/plain", `title=x`, "*").Code)
+	assert.Equal(t, http.StatusBadRequest, patch("application/merge-patch+json", `[1]`, "*").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, patch("application/merge-patch+json", `{"owner": "nobody"}`, "*").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, patch("application/merge-patch+json", `{"title": null}`, "*").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, patch("application/merge-patch+json", `{"seconds": "lots"}`, "*").Code)
+	assert.Equal(t, http.StatusBadRequest, patch("application/merge-patch+json", `{"planned_end_time": "2025-01-27T08:00:00Z"}`, "*").Code)
+
+	version := taskVersion(id)
+	w = patch("application/json-patch+json", fmt.Sprintf(`[
+		{"op": "test", "path": "/version", "value": %d},
+		{"op": "replace", "path": "/title", "value": "Patched"},
+		{"op": "add", "path": "/required_skills/-", "value": "go"},
+		{"op": "add", "path": "/custom_fields/severity", "value": "low"},
+		{"op": "copy", "from": "/title", "path": "/description"},
+		{"op": "replace", "path": "/planned_end_time", "value": null}
+	]`, version), "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	task = load()
+	assert.Equal(t, "Patched", task.Title)
+	assert.Equal(t, "Patched", task.Description)
+	assert.Equal(t, models.StringList{"go"}, task.RequiredSkills)
+	assert.Equal(t, "low", task.CustomFields["severity"])
+	assert.True(t, task.PlannedEndTime.IsZero())
+	assert.Equal(t, version+1, task.Version)
+
+	w = patch("application/json-patch+json", fmt.Sprintf(`[{"op": "test", "path": "/version", "value": %d}, {"op": "remove", "path": "/title"}]`, version), "")
+	assert.Equal(t, http.StatusConflict, w.Code, "Expected a failed version test to be a conflict")
+	w = patch("application/json-patch+json", `[{"op": "test", "path": "/title", "value": "Other"}, {"op": "replace", "path": "/description", "value": "x"}]`, `"`+fmt.Sprint(version+1)+`"`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "Patched", load().Description, "Expected a failed patch to change nothing")
+	assert.Equal(t, http.StatusUnprocessableEntity, patch("application/json-patch+json", `[{"op": "remove", "path": "/nothing"}]`, "*").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, patch("application/json-patch+json", `[{"op": "replace", "path": "/version", "value": 1}]`, "*").Code)
+	assert.Equal(t, http.StatusBadRequest, patch("application/json-patch+json", `[{"op": "frobnicate", "path": "/title"}]`, "*").Code)
+	assert.Equal(t, http.StatusBadRequest, patch("application/json-patch+json", `[{"op": "add", "path": "title", "value": "x"}]`, "*").Code)
+	assert.Equal(t, http.StatusNotFound, requestAs(router, user, "PATCH", "/task/update?task_id=999999", nil).Code)
+}
+
+func TestAPIv1Routes(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := createNamedUser("restful")
+	worker := createNamedUser("worker")
+
+	w := requestAs(router, user, "POST", "/api/v1/tasks", map[string]interface{}{"title": "Resource", "seconds": 3600})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	path := fmt.Sprintf("/api/v1/tasks/%d", created.Task.ID)
+	assert.Equal(t, path, w.Header().Get("Location"))
+	assert.Empty(t, w.Header().Get("Deprecation"))
+
+	w = requestAs(router, user, "GET", path, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+	assert.Contains(t, w.Body.String(), `"title":"Resource"`)
+	assert.Equal(t, http.StatusNotFound, requestAs(router, user, "GET", "/api/v1/tasks/999999", nil).Code)
+	assert.Equal(t, http.StatusNotFound, requestAs(router, user, "GET", "/api/v1/tasks/abc", nil).Code)
+	assert.Equal(t, http.StatusNotFound, requestAs(router, user, "GET", "/api/v1/tasks/1%20OR%201=1", nil).Code)
+
+	w = requestAs(router, user, "PUT", path, map[string]interface{}{"title": "Renamed", "version": 1})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	req, _ := http.NewRequest("PATCH", path, bytes.NewBufferString(`{"description": "Patched"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("X-Test-User", fmt.Sprint(user.ID))
+	req.Header.Set("If-Match", `"2"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = requestAs(router, user, "PUT", path+"/assignee", map[string]interface{}{"user_id": worker.ID})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var task models.Task
+	config.DB.First(&task, created.Task.ID)
+	assert.Equal(t, "Patched", task.Description)
+	if assert.NotNil(t, task.AssignedTo) {
+		assert.Equal(t, worker.ID, *task.AssignedTo)
+	}
+
+	w = requestAs(router, user, "POST", path+"/checklist", map[string]interface{}{"text": "Step"})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var item models.ChecklistItem
+	config.DB.Where("task_id = ?", created.Task.ID).First(&item)
+	other := CreateTestTask()
+	assert.Equal(t, http.StatusNotFound, requestAs(router, user, "PUT", fmt.Sprintf("/api/v1/tasks/%d/checklist/%d", other.ID, item.ID), map[string]interface{}{"done": true}).Code,
+		"Expected items to be reachable only through their own task")
+	w = requestAs(router, user, "PUT", fmt.Sprintf("%s/checklist/%d", path, item.ID), map[string]interface{}{"done": true})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("%s/checklist/%d", path, item.ID), nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = requestAs(router, user, "POST", path+"/comments", map[string]interface{}{"body": "Looks good"})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var comment struct {
+		Comment models.Comment `json:"comment"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &comment)
+	w = requestAs(router, user, "GET", path+"/comments", nil)
+	assert.Contains(t, w.Body.String(), "Looks good")
+	w = requestAs(router, user, "DELETE", fmt.Sprintf("%s/comments/%d", path, comment.Comment.ID), nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = requestAs(router, user, "DELETE", path, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, http.StatusNotFound, requestAs(router, user, "GET", path, nil).Code)
+	assert.Equal(t, http.StatusNotFound, requestAs(router, user, "DELETE", path, nil).Code)
+
+	w = requestAs(router, user, "GET", path+"/history", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), models.AuditTaskDeleted)
+
+	// The legacy routes still work, with their old status codes, and point
+	// to their successors.
+	w = requestAs(router, user, "POST", "/task/create", map[string]interface{}{"title": "Legacy", "seconds": 60})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	assert.Equal(t, `</api/v1/tasks>; rel="successor-version"`, w.Header().Get("Link"))
+	assert.Empty(t, w.Header().Get("Location"))
+}
+
+func TestProblemDetails(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := createNamedUser("troubled")
+
+	decode := func(w *httptest.ResponseRecorder) problem.Problem {
+		assert.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+		var p problem.Problem
+		json.Unmarshal(w.Body.Bytes(), &p)
+		return p
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/tasks/999999", nil)
+	req.Header.Set("X-Test-User", fmt.Sprint(user.ID))
+	req.Header.Set("X-Request-ID", "trace-123")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	p := decode(w)
+	assert.Equal(t, "task_not_found", p.Code)
+	assert.Equal(t, "/problems/task_not_found", p.Type)
+	assert.Equal(t, "Not Found", p.Title)
+	assert.Equal(t, http.StatusNotFound, p.Status)
+	assert.Equal(t, "Task not found", p.Detail)
+	assert.Equal(t, "Task not found", p.Error, "Expected the old error member to be kept")
+	assert.Equal(t, "/api/v1/tasks/999999", p.Instance)
+	assert.Equal(t, "trace-123", p.RequestID)
+
+	p = decode(requestAs(router, user, "GET", "/no/such/route", nil))
+	assert.Equal(t, "not_found", p.Code)
+	w = requestAs(router, user, "DELETE", "/auth/login", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "method_not_allowed", decode(w).Code)
+
+	w = requestAs(router, user, "POST", "/api/v1/tasks", map[string]interface{}{"title": 42})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	p = decode(w)
+	assert.Equal(t, "validation_failed", p.Code)
+	assert.Equal(t, []problem.FieldError{{Field: "title", Code: "invalid_type", Message: "must be a string"}}, p.Errors)
+
+	w = requestAs(router, user, "POST", "/api/v1/tasks", map[string]interface{}{"title": "Odd", "status": "someday"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	p = decode(w)
+	if assert.Len(t, p.Errors, 1) {
+		assert.Equal(t, "status", p.Errors[0].Field)
+	}
+
+	w = requestAs(router, user, "POST", "/auth/register", map[string]interface{}{"email": "not-an-email"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	fields := map[string]string{}
+	for _, fe := range decode(w).Errors {
+		fields[fe.Field] = fe.Code
+	}
+	assert.Equal(t, "email", fields["email"], w.Body.String())
+	assert.Equal(t, "required", fields["password"], w.Body.String())
+
+	upload := func(csvData string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, _ := form.CreateFormFile("taskBulkUpload", "tasks.csv")
+		part.Write([]byte(csvData))
+		form.Close()
+		req, _ := http.NewRequest("POST", "/task/bulkupload", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	header := "title,description,start_date,start_time,end_date,end_time,seconds\n"
+	w = upload(header + "Ok,,2026-01-05,09:00:00,2026-01-05,10:00:00,3600\nLate,,2026-01-05,nine,2026-01-05,10:00:00,3600\n")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Expected a malformed row to be the client's fault")
+	p = decode(w)
+	assert.Equal(t, "invalid_csv", p.Code)
+	assert.Equal(t, "Row 3: Error parsing planned start time", p.Detail)
+	assert.Equal(t, []problem.FieldError{{Field: "planned_start_time", Code: "invalid", Message: "Error parsing planned start time"}}, p.Errors)
+	assert.Contains(t, w.Body.String(), `"row":3`)
+
+	w = upload(header + "Short,,2026-01-05\n")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_csv", decode(w).Code)
+	w = upload(header)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var count int64
+	config.DB.Model(&models.Task{}).Count(&count)
+	assert.Zero(t, count, "Expected no tasks from rejected files")
+}
+
+func TestTaskInputValidation(t *testing.T) {
+	setup()
+	router := setupRouter()
+	user := createNamedUser("validator")
+	assignee := createNamedUser("assignee")
+
+	fieldCodes := func(w *httptest.ResponseRecorder) map[string]string {
+		var p problem.Problem
+		json.Unmarshal(w.Body.Bytes(), &p)
+		codes := map[string]string{}
+		for _, fe := range p.Errors {
+			codes[fe.Field] = fe.Code
+		}
+		return codes
+	}
+
+	w := requestAs(router, user, "POST", "/api/v1/tasks", map[string]interface{}{
+		"title":              "   ",
+		"seconds":            -5,
+		"planned_start_time": "2026-01-05T10:00:00Z",
+		"planned_end_time":   "2026-01-05T09:00:00Z",
+		"assigned_to":        999999,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]string{
+		"title":              "required",
+		"seconds":            "negative",
+		"planned_start_time": "after_end",
+		"assigned_to":        "user_not_found",
+	}, fieldCodes(w), "Expected every invalid field to be reported at once")
+
+	w = requestAs(router, user, "POST", "/api/v1/tasks", map[string]interface{}{"title": strings.Repeat("x", 201)})
+	assert.Equal(t, map[string]string{"title": "length"}, fieldCodes(w))
+
+	w = requestAs(router, user, "POST", "/api/v1/tasks", map[string]interface{}{
+		"id":             4242,
+		"created_at":     "2001-01-01T00:00:00Z",
+		"version":        9,
+		"rollup_seconds": 99999,
+		"user":           map[string]interface{}{"username": "intruder", "role": "admin"},
+		"title":          "  Trimmed  ",
+		"seconds":        60,
+		"assigned_to":    assignee.ID,
+	})
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		Task models.Task `json:"task"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NotEqual(t, uint(4242), created.Task.ID)
+	assert.Equal(t, "Trimmed", created.Task.Title)
+	assert.Equal(t, uint(1), created.Task.Version)
+	assert.Equal(t, int64(60), created.Task.RollupSeconds)
+	assert.True(t, created.Task.CreatedAt.After(time.Now().Add(-time.Hour)))
+	assert.Equal(t, assignee.ID, derefUint(created.Task.AssignedTo))
+	var withAssignees models.Task
+	config.DB.Preload("Assignees").First(&withAssignees, created.Task.ID)
+	if assert.Len(t, withAssignees.Assignees, 1) {
+		assert.Equal(t, assignee.ID, withAssignees.Assignees[0].ID)
+	}
+	var assignments int64
+	config.DB.Model(&models.AuditEvent{}).Where("action = ? AND task_id = ?", models.AuditTaskAssigned, created.Task.ID).Count(&assignments)
+	assert.Equal(t, int64(1), assignments)
+	assert.Equal(t, int64(1), notificationCount(assignee, "task_assigned"))
+	var intruders int64
+	config.DB.Model(&models.User{}).Where("username = ?", "intruder").Count(&intruders)
+	assert.Zero(t, intruders, "Expected nested users to be ignored")
+
+	path := fmt.Sprintf("/api/v1/tasks/%d", created.Task.ID)
+	w = requestAs(router, user, "PUT", path, map[string]interface{}{"seconds": -1, "version": taskVersion(created.Task.ID)})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]string{"seconds": "negative"}, fieldCodes(w))
+	w = requestAs(router, user, "PUT", path, map[string]interface{}{
+		"actual_start_time": "2026-01-05T10:00:00Z",
+		"actual_end_time":   "2026-01-05T10:00:00Z",
+		"version":           taskVersion(created.Task.ID),
+	})
+	assert.Equal(t, map[string]string{"actual_start_time": "after_end"}, fieldCodes(w))
+
+	// Deactivating the assignee does not block edits that leave them be.
+	now := time.Now()
+	config.DB.Model(&assignee).Update("deactivated_at", &now)
+	w = requestAs(router, user, "PUT", path, map[string]interface{}{"title": "Still editable", "version": taskVersion(created.Task.ID)})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile("taskBulkUpload", "tasks.csv")
+	part.Write([]byte("title,description,start_date,start_time,end_date,end_time,seconds\n,,2026-01-05,09:00:00,2026-01-05,10:00:00,-60\n"))
+	form.Close()
+	req, _ := http.NewRequest("POST", "/task/bulkupload", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]string{"title": "required", "seconds": "negative"}, fieldCodes(w))
+	assert.Contains(t, w.Body.String(), "Row 2")
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	setup()
+	router := setupRouter()
+	alice, bob := createNamedUser("alice"), createNamedUser("bob")
+
+	send := func(user models.User, method, path, key string, payload interface{}) *httptest.ResponseRecorder {
+		jsonData, _ := json.Marshal(payload)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-User", fmt.Sprint(user.ID))
+		req.Header.Set(middleware.IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	taskCount := func(title string) int64 {
+		var count int64
+		config.DB.Model(&models.Task{}).Where("title = ?", title).Count(&count)
+		return count
+	}
+
+	// A retried create is answered with the first response and creates nothing.
+	payload := map[string]interface{}{"title": "Retried", "description": "From a flaky client"}
+	first := send(alice, "POST", "/api/v1/tasks", "create-1", payload)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	retry := send(alice, "POST", "/api/v1/tasks", "create-1", payload)
+	assert.Equal(t, first.Code, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, first.Header().Get("Location"), retry.Header().Get("Location"))
+	assert.Equal(t, "true", retry.Header().Get(middleware.IdempotencyReplayedHeader))
+	assert.Empty(t, first.Header().Get(middleware.IdempotencyReplayedHeader))
+	assert.Equal(t, int64(1), taskCount("Retried"))
+
+	// The same key with another payload is rejected.
+	w := send(alice, "POST", "/api/v1/tasks", "create-1", map[string]interface{}{"title": "Other", "description": "Different"})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"idempotency_key_mismatch"`)
+	assert.Equal(t, int64(0), taskCount("Other"))
+
+	// Keys belong to the user who sent them.
+	w = send(bob, "POST", "/api/v1/tasks", "create-1", payload)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, w.Header().Get(middleware.IdempotencyReplayedHeader))
+	assert.Equal(t, int64(2), taskCount("Retried"))
+
+	// Failed requests are stored too, but server errors are not.
+	w = send(alice, "POST", "/api/v1/tasks", "create-2", map[string]interface{}{"description": "No title"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = send(alice, "POST", "/api/v1/tasks", "create-2", map[string]interface{}{"description": "No title"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "true", w.Header().Get(middleware.IdempotencyReplayedHeader))
+
+	w = send(alice, "POST", "/api/v1/tasks", "not a valid key", payload)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"invalid_idempotency_key"`)
+
+	// A bulk upload is matched by its fields and file, not the multipart boundary.
+	upload := func(key string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		part, _ := form.CreateFormFile("taskBulkUpload", "tasks.csv")
+		part.Write([]byte("title,description,start_date,start_time,end_date,end_time,seconds\n" +
+			"Bulk retried,Uploaded twice,2025-01-27,09:00:00,2025-01-27,12:00:00,3600\n"))
+		form.Close()
+
+		req, _ := http.NewRequest("POST", "/api/v1/tasks/bulk", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-Test-User", fmt.Sprint(alice.ID))
+		req.Header.Set(middleware.IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	first = upload("bulk-1")
+	assert.Equal(t, http.StatusCreated, first.Code)
+	retry = upload("bulk-1")
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get(middleware.IdempotencyReplayedHeader))
+	assert.Equal(t, int64(1), taskCount("Bulk retried"))
+
+	// A retried delete repeats its success instead of answering 404.
+	task := models.Task{Title: "Doomed", Description: "Deleted once"}
+	config.DB.Create(&task)
+	path := fmt.Sprintf("/api/v1/tasks/%d", task.ID)
+	first = send(alice, "DELETE", path, "delete-1", nil)
+	assert.Equal(t, http.StatusNoContent, first.Code)
+	retry = send(alice, "DELETE", path, "delete-1", nil)
+	assert.Equal(t, http.StatusNoContent, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	w = send(alice, "DELETE", path, "delete-2", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Keys expire after the window.
+	config.DB.Model(&models.IdempotencyKey{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute))
+	w = send(alice, "DELETE", path, "delete-1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestBatchTasks(t *testing.T) {
+	setup()
+	router := setupRouter()
+	alice, bob := createNamedUser("alice"), createNamedUser("bob")
+
+	bug := models.Label{Name: "bug"}
+	config.DB.Create(&bug)
+	newTask := func(title, project string, parentID *uint) models.Task {
+		task := models.Task{Title: title, Description: title, Project: project, Status: models.TaskStatusOpen, ParentID: parentID}
+		config.DB.Create(&task)
+		return task
+	}
+	parent := newTask("Parent", "apollo", nil)
+	child := newTask("Child", "apollo", &parent.ID)
+	other := newTask("Other", "gemini", nil)
+	config.DB.Model(&child).Update("assigned_to", alice.ID)
+	config.DB.Model(&child).Association("Assignees").Append(&alice)
+
+	decode := func(w *httptest.ResponseRecorder) map[string]interface{} {
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body
+	}
+	status := func(id uint) string {
+		var task models.Task
+		config.DB.Unscoped().First(&task, id)
+		return task.Status
+	}
+
+	// A dry run reports the changes without saving them.
+	w := requestAs(router, alice, "POST", "/api/v1/tasks/batch", map[string]interface{}{
+		"task_ids": []uint{other.ID, parent.ID}, "action": "update", "priority": "high", "dry_run": true,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := decode(w)
+	assert.Equal(t, true, body["dry_run"])
+	results := body["results"].([]interface{})
+	assert.Len(t, results, 2)
+	assert.Equal(t, float64(other.ID), results[0].(map[string]interface{})["task_id"])
+	assert.Equal(t, "updated", results[0].(map[string]interface{})["result"])
+	assert.Equal(t, uint(1), taskVersion(other.ID))
+
+	// Completing a parent without its open child fails for that task, and
+	// nothing in the batch is saved.
+	w = requestAs(router, alice, "POST", "/api/v1/tasks/batch", map[string]interface{}{
+		"task_ids": []uint{parent.ID, other.ID, 9999}, "action": "update", "status": "done",
+	})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	body = decode(w)
+	assert.Equal(t, "batch_failed", body["code"])
+	summary := body["summary"].(map[string]interface{})
+	assert.Equal(t, float64(2), summary["failed"])
+	results = body["results"].([]interface{})
+	assert.Equal(t, "open_subtasks", results[0].(map[string]interface{})["code"])
+	assert.Equal(t, "updated", results[1].(map[string]interface{})["result"])
+	assert.Equal(t, "task_not_found", results[2].(map[string]interface{})["code"])
+	assert.Equal(t, models.TaskStatusOpen, status(other.ID))
+
+	// With the child in the batch, the whole subtree is completed, assigned
+	// and labeled in one go. Bob replaces Alice on the child.
+	w = requestAs(router, alice, "POST", "/api/v1/tasks/batch", map[string]interface{}{
+		"filter": "project=apollo", "action": "update", "status": "done", "assigned_to": bob.ID, "add_labels": []uint{bug.ID},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	summary = decode(w)["summary"].(map[string]interface{})
+	assert.Equal(t, float64(2), summary["matched"])
+	assert.Equal(t, float64(2), summary["updated"])
+	for _, id := range []uint{parent.ID, child.ID} {
+		var task models.Task
+		config.DB.Preload("Labels").Preload("Assignees").First(&task, id)
+		assert.Equal(t, models.TaskStatusDone, task.Status)
+		assert.Equal(t, bob.ID, derefUint(task.AssignedTo))
+		assert.Len(t, task.Assignees, 1)
+		assert.Equal(t, bob.ID, task.Assignees[0].ID)
+		assert.Len(t, task.Labels, 1)
+		assert.Equal(t, uint(2), task.Version)
+	}
+	var progress models.Task
+	config.DB.First(&progress, parent.ID)
+	assert.Equal(t, 1.0, progress.Progress)
+	assert.Equal(t, int64(2), notificationCount(bob, "task_assigned"))
+	assert.Equal(t, int64(0), notificationCount(alice, "task_assigned"))
+	for _, action := range []string{models.AuditTaskUpdated, models.AuditTaskAssigned} {
+		var audits int64
+		config.DB.Model(&models.AuditEvent{}).Where("action = ? AND task_id IN ?", action, []uint{parent.ID, child.ID}).Count(&audits)
+		assert.Equal(t, int64(2), audits, action)
+	}
+
+	// Repeating the update changes nothing.
+	w = requestAs(router, alice, "POST", "/api/v1/tasks/batch", map[string]interface{}{
+		"filter": "project=apollo", "action": "update", "status": "done",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(2), decode(w)["summary"].(map[string]interface{})["unchanged"])
+	assert.Equal(t, uint(2), taskVersion(parent.ID))
+
+	// Deleting the parent moves the child up.
+	w = requestAs(router, alice, "POST", "/api/v1/tasks/batch", map[string]interface{}{
+		"task_ids": []uint{parent.ID}, "action": "delete",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(1), decode(w)["summary"].(map[string]interface{})["deleted"])
+	var moved models.Task
+	config.DB.First(&moved, child.ID)
+	assert.Nil(t, moved.ParentID)
+	assert.Error(t, config.DB.First(&models.Task{}, parent.ID).Error)
+	var deletions int64
+	config.DB.Model(&models.AuditEvent{}).Where("action = ? AND task_id = ?", models.AuditTaskDeleted, parent.ID).Count(&deletions)
+	assert.Equal(t, int64(1), deletions)
+
+	// Invalid requests are rejected before any task is looked at.
+	for _, payload := range []map[string]interface{}{
+		{"action": "update", "status": "done"},
+		{"task_ids": []uint{other.ID}, "filter": "project=gemini", "action": "update", "status": "done"},
+		{"task_ids": []uint{other.ID}, "action": "update"},
+		{"task_ids": []uint{other.ID}, "action": "delete", "status": "done"},
+		{"task_ids": []uint{other.ID}, "action": "archive"},
+		{"task_ids": []uint{other.ID}, "action": "update", "status": "finished"},
+		{"filter": "sort=title", "action": "delete"},
+	} {
+		w = requestAs(router, alice, "POST", "/api/v1/tasks/batch", payload)
+		assert.Equal(t, http.StatusBadRequest, w.Code, payload)
+		assert.Equal(t, "validation_failed", decode(w)["code"], payload)
+	}
+	w = requestAs(router, alice, "POST", "/api/v1/tasks/batch", map[string]interface{}{
+		"task_ids": []uint{other.ID}, "action": "update", "add_labels": []uint{9999},
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, models.TaskStatusOpen, status(other.ID))
+}
+
 func CreateTestTask() *models.Task {
 
 	task := &models.Task{
@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	customFieldDateLayout  = "2006-01-02"
+	maxCustomFieldTextSize = 1000
+)
+
+var fieldKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// projectFields returns the custom fields defined for project by key.
+func projectFields(project string) (map[string]models.CustomField, error) {
+	fields := map[string]models.CustomField{}
+	if project == "" {
+		return fields, nil
+	}
+
+	var list []models.CustomField
+	if err := config.DB.Where("project = ?", project).Find(&list).Error; err != nil {
+		return nil, err
+	}
+	for _, field := range list {
+		fields[field.Key] = field
+	}
+	return fields, nil
+}
+
+// normalizeFieldValue converts a value from JSON, a CSV cell or a query
+// string to the form stored for field.
+func normalizeFieldValue(field models.CustomField, raw interface{}) (interface{}, error) {
+	text, isText := raw.(string)
+	if isText {
+		text = strings.TrimSpace(text)
+	}
+
+	switch field.Type {
+	case models.FieldTypeText:
+		if !isText {
+			return nil, fmt.Errorf("custom field %q must be text", field.Key)
+		}
+		if len(text) > maxCustomFieldTextSize {
+			return nil, fmt.Errorf("custom field %q must be at most %d characters", field.Key, maxCustomFieldTextSize)
+		}
+		return text, nil
+
+	case models.FieldTypeNumber:
+		number, ok := raw.(float64)
+		if isText {
+			parsed, err := strconv.ParseFloat(text, 64)
+			number, ok = parsed, err == nil && !math.IsNaN(parsed) && !math.IsInf(parsed, 0)
+		}
+		if !ok {
+			return nil, fmt.Errorf("custom field %q must be a number", field.Key)
+		}
+		return number, nil
+
+	case models.FieldTypeDate:
+		if isText {
+			if date, err := time.Parse(customFieldDateLayout, text); err == nil {
+				return date.Format(customFieldDateLayout), nil
+			}
+		}
+		return nil, fmt.Errorf("custom field %q must be a date in YYYY-MM-DD format", field.Key)
+
+	case models.FieldTypeEnum:
+		for _, option := range field.Options {
+			if isText && strings.EqualFold(option, text) {
+				return option, nil
+			}
+		}
+		return nil, fmt.Errorf("custom field %q must be one of: %s", field.Key, strings.Join(field.Options, ", "))
+
+	case models.FieldTypeUser:
+		// Users are given by ID, or by name in CSV files and filters.
+		var user models.User
+		query := config.DB.Where("deactivated_at IS NULL")
+		switch value := raw.(type) {
+		case float64:
+			if value > 0 && value == math.Trunc(value) {
+				query.First(&user, uint(value))
+			}
+		case string:
+			if id, err := strconv.ParseUint(text, 10, 64); err == nil {
+				query.First(&user, id)
+			} else if text != "" {
+				query.Where("LOWER(username) = ?", strings.ToLower(text)).First(&user)
+			}
+		}
+		if user.ID == 0 {
+			return nil, fmt.Errorf("custom field %q must be an active user", field.Key)
+		}
+		return float64(user.ID), nil
+	}
+	return nil, fmt.Errorf("custom field %q has unknown type %q", field.Key, field.Type)
+}
+
+// setCustomFields applies changes to the task's custom field values, where
+// nil clears a value, and checks the result against the fields of the
+// task's project.
+func setCustomFields(task *models.Task, fields map[string]models.CustomField, changes map[string]interface{}) error {
+	values := models.FieldValues{}
+	for key, value := range task.CustomFields {
+		values[key] = value
+	}
+
+	for key, raw := range changes {
+		if raw == nil {
+			delete(values, key)
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown custom field %q for project %q", key, task.Project)
+		}
+		value, err := normalizeFieldValue(field, raw)
+		if err != nil {
+			return err
+		}
+		values[key] = value
+	}
+
+	var missing []string
+	for key := range values {
+		if _, ok := fields[key]; !ok {
+			return fmt.Errorf("unknown custom field %q for project %q", key, task.Project)
+		}
+	}
+	for key, field := range fields {
+		if _, ok := values[key]; field.Required && !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing required custom fields: %s", strings.Join(missing, ", "))
+	}
+
+	task.CustomFields = values
+	return nil
+}
+
+// compareFieldValues orders two stored values of field. Enum values follow
+// the order of the field's options.
+func compareFieldValues(field models.CustomField, a, b interface{}) int {
+	switch field.Type {
+	case models.FieldTypeNumber, models.FieldTypeUser:
+		x, _ := a.(float64)
+		y, _ := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case models.FieldTypeEnum:
+		x, y := len(field.Options), len(field.Options)
+		for i, option := range field.Options {
+			if option == a {
+				x = i
+			}
+			if option == b {
+				y = i
+			}
+		}
+		return x - y
+	}
+	x, _ := a.(string)
+	y, _ := b.(string)
+	return strings.Compare(strings.ToLower(x), strings.ToLower(y))
+}
+
+// formatFieldValue renders a stored value for a CSV cell.
+func formatFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+type customFieldInput struct {
+	Project  string   `json:"project" binding:"required"`
+	Key      string   `json:"key" binding:"required"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type" binding:"required"`
+	Options  []string `json:"options"`
+	Required bool     `json:"required"`
+}
+
+func validateFieldOptions(fieldType string, options []string) (models.StringList, error) {
+	if fieldType != models.FieldTypeEnum {
+		if len(options) > 0 {
+			return nil, errors.New("only enum fields have options")
+		}
+		return nil, nil
+	}
+
+	var list models.StringList
+	for _, option := range options {
+		option = strings.TrimSpace(option)
+		if option == "" || list.Contains(option) {
+			return nil, fmt.Errorf("enum options must be unique and non-empty, got %q", option)
+		}
+		list = append(list, option)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("enum fields need at least one option")
+	}
+	return list, nil
+}
+
+func GetCustomFields(c *gin.Context) {
+	query := config.DB.Order("project, id")
+	if project := c.Query("project"); project != "" {
+		query = query.Where("project = ?", project)
+	}
+
+	var fields []models.CustomField
+	if err := query.Find(&fields).Error; err != nil {
+		problem.Internal(c, "Failed to fetch custom fields", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"fields": fields})
+}
+
+// CreateCustomField defines a field for a project. New required fields only
+// apply to tasks created or updated afterwards.
+func CreateCustomField(c *gin.Context) {
+	var input customFieldInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+	if !fieldKeyPattern.MatchString(input.Key) {
+		problem.Invalid(c, "Key must start with a lowercase letter and contain only lowercase letters, digits and underscores")
+		return
+	}
+	input.Type = strings.ToLower(input.Type)
+	if !models.StringList(models.FieldTypes).Contains(input.Type) {
+		problem.Invalid(c, fmt.Sprintf("Invalid type %q", input.Type))
+		return
+	}
+	options, err := validateFieldOptions(input.Type, input.Options)
+	if err != nil {
+		problem.Validation(c, err)
+		return
+	}
+	if input.Name == "" {
+		input.Name = input.Key
+	}
+
+	var existing int64
+	config.DB.Model(&models.CustomField{}).Where("project = ? AND key = ?", input.Project, input.Key).Count(&existing)
+	if existing > 0 {
+		problem.Respond(c, http.StatusConflict, "custom_field_exists", fmt.Sprintf("Project %q already has a field %q", input.Project, input.Key))
+		return
+	}
+
+	field := models.CustomField{
+		Project:  input.Project,
+		Key:      input.Key,
+		Name:     input.Name,
+		Type:     input.Type,
+		Options:  options,
+		Required: input.Required,
+	}
+	if err := config.DB.Create(&field).Error; err != nil {
+		problem.Internal(c, "Failed to create custom field", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom field created successfully", "field": field})
+}
+
+// UpdateCustomField changes a field's name, options or required flag. The
+// project, key and type are fixed; enum options still in use cannot be
+// removed.
+func UpdateCustomField(c *gin.Context) {
+	var field models.CustomField
+	if err := config.DB.First(&field, c.Query("field_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "custom_field_not_found", "Custom field not found")
+		return
+	}
+
+	var input struct {
+		Name     *string  `json:"name"`
+		Options  []string `json:"options"`
+		Required *bool    `json:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if input.Options != nil {
+		options, err := validateFieldOptions(field.Type, input.Options)
+		if err != nil {
+			problem.Validation(c, err)
+			return
+		}
+
+		var tasks []models.Task
+		if err := config.DB.Select("id", "custom_fields").Where("project = ?", field.Project).Find(&tasks).Error; err != nil {
+			problem.Internal(c, "Failed to check option usage", err)
+			return
+		}
+		for _, task := range tasks {
+			if value, ok := task.CustomFields[field.Key].(string); ok && !options.Contains(value) {
+				problem.Respond(c, http.StatusConflict, "option_in_use", fmt.Sprintf("Option %q is still used by task %d", value, task.ID))
+				return
+			}
+		}
+		field.Options = options
+	}
+	if input.Name != nil && *input.Name != "" {
+		field.Name = *input.Name
+	}
+	if input.Required != nil {
+		field.Required = *input.Required
+	}
+
+	if err := config.DB.Save(&field).Error; err != nil {
+		problem.Internal(c, "Failed to update custom field", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom field updated successfully", "field": field})
+}
+
+// DeleteCustomField removes a field and its values from the project's tasks.
+func DeleteCustomField(c *gin.Context) {
+	var field models.CustomField
+	if err := config.DB.First(&field, c.Query("field_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "custom_field_not_found", "Custom field not found")
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var tasks []models.Task
+		if err := tx.Select("id", "custom_fields").Where("project = ?", field.Project).Find(&tasks).Error; err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if _, ok := task.CustomFields[field.Key]; !ok {
+				continue
+			}
+			delete(task.CustomFields, field.Key)
+			if err := tx.Model(&models.Task{}).Where("id = ?", task.ID).Updates(map[string]interface{}{"custom_fields": task.CustomFields, "version": nextVersion}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&field).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to delete custom field", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom field deleted successfully"})
+}
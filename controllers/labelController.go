@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/websocket"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultLabelColor  = "#808080"
+	maxLabelNameLength = 50
+)
+
+var labelColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// validateLabel checks a label's name and color. Commas are not allowed in
+// names since tag queries list names separated by commas.
+func validateLabel(label *models.Label) error {
+	label.Name = strings.TrimSpace(label.Name)
+	if label.Name == "" || len(label.Name) > maxLabelNameLength {
+		return problem.FieldError{Field: "name", Code: "length", Message: fmt.Sprintf("label name must be 1 to %d characters", maxLabelNameLength)}
+	}
+	if strings.Contains(label.Name, ",") {
+		return problem.FieldError{Field: "name", Code: "invalid", Message: "label name must not contain commas"}
+	}
+	if label.Color == "" {
+		label.Color = defaultLabelColor
+	}
+	if !labelColorPattern.MatchString(label.Color) {
+		return problem.FieldError{Field: "color", Code: "invalid", Message: "label color must look like #1a2b3c"}
+	}
+	label.Color = strings.ToLower(label.Color)
+	return nil
+}
+
+// isUniqueViolation reports whether err is a failed unique constraint, such
+// as a second label with the same name.
+func isUniqueViolation(err error) bool {
+	if translator, ok := config.DB.Dialector.(gorm.ErrorTranslator); ok {
+		err = translator.Translate(err)
+	}
+	return errors.Is(err, gorm.ErrDuplicatedKey)
+}
+
+func GetLabels(c *gin.Context) {
+	var labels []models.Label
+	if err := config.DB.Order("name").Find(&labels).Error; err != nil {
+		problem.Internal(c, "Failed to fetch labels", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"labels": labels})
+}
+
+func CreateLabel(c *gin.Context) {
+	var input struct {
+		Name        string `json:"name" binding:"required"`
+		Color       string `json:"color"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	label := models.Label{Name: input.Name, Color: input.Color, Description: input.Description}
+	if err := validateLabel(&label); err != nil {
+		problem.Validation(c, err)
+		return
+	}
+	if err := config.DB.Create(&label).Error; isUniqueViolation(err) {
+		problem.Respond(c, http.StatusConflict, "label_exists", fmt.Sprintf("Label %q already exists", label.Name))
+		return
+	} else if err != nil {
+		problem.Internal(c, "Failed to create label", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Label created successfully", "label": label})
+}
+
+func UpdateLabel(c *gin.Context) {
+	var label models.Label
+	if err := config.DB.First(&label, c.Query("label_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "label_not_found", "Label not found")
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Color       *string `json:"color"`
+		Description *string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+	if input.Name != nil {
+		label.Name = *input.Name
+	}
+	if input.Color != nil {
+		label.Color = *input.Color
+	}
+	if input.Description != nil {
+		label.Description = *input.Description
+	}
+
+	if err := validateLabel(&label); err != nil {
+		problem.Validation(c, err)
+		return
+	}
+	if err := config.DB.Save(&label).Error; isUniqueViolation(err) {
+		problem.Respond(c, http.StatusConflict, "label_exists", fmt.Sprintf("Label %q already exists", label.Name))
+		return
+	} else if err != nil {
+		problem.Internal(c, "Failed to update label", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Label updated successfully", "label": label})
+}
+
+// DeleteLabel removes a label from every task and then deletes it.
+func DeleteLabel(c *gin.Context) {
+	var label models.Label
+	if err := config.DB.First(&label, c.Query("label_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "label_not_found", "Label not found")
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM task_labels WHERE label_id = ?", label.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&label).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to delete label", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Label deleted successfully"})
+}
+
+// UpdateTaskLabels adds and removes labels on one or more tasks at once.
+func UpdateTaskLabels(c *gin.Context) {
+	var input struct {
+		TaskIDs []uint `json:"task_ids" binding:"required"`
+		Add     []uint `json:"add"`
+		Remove  []uint `json:"remove"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+	if len(input.TaskIDs) == 0 || len(input.Add)+len(input.Remove) == 0 {
+		problem.Invalid(c, "Give task_ids and labels to add or remove")
+		return
+	}
+
+	var tasks []models.Task
+	if err := config.DB.Preload("Labels").Where("id IN ?", input.TaskIDs).Order("id").Find(&tasks).Error; err != nil {
+		problem.Internal(c, "Failed to fetch tasks", err)
+		return
+	}
+	taskIDs := make([]uint, len(tasks))
+	for i, task := range tasks {
+		taskIDs[i] = task.ID
+	}
+	if missing := missingIDs(input.TaskIDs, taskIDs); len(missing) > 0 {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Tasks not found", gin.H{"task_ids": missing})
+		return
+	}
+
+	var add, remove []models.Label
+	if err := config.DB.Where("id IN ?", input.Add).Find(&add).Error; err != nil {
+		problem.Internal(c, "Failed to fetch labels", err)
+		return
+	}
+	if err := config.DB.Where("id IN ?", input.Remove).Find(&remove).Error; err != nil {
+		problem.Internal(c, "Failed to fetch labels", err)
+		return
+	}
+	var labelIDs []uint
+	for _, label := range append(append([]models.Label{}, add...), remove...) {
+		labelIDs = append(labelIDs, label.ID)
+	}
+	if missing := missingIDs(append(append([]uint{}, input.Add...), input.Remove...), labelIDs); len(missing) > 0 {
+		problem.Respond(c, http.StatusNotFound, "label_not_found", "Labels not found", gin.H{"label_ids": missing})
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		for i := range tasks {
+			if len(add) > 0 {
+				if err := tx.Model(&tasks[i]).Omit("Labels.*").Association("Labels").Append(add); err != nil {
+					return err
+				}
+			}
+			if len(remove) > 0 {
+				if err := tx.Model(&tasks[i]).Association("Labels").Delete(remove); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Model(&models.Task{}).Where("id IN ?", taskIDs).Update("version", nextVersion).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to update labels", err)
+		return
+	}
+
+	var updated []models.Task
+	config.DB.Preload("Labels").Where("id IN ?", input.TaskIDs).Order("id").Find(&updated)
+	for i := range updated {
+		before, after := sortedLabelNames(tasks[i].Labels), sortedLabelNames(updated[i].Labels)
+		if !reflect.DeepEqual(before, after) {
+			recordTaskAudit(c, models.AuditTaskUpdated, updated[i].ID, models.FieldChanges{
+				{Field: "labels", Before: before, After: after},
+			}, "")
+		}
+	}
+	versions := map[uint]uint{}
+	for _, task := range updated {
+		versions[task.ID] = task.Version
+	}
+	websocket.GetManager().SendNotification("task_labels_updated", gin.H{"task_ids": input.TaskIDs, "added": add, "removed": remove, "versions": versions})
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Updated labels on %d tasks", len(updated)), "tasks": updated})
+}
+
+// sortedLabelNames returns the sorted names of labels.
+func sortedLabelNames(labels []models.Label) []string {
+	names := make([]string, 0, len(labels))
+	for _, label := range labels {
+		names = append(names, label.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// missingIDs returns the requested IDs that are not among found.
+func missingIDs(requested, found []uint) []uint {
+	present := map[uint]bool{}
+	for _, id := range found {
+		present[id] = true
+	}
+	var missing []uint
+	for _, want := range requested {
+		if !present[want] {
+			missing = append(missing, want)
+		}
+	}
+	return missing
+}
+
+type labelUsage struct {
+	models.Label
+	Tasks     int64 `json:"tasks"`
+	OpenTasks int64 `json:"open_tasks"`
+	DoneTasks int64 `json:"done_tasks"`
+}
+
+// GetLabelStats counts the tasks carrying each label, optionally within one
+// project, and the tasks without any label.
+func GetLabelStats(c *gin.Context) {
+	project := c.Query("project")
+
+	taskJoin := "LEFT JOIN tasks ON tasks.id = task_labels.task_id AND tasks.deleted_at IS NULL"
+	var joinArgs []interface{}
+	if project != "" {
+		taskJoin += " AND tasks.project = ?"
+		joinArgs = append(joinArgs, project)
+	}
+
+	var usage []labelUsage
+	err := config.DB.Model(&models.Label{}).
+		Select("labels.*, COUNT(tasks.id) AS tasks, "+
+			"COALESCE(SUM(CASE WHEN tasks.id IS NOT NULL AND tasks.status <> ? THEN 1 ELSE 0 END), 0) AS open_tasks, "+
+			"COALESCE(SUM(CASE WHEN tasks.status = ? THEN 1 ELSE 0 END), 0) AS done_tasks",
+			models.TaskStatusDone, models.TaskStatusDone).
+		Joins("LEFT JOIN task_labels ON task_labels.label_id = labels.id").
+		Joins(taskJoin, joinArgs...).
+		Group("labels.id").
+		Order("tasks DESC, labels.name").
+		Scan(&usage).Error
+	if err != nil {
+		problem.Internal(c, "Failed to fetch label statistics", err)
+		return
+	}
+
+	unlabeled := config.DB.Model(&models.Task{}).Where("id NOT IN (SELECT task_id FROM task_labels)")
+	if project != "" {
+		unlabeled = unlabeled.Where("project = ?", project)
+	}
+	var unlabeledCount int64
+	if err := unlabeled.Count(&unlabeledCount).Error; err != nil {
+		problem.Internal(c, "Failed to fetch label statistics", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"labels": usage, "unlabeled_tasks": unlabeledCount})
+}
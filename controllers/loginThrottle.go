@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// throttlePolicy describes how failures for one kind of key are punished.
+// After FreeAttempts failures each further attempt must wait an exponentially
+// growing delay, and after LockoutAfter failures the key is locked outright.
+// Failures older than Window are forgotten.
+type throttlePolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+var (
+	accountThrottle = throttlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        30 * time.Second,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          15 * time.Minute,
+	}
+	ipThrottle = throttlePolicy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        30 * time.Second,
+		LockoutAfter:    100,
+		LockoutDuration: 15 * time.Minute,
+		Window:          15 * time.Minute,
+	}
+)
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func twoFactorThrottleKey(userID uint) string {
+	return fmt.Sprintf("2fa:%d", userID)
+}
+
+// throttleWait returns how long the caller must wait before key may attempt
+// to log in again, or zero.
+func throttleWait(key string, now time.Time) time.Duration {
+	var throttle models.LoginThrottle
+	if err := config.DB.First(&throttle, "key = ?", key).Error; err != nil {
+		return 0
+	}
+
+	if throttle.LockedUntil != nil && now.Before(*throttle.LockedUntil) {
+		return throttle.LockedUntil.Sub(now)
+	}
+	if now.Before(throttle.NextAttemptAt) {
+		return throttle.NextAttemptAt.Sub(now)
+	}
+	return 0
+}
+
+// delay is how long a key must wait after its failures-th failure.
+func (policy throttlePolicy) delay(failures int) time.Duration {
+	if failures <= policy.FreeAttempts {
+		return 0
+	}
+	exponent := float64(failures - policy.FreeAttempts - 1)
+	delay := time.Duration(float64(policy.BaseDelay) * math.Pow(2, exponent))
+	if delay > policy.MaxDelay || delay <= 0 {
+		delay = policy.MaxDelay
+	}
+	return delay
+}
+
+// registerFailure counts a failed attempt for key and reports whether it
+// caused a new lockout.
+func registerFailure(key string, policy throttlePolicy, now time.Time) bool {
+	lockedOut := false
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var throttle models.LoginThrottle
+		if err := tx.First(&throttle, "key = ?", key).Error; err != nil {
+			throttle = models.LoginThrottle{Key: key}
+		}
+
+		if now.Sub(throttle.LastFailureAt) > policy.Window {
+			throttle.Failures = 0
+		}
+		if throttle.LockedUntil != nil && !now.Before(*throttle.LockedUntil) {
+			throttle.LockedUntil = nil
+			throttle.Failures = 0
+		}
+
+		throttle.Failures++
+		throttle.LastFailureAt = now
+
+		if delay := policy.delay(throttle.Failures); delay > 0 {
+			throttle.NextAttemptAt = now.Add(delay)
+		}
+
+		if throttle.Failures >= policy.LockoutAfter && throttle.LockedUntil == nil {
+			until := now.Add(policy.LockoutDuration)
+			throttle.LockedUntil = &until
+			throttle.LockoutsIssued++
+			lockedOut = true
+		}
+
+		return tx.Save(&throttle).Error
+	})
+	if err != nil {
+		log.Printf("Failed to record login failure for %s: %v", key, err)
+	}
+
+	return lockedOut
+}
+
+// throttledKey is a key together with the policy its failures are counted
+// under.
+type throttledKey struct {
+	key    string
+	policy throttlePolicy
+}
+
+// throttleMu makes checking and counting an attempt one step, so parallel
+// guesses cannot all pass the check before any of them is counted.
+var throttleMu sync.Mutex
+
+// reserveAttempt checks whether an attempt may be made for every key and, if
+// so, counts it as a failure before the credentials are verified. It returns
+// how long the caller must wait instead, or the keys the attempt locked out.
+// When the attempt succeeds the caller takes the failure back with
+// undoFailure, or clears keys that belong to the user who logged in.
+func reserveAttempt(now time.Time, keys ...throttledKey) (time.Duration, []throttledKey) {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	var wait time.Duration
+	for _, k := range keys {
+		wait = max(wait, throttleWait(k.key, now))
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	var lockedOut []throttledKey
+	for _, k := range keys {
+		if registerFailure(k.key, k.policy, now) {
+			lockedOut = append(lockedOut, k)
+		}
+	}
+	return 0, lockedOut
+}
+
+// recordLoginFailure audits a failed attempt and the lockouts it caused.
+func recordLoginFailure(c *gin.Context, subject, reason string, lockedOut []throttledKey) {
+	recordAuditEvent(c, models.AuditLoginFailed, subject, reason)
+	for _, k := range lockedOut {
+		recordAuditEvent(c, models.AuditLoginLockout, k.key, fmt.Sprintf("locked for %s", k.policy.LockoutDuration))
+	}
+}
+
+// undoFailure takes back the failure reserveAttempt counted for k, and the
+// lockout if that failure caused it, leaving earlier failures in place.
+func undoFailure(k throttledKey, lockedOut []throttledKey) {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var throttle models.LoginThrottle
+		if err := tx.Where("key = ?", k.key).Limit(1).Find(&throttle).Error; err != nil || throttle.Key == "" {
+			return err
+		}
+
+		if throttle.Failures > 0 {
+			throttle.Failures--
+		}
+		for _, locked := range lockedOut {
+			if locked.key == k.key && throttle.LockedUntil != nil {
+				throttle.LockedUntil = nil
+				throttle.LockoutsIssued--
+			}
+		}
+		throttle.NextAttemptAt = time.Time{}
+		if delay := k.policy.delay(throttle.Failures); delay > 0 {
+			throttle.NextAttemptAt = throttle.LastFailureAt.Add(delay)
+		}
+		return tx.Save(&throttle).Error
+	})
+	if err != nil {
+		log.Printf("Failed to take back login failure for %s: %v", k.key, err)
+	}
+}
+
+func clearThrottle(key string) {
+	config.DB.Delete(&models.LoginThrottle{}, "key = ?", key)
+}
+
+func respondThrottled(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	problem.Respond(c, http.StatusTooManyRequests, "login_throttled", "Too many login attempts, try again later")
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// compareDummyPassword spends the same bcrypt work as a real comparison so
+// unknown emails cannot be told apart by response time.
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dtms-dummy-password"), passwordHashCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// UnlockLogin lets an administrator lift a lockout on an email address or a
+// client IP before it expires.
+func UnlockLogin(c *gin.Context) {
+	var input struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || (input.Email == "" && input.IP == "") {
+		problem.Invalid(c, "Provide an email or an ip to unlock")
+		return
+	}
+
+	if input.Email != "" {
+		clearThrottle(accountThrottleKey(input.Email))
+
+		var user models.User
+		if err := config.DB.Where("email = ?", input.Email).First(&user).Error; err == nil {
+			clearThrottle(twoFactorThrottleKey(user.ID))
+		}
+		recordAuditEvent(c, models.AuditLoginUnlock, accountThrottleKey(input.Email), "")
+	}
+
+	if input.IP != "" {
+		clearThrottle(ipThrottleKey(input.IP))
+		recordAuditEvent(c, models.AuditLoginUnlock, ipThrottleKey(input.IP), "")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Login unlocked successfully"})
+}
+
+// GetLoginLockouts lists keys that are currently locked out.
+func GetLoginLockouts(c *gin.Context) {
+	var throttles []models.LoginThrottle
+	if err := config.DB.Where("locked_until > ?", time.Now()).Find(&throttles).Error; err != nil {
+		problem.Internal(c, "Failed to fetch lockouts", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"lockouts": throttles})
+}
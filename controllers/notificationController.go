@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/websocket"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notifyUsers stores a notification for each user and pushes it to their
+// open WebSocket connections. The acting user, if any, is skipped.
+func notifyUsers(c *gin.Context, userIDs []uint, event, message string, task *models.Task) {
+	var actorID uint
+	if c != nil {
+		if value, ok := c.Get("user"); ok {
+			actorID = value.(models.User).ID
+		}
+	}
+
+	seen := map[uint]bool{actorID: true, 0: true}
+	var recipients []uint
+	var notifications []models.Notification
+	for _, id := range userIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		recipients = append(recipients, id)
+
+		notification := models.Notification{UserID: id, Event: event, Message: message}
+		if task != nil {
+			notification.TaskID = &task.ID
+		}
+		notifications = append(notifications, notification)
+	}
+
+	if len(recipients) == 0 {
+		return
+	}
+
+	if err := config.DB.Create(&notifications).Error; err != nil {
+		log.Printf("Failed to store %s notifications: %v", event, err)
+	}
+
+	websocket.GetManager().SendUserNotification(recipients, event, gin.H{"message": message, "task": task})
+}
+
+// taskParticipantIDs returns everyone involved in task: the assignees,
+// reviewers and, for team tasks, the team members. Assignees, Reviewers and
+// Team.Members must be preloaded.
+func taskParticipantIDs(task models.Task) []uint {
+	var ids []uint
+	if task.AssignedTo != nil {
+		ids = append(ids, *task.AssignedTo)
+	}
+	for _, user := range task.Assignees {
+		ids = append(ids, user.ID)
+	}
+	for _, user := range task.Reviewers {
+		ids = append(ids, user.ID)
+	}
+	if task.Team != nil {
+		for _, user := range task.Team.Members {
+			ids = append(ids, user.ID)
+		}
+	}
+	return ids
+}
+
+func GetNotifications(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	query := config.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Limit(100)
+	if c.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+
+	var notifications []models.Notification
+	if err := query.Find(&notifications).Error; err != nil {
+		problem.Internal(c, "Failed to fetch notifications", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications})
+}
+
+// MarkNotificationsRead marks the given notifications, or all of them when
+// no IDs are sent, as read.
+func MarkNotificationsRead(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		IDs []uint `json:"ids"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	query := config.DB.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", user.ID)
+	if len(input.IDs) > 0 {
+		query = query.Where("id IN ?", input.IDs)
+	}
+
+	if err := query.Update("read_at", time.Now()).Error; err != nil {
+		problem.Internal(c, "Failed to update notifications", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notifications marked as read"})
+}
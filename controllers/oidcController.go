@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"dtms/config"
+	"dtms/models"
+	"dtms/oidc"
+	"dtms/problem"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	oidcStatePurpose = "oidc_state"
+	oidcStateCookie  = "oidc_state"
+	oidcStateTTL     = 10 * time.Minute
+)
+
+var (
+	errOIDCNotConfigured = errors.New("single sign-on is not configured")
+	errOIDCNoEmail       = errors.New("identity provider did not supply an email address")
+	errOIDCUnverified    = errors.New("an account with this email already exists and the identity provider has not verified the email")
+	errOIDCLinked        = errors.New("an account with this email is linked to a different identity")
+)
+
+var (
+	oidcProvider *oidc.Provider
+	oidcMu       sync.Mutex
+)
+
+// getOIDCProvider runs discovery on first use and caches the result. Failed
+// discovery is retried on the next request.
+func getOIDCProvider(c *gin.Context) (*oidc.Provider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+
+	if oidcProvider != nil {
+		return oidcProvider, nil
+	}
+
+	cfg, ok := oidc.ConfigFromEnv()
+	if !ok {
+		return nil, errOIDCNotConfigured
+	}
+
+	provider, err := oidc.Discover(c.Request.Context(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	oidcProvider = provider
+	return provider, nil
+}
+
+func respondOIDCProviderError(c *gin.Context, err error) {
+	if errors.Is(err, errOIDCNotConfigured) {
+		problem.Respond(c, http.StatusNotFound, "sso_not_configured", "Single sign-on is not configured")
+		return
+	}
+	log.Printf("OIDC provider unavailable: %v", err)
+	problem.Respond(c, http.StatusBadGateway, "sso_provider_unavailable", "Identity provider unavailable")
+}
+
+// OIDCLogin redirects to the identity provider. State, nonce and the PKCE
+// verifier travel in a short-lived signed cookie scoped to /auth/oidc.
+func OIDCLogin(c *gin.Context) {
+	provider, err := getOIDCProvider(c)
+	if err != nil {
+		respondOIDCProviderError(c, err)
+		return
+	}
+
+	state, errState := oidc.RandomString()
+	nonce, errNonce := oidc.RandomString()
+	verifier, challenge, errPKCE := oidc.NewPKCE()
+	if errState != nil || errNonce != nil || errPKCE != nil {
+		problem.Internal(c, "Failed to start single sign-on", nil)
+		return
+	}
+
+	cookie, err := config.Keys.Sign(jwt.MapClaims{
+		"purpose":  oidcStatePurpose,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(oidcStateTTL).Unix(),
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to start single sign-on", err)
+		return
+	}
+
+	c.SetCookie(oidcStateCookie, cookie, int(oidcStateTTL.Seconds()), "/auth/oidc", "", false, true)
+	c.Redirect(http.StatusFound, provider.AuthCodeURL(state, nonce, challenge))
+}
+
+func OIDCCallback(c *gin.Context) {
+	provider, err := getOIDCProvider(c)
+	if err != nil {
+		respondOIDCProviderError(c, err)
+		return
+	}
+
+	if reason := c.Query("error"); reason != "" {
+		problem.Respond(c, http.StatusUnauthorized, "sso_failed", "Single sign-on failed: "+reason)
+		return
+	}
+
+	cookie, err := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, "/auth/oidc", "", false, true)
+	if err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_sso_state", "Missing single sign-on state")
+		return
+	}
+
+	token, err := jwt.Parse(cookie, config.Keys.Keyfunc)
+	if err != nil || !token.Valid {
+		problem.Respond(c, http.StatusBadRequest, "invalid_sso_state", "Invalid or expired single sign-on state")
+		return
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	state, _ := claims["state"].(string)
+	nonce, _ := claims["nonce"].(string)
+	verifier, _ := claims["verifier"].(string)
+	if claims["purpose"] != oidcStatePurpose || state == "" ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		problem.Respond(c, http.StatusBadRequest, "invalid_sso_state", "Invalid or expired single sign-on state")
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(c.Request.Context(), c.Query("code"), verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		problem.Respond(c, http.StatusUnauthorized, "sso_failed", "Single sign-on failed")
+		return
+	}
+
+	identity, err := provider.VerifyIDToken(c.Request.Context(), rawIDToken, nonce)
+	if err != nil {
+		log.Printf("OIDC ID token rejected: %v", err)
+		problem.Respond(c, http.StatusUnauthorized, "sso_failed", "Single sign-on failed")
+		return
+	}
+
+	user, err := provisionOIDCUser(provider.Config(), identity)
+	switch {
+	case errors.Is(err, errOIDCNoEmail):
+		problem.Validation(c, err)
+		return
+	case errors.Is(err, errOIDCUnverified), errors.Is(err, errOIDCLinked):
+		problem.Respond(c, http.StatusConflict, "sso_account_conflict", err.Error())
+		return
+	case err != nil:
+		problem.Internal(c, "Failed to provision user", err)
+		return
+	}
+
+	// The IdP only stands in for the password; accounts with 2FA still
+	// answer the same challenge as a password login.
+	completeLogin(c, user)
+}
+
+// provisionOIDCUser finds the user for an IdP identity, linking an existing
+// account by verified email or creating one on first login, and syncs the
+// role from the IdP groups when a role mapping is configured.
+func provisionOIDCUser(cfg oidc.Config, identity *oidc.Claims) (models.User, error) {
+	var user models.User
+	err := config.DB.Where("oidc_issuer = ? AND oidc_subject = ?", cfg.Issuer, identity.Subject).First(&user).Error
+	if err != nil {
+		if identity.Email == "" {
+			return user, errOIDCNoEmail
+		}
+
+		if err := config.DB.Where("email = ?", identity.Email).First(&user).Error; err == nil {
+			if !identity.EmailVerified {
+				return user, errOIDCUnverified
+			}
+			if user.OIDCSubject != "" {
+				return user, errOIDCLinked
+			}
+		} else {
+			user = models.User{
+				Email:    identity.Email,
+				Username: firstNonEmpty(identity.Username, identity.Name, identity.Email),
+				Role:     models.RoleMember,
+			}
+		}
+		user.OIDCIssuer = cfg.Issuer
+		user.OIDCSubject = identity.Subject
+	}
+
+	if identity.EmailVerified && user.EmailVerifiedAt == nil {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	if len(cfg.RoleMapping) > 0 {
+		user.Role = highestRole(cfg.Roles(identity.Groups))
+	}
+
+	if err := config.DB.Save(&user).Error; err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+// highestRole returns the most privileged known role in roles, defaulting to
+// member.
+func highestRole(roles []string) string {
+	for _, candidate := range models.Roles {
+		for _, role := range roles {
+			if role == candidate {
+				return candidate
+			}
+		}
+	}
+	return models.RoleMember
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
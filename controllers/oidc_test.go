@@ -0,0 +1,293 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"dtms/config"
+	"dtms/models"
+	"dtms/oidc"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
+
+type pendingCode struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+	identity    mockIdentity
+}
+
+// mockIdP is a local OpenID provider that issues RS256 ID tokens and
+// enforces PKCE at its token endpoint.
+type mockIdP struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	identity mockIdentity
+
+	mu    sync.Mutex
+	codes map[string]pendingCode
+}
+
+func newMockIdP(t *testing.T, clientID string) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	idp := &mockIdP{key: key, clientID: clientID, codes: map[string]pendingCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "idp-key",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != clientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+
+		code, _ := oidc.RandomString()
+		idp.mu.Lock()
+		idp.codes[code] = pendingCode{
+			challenge:   q.Get("code_challenge"),
+			nonce:       q.Get("nonce"),
+			redirectURI: q.Get("redirect_uri"),
+			identity:    idp.identity,
+		}
+		idp.mu.Unlock()
+
+		redirect, _ := url.Parse(q.Get("redirect_uri"))
+		params := redirect.Query()
+		params.Set("code", code)
+		params.Set("state", q.Get("state"))
+		redirect.RawQuery = params.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		pending, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok || r.PostForm.Get("client_id") != clientID || r.PostForm.Get("redirect_uri") != pending.redirectURI ||
+			oidc.S256Challenge(r.PostForm.Get("code_verifier")) != pending.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            idp.server.URL,
+			"aud":            clientID,
+			"sub":            pending.identity.Subject,
+			"email":          pending.identity.Email,
+			"email_verified": pending.identity.EmailVerified,
+			"name":           pending.identity.Name,
+			"groups":         pending.identity.Groups,
+			"nonce":          pending.nonce,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Minute).Unix(),
+		})
+		token.Header["kid"] = "idp-key"
+		idToken, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize plays the browser: it starts a login at DTMS, lets the IdP
+// authorize it and returns the callback URL and the state cookie.
+func (idp *mockIdP) authorize(t *testing.T, router *gin.Engine) (*url.URL, *http.Cookie) {
+	req, _ := http.NewRequest("GET", "/auth/oidc/login", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if !assert.Equal(t, http.StatusFound, w.Code) {
+		t.FailNow()
+	}
+	cookies := w.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		t.FailNow()
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusFound, resp.StatusCode) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	return callback, cookies[0]
+}
+
+func callbackRequest(router *gin.Engine, callback *url.URL, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", callback.RequestURI(), nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// login runs a complete single sign-on round trip.
+func (idp *mockIdP) login(t *testing.T, router *gin.Engine) *httptest.ResponseRecorder {
+	callback, cookie := idp.authorize(t, router)
+	return callbackRequest(router, callback, cookie)
+}
+
+func setupOIDC(t *testing.T) (*gin.Engine, *mockIdP) {
+	setup()
+	idp := newMockIdP(t, "dtms")
+
+	t.Setenv("OIDC_ISSUER", idp.server.URL)
+	t.Setenv("OIDC_CLIENT_ID", "dtms")
+	t.Setenv("OIDC_REDIRECT_URL", "http://dtms.test/auth/oidc/callback")
+	t.Setenv("OIDC_ROLE_MAPPING", "dtms-admins=admin,dtms-managers=manager")
+	oidcProvider = nil
+	t.Cleanup(func() { oidcProvider = nil })
+
+	router := setupRouter()
+	router.GET("/auth/oidc/login", OIDCLogin)
+	router.GET("/auth/oidc/callback", OIDCCallback)
+	return router, idp
+}
+
+func TestOIDCProvisionsUserAndMapsGroups(t *testing.T) {
+	router, idp := setupOIDC(t)
+	idp.identity = mockIdentity{Subject: "idp-123", Email: "sso@example.com", EmailVerified: true, Name: "SSO User", Groups: []string{"staff", "dtms-managers"}}
+
+	w := idp.login(t, router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Login successful!")
+
+	var user models.User
+	assert.NoError(t, config.DB.Where("email = ?", "sso@example.com").First(&user).Error)
+	assert.Equal(t, models.RoleManager, user.Role)
+	assert.Equal(t, "SSO User", user.Username)
+	assert.NotNil(t, user.EmailVerifiedAt)
+
+	idp.identity.Groups = []string{"dtms-managers", "dtms-admins"}
+	w = idp.login(t, router)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var users []models.User
+	config.DB.Where("email = ?", "sso@example.com").Find(&users)
+	assert.Len(t, users, 1, "Expected the returning user to be matched by subject")
+	assert.Equal(t, models.RoleAdmin, users[0].Role)
+}
+
+func TestOIDCRejectsForgedState(t *testing.T) {
+	router, idp := setupOIDC(t)
+	idp.identity = mockIdentity{Subject: "idp-123", Email: "sso@example.com", EmailVerified: true}
+
+	callback, cookie := idp.authorize(t, router)
+	q := callback.Query()
+	q.Set("state", "forged")
+	callback.RawQuery = q.Encode()
+
+	w := callbackRequest(router, callback, cookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOIDCEnforcesPKCE(t *testing.T) {
+	router, idp := setupOIDC(t)
+	idp.identity = mockIdentity{Subject: "idp-123", Email: "sso@example.com", EmailVerified: true}
+
+	// A code issued to another browser session cannot be redeemed with this
+	// session's verifier.
+	_, victimCookie := idp.authorize(t, router)
+	attackerCallback, _ := idp.authorize(t, router)
+
+	var victimClaims jwt.MapClaims
+	_, err := jwt.ParseWithClaims(victimCookie.Value, &victimClaims, config.Keys.Keyfunc)
+	assert.NoError(t, err)
+	q := attackerCallback.Query()
+	q.Set("state", victimClaims["state"].(string))
+	attackerCallback.RawQuery = q.Encode()
+
+	w := callbackRequest(router, attackerCallback, victimCookie)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestOIDCLinksExistingAccountOnlyWithVerifiedEmail(t *testing.T) {
+	router, idp := setupOIDC(t)
+	local := RegisterUserForTest()
+
+	idp.identity = mockIdentity{Subject: "idp-456", Email: local.Email, EmailVerified: false}
+	w := idp.login(t, router)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	idp.identity.EmailVerified = true
+	w = idp.login(t, router)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var user models.User
+	config.DB.First(&user, local.ID)
+	assert.Equal(t, "idp-456", user.OIDCSubject)
+	assert.Equal(t, models.RoleMember, user.Role)
+}
+
+func TestOIDCRequiresSecondFactor(t *testing.T) {
+	router, idp := setupOIDC(t)
+	local := RegisterUserForTest()
+	config.DB.Model(&local).Update("two_factor_enabled", true)
+
+	idp.identity = mockIdentity{Subject: "idp-789", Email: local.Email, EmailVerified: true}
+	w := idp.login(t, router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"two_factor_required":true`)
+	assert.NotContains(t, w.Body.String(), "Login successful!")
+	for _, cookie := range w.Result().Cookies() {
+		assert.NotEqual(t, "jwt", cookie.Name, "Expected no session before the second factor")
+	}
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	setup()
+	t.Setenv("OIDC_ISSUER", "")
+	oidcProvider = nil
+
+	router := gin.New()
+	router.GET("/auth/oidc/login", OIDCLogin)
+	req, _ := http.NewRequest("GET", "/auth/oidc/login", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
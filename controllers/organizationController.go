@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func CreateOrganization(c *gin.Context) {
+	var input struct {
+		Name             string `json:"name" binding:"required"`
+		RequireTwoFactor bool   `json:"require_two_factor"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	org := models.Organization{Name: input.Name, RequireTwoFactor: input.RequireTwoFactor}
+	if err := config.DB.Create(&org).Error; err != nil {
+		problem.Internal(c, "Failed to create organization", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Organization created successfully", "organization": org})
+}
+
+func GetOrganizations(c *gin.Context) {
+	var orgs []models.Organization
+	if err := config.DB.Find(&orgs).Error; err != nil {
+		problem.Internal(c, "Failed to fetch organizations", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organizations": orgs})
+}
+
+// UpdateOrganization renames an organization or toggles whether its members
+// must use two-factor authentication.
+func UpdateOrganization(c *gin.Context) {
+	orgID := c.Query("organization_id")
+
+	var org models.Organization
+	if err := config.DB.First(&org, orgID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "organization_not_found", "Organization not found")
+		return
+	}
+
+	var input struct {
+		Name             *string `json:"name"`
+		RequireTwoFactor *bool   `json:"require_two_factor"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if input.Name != nil && *input.Name != "" {
+		org.Name = *input.Name
+	}
+	if input.RequireTwoFactor != nil {
+		org.RequireTwoFactor = *input.RequireTwoFactor
+	}
+
+	if err := config.DB.Save(&org).Error; err != nil {
+		problem.Internal(c, "Failed to update organization", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Organization updated successfully", "organization": org})
+}
+
+func AddOrganizationMember(c *gin.Context) {
+	var input struct {
+		OrganizationID uint `json:"organization_id" binding:"required"`
+		UserID         uint `json:"user_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	var org models.Organization
+	if err := config.DB.First(&org, input.OrganizationID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "organization_not_found", "Organization not found")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, input.UserID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+
+	if err := config.DB.Model(&user).Update("organization_id", org.ID).Error; err != nil {
+		problem.Internal(c, "Failed to add member", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member added successfully", "user": user})
+}
@@ -0,0 +1,410 @@
+package controllers
+
+import (
+	"context"
+	"dtms/config"
+	"dtms/mailer"
+	"dtms/models"
+	"dtms/problem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reminder is a due-date reminder for one task.
+type Reminder struct {
+	Task   models.Task
+	Kind   string
+	Offset time.Duration
+}
+
+// Event is the WebSocket and notification event name for the reminder.
+func (r Reminder) Event() string {
+	if r.Kind == models.ReminderOverdue {
+		return "task_overdue"
+	}
+	return "task_due_soon"
+}
+
+func (r Reminder) Message() string {
+	due := r.Task.PlannedEndTime.UTC().Format(time.RFC1123)
+	if r.Kind == models.ReminderOverdue {
+		return fmt.Sprintf("Task %q is overdue: it was due %s", r.Task.Title, due)
+	}
+	return fmt.Sprintf("Task %q is due %s", r.Task.Title, due)
+}
+
+// ReminderNotifier delivers reminders over one channel. Channel names it in
+// the record of sent reminders.
+type ReminderNotifier interface {
+	Channel() string
+	NotifyReminder(reminder Reminder, recipients []models.User) error
+}
+
+// WebSocketReminderNotifier stores a notification for each recipient and
+// pushes it to their open connections.
+type WebSocketReminderNotifier struct{}
+
+func (WebSocketReminderNotifier) Channel() string { return "websocket" }
+
+func (WebSocketReminderNotifier) NotifyReminder(reminder Reminder, recipients []models.User) error {
+	ids := make([]uint, len(recipients))
+	for i, user := range recipients {
+		ids[i] = user.ID
+	}
+	notifyUsers(nil, ids, reminder.Event(), reminder.Message(), &reminder.Task)
+	return nil
+}
+
+// EmailReminderNotifier sends reminders through the configured mailer.
+type EmailReminderNotifier struct{}
+
+func (EmailReminderNotifier) Channel() string { return "email" }
+
+func (EmailReminderNotifier) NotifyReminder(reminder Reminder, recipients []models.User) error {
+	subject := "Reminder: " + reminder.Task.Title
+	if reminder.Kind == models.ReminderOverdue {
+		subject = "Overdue: " + reminder.Task.Title
+	}
+
+	for _, user := range recipients {
+		err := mailer.GetMailer().Send(mailer.Message{
+			To:      user.Email,
+			Subject: subject,
+			Body:    fmt.Sprintf("Hello %s,\n\n%s.\n", user.Username, reminder.Message()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReminderScheduler periodically looks for open tasks whose planned end is
+// near or past and reminds the people working on them. Before holds the
+// offsets ahead of the planned end at which "due soon" reminders go out,
+// After the offsets past it for overdue reminders.
+type ReminderScheduler struct {
+	Interval  time.Duration
+	Before    []time.Duration
+	After     []time.Duration
+	Notifiers []ReminderNotifier
+}
+
+// ReminderSchedulerFromEnv reads REMINDER_INTERVAL, REMINDER_BEFORE,
+// REMINDER_AFTER (comma separated Go durations) and REMINDER_CHANNELS
+// ("websocket", "email").
+func ReminderSchedulerFromEnv() (*ReminderScheduler, error) {
+	s := &ReminderScheduler{Interval: time.Minute}
+
+	if value := os.Getenv("REMINDER_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid REMINDER_INTERVAL %q", value)
+		}
+		s.Interval = interval
+	}
+
+	var err error
+	if s.Before, err = parseOffsets("REMINDER_BEFORE", "24h,1h"); err != nil {
+		return nil, err
+	}
+	if s.After, err = parseOffsets("REMINDER_AFTER", "0s,24h"); err != nil {
+		return nil, err
+	}
+
+	channels := os.Getenv("REMINDER_CHANNELS")
+	if channels == "" {
+		channels = "websocket,email"
+	}
+	for _, channel := range strings.Split(channels, ",") {
+		switch strings.TrimSpace(channel) {
+		case "websocket":
+			s.Notifiers = append(s.Notifiers, WebSocketReminderNotifier{})
+		case "email":
+			s.Notifiers = append(s.Notifiers, EmailReminderNotifier{})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown reminder channel %q", channel)
+		}
+	}
+	return s, nil
+}
+
+func parseOffsets(name, fallback string) ([]time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		value = fallback
+	}
+
+	var offsets []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		offset, err := time.ParseDuration(part)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid %s offset %q", name, part)
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets, nil
+}
+
+// Run checks for reminders every Interval until ctx is cancelled.
+func (s *ReminderScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.RunOnce(time.Now()); err != nil {
+			log.Printf("Reminder run failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reminderSlack widens the SQL bounds on planned_end_time. sqlite compares
+// times as text, which is off by up to the largest time zone offset, so the
+// bounds only narrow the candidates and the exact check happens in Go.
+const reminderSlack = 14 * time.Hour
+
+// reminderCatchUp is how long past its last overdue offset a task is still
+// looked at, so that a scheduler that was down sends the final reminder.
+const reminderCatchUp = 7 * 24 * time.Hour
+
+// unfinishedTasks limits db to tasks that are not done and have no actual
+// end. A zero time is stored as the zero value, not NULL.
+func unfinishedTasks(db *gorm.DB) *gorm.DB {
+	return db.
+		Where("status <> ?", models.TaskStatusDone).
+		Where("actual_end_time IS NULL OR actual_end_time = ?", time.Time{})
+}
+
+// openTasks returns the unfinished tasks whose planned end is close enough
+// to now for a reminder.
+func (s *ReminderScheduler) openTasks(now time.Time) ([]models.Task, error) {
+	var before, after time.Duration
+	for _, offset := range s.Before {
+		before = max(before, offset)
+	}
+	for _, offset := range s.After {
+		after = max(after, offset)
+	}
+
+	var tasks []models.Task
+	err := unfinishedTasks(config.DB).
+		Where("planned_end_time BETWEEN ? AND ?", now.Add(-after-reminderCatchUp-reminderSlack).UTC(), now.Add(before+reminderSlack).UTC()).
+		Find(&tasks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	open := tasks[:0]
+	for _, task := range tasks {
+		if !task.PlannedEndTime.IsZero() && task.ActualEndTime.IsZero() {
+			open = append(open, task)
+		}
+	}
+	return open, nil
+}
+
+// RunOnce sends the reminders due at now and returns how many were sent.
+// Each task gets at most one reminder per run: the latest stage it has
+// reached, so that a scheduler that was down does not send a burst of
+// stale ones. A reminder that fails on one channel is tried again on that
+// channel in the next run.
+func (s *ReminderScheduler) RunOnce(now time.Time) (int, error) {
+	tasks, err := s.openTasks(now)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, task := range tasks {
+		reminder, ok := s.stage(task, now)
+		if !ok {
+			continue
+		}
+
+		var recipients []models.User
+		loaded := false
+		delivered := false
+		for _, notifier := range s.Notifiers {
+			record, claimed, err := claimReminder(reminder, notifier.Channel())
+			if err != nil {
+				return sent, err
+			}
+			if !claimed {
+				continue
+			}
+
+			if !loaded {
+				full, err := loadTaskWithParticipants(task.ID)
+				if err == nil {
+					reminder.Task = *full
+					recipients, err = reminderRecipients(*full)
+				}
+				if err != nil {
+					config.DB.Delete(&record)
+					return sent, err
+				}
+				loaded = true
+			}
+
+			if err := notifier.NotifyReminder(reminder, recipients); err != nil {
+				log.Printf("Failed to send %s reminder for task %d by %s: %v", reminder.Kind, task.ID, notifier.Channel(), err)
+				config.DB.Delete(&record)
+				continue
+			}
+			if err := config.DB.Model(&record).Update("sent_at", now).Error; err != nil {
+				return sent, err
+			}
+			delivered = true
+		}
+		if delivered {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// stage returns the most advanced reminder task has reached at now: the
+// largest passed overdue offset, else the smallest upcoming offset whose
+// time has come.
+func (s *ReminderScheduler) stage(task models.Task, now time.Time) (Reminder, bool) {
+	due := task.PlannedEndTime
+	reminder := Reminder{Task: task, Offset: -1}
+
+	if !now.Before(due) {
+		for _, offset := range s.After {
+			if !now.Before(due.Add(offset)) && offset > reminder.Offset {
+				reminder.Kind, reminder.Offset = models.ReminderOverdue, offset
+			}
+		}
+		return reminder, reminder.Offset >= 0
+	}
+
+	for _, offset := range s.Before {
+		if !now.Before(due.Add(-offset)) && (reminder.Offset < 0 || offset < reminder.Offset) {
+			reminder.Kind, reminder.Offset = models.ReminderUpcoming, offset
+		}
+	}
+	return reminder, reminder.Offset >= 0
+}
+
+// claimReminder records that the reminder is being sent over channel and
+// reports whether this call was the first to do so. The caller marks the
+// record sent once delivery succeeds, or deletes it so a later run retries.
+func claimReminder(reminder Reminder, channel string) (models.TaskReminder, bool, error) {
+	record := models.TaskReminder{
+		TaskID:        reminder.Task.ID,
+		Kind:          reminder.Kind,
+		OffsetSeconds: int64(reminder.Offset / time.Second),
+		DueAt:         reminder.Task.PlannedEndTime.UTC(),
+		Channel:       channel,
+	}
+	result := config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	return record, result.RowsAffected == 1, result.Error
+}
+
+// reminderRecipients are the task's active participants. Reviewers are
+// included: they are waiting on the task too.
+func reminderRecipients(task models.Task) ([]models.User, error) {
+	var users []models.User
+	ids := taskParticipantIDs(task)
+	if len(ids) == 0 {
+		return users, nil
+	}
+	err := config.DB.Where("id IN ? AND deactivated_at IS NULL", ids).Find(&users).Error
+	return users, err
+}
+
+// GetOverdueReport lists open tasks past their planned end, most overdue
+// first, with totals per assignee. Filter with ?user_id= or ?team_id=.
+func GetOverdueReport(c *gin.Context) {
+	now := time.Now()
+
+	// The bound is widened by reminderSlack since sqlite compares times as
+	// text; the exact check is below.
+	query := unfinishedTasks(config.DB.Preload("User")).
+		Where("planned_end_time > ? AND planned_end_time < ?", time.Time{}, now.Add(reminderSlack).UTC())
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("assigned_to = ? OR id IN (SELECT task_id FROM task_assignees WHERE user_id = ?)", userID, userID)
+	}
+	if teamID := c.Query("team_id"); teamID != "" {
+		query = query.Where("team_id = ?", teamID)
+	}
+
+	var tasks []models.Task
+	if err := query.Find(&tasks).Error; err != nil {
+		problem.Internal(c, "Failed to fetch overdue tasks", err)
+		return
+	}
+
+	type overdueTask struct {
+		models.Task
+		OverdueSeconds int64 `json:"overdue_seconds"`
+	}
+	type assigneeTotal struct {
+		UserID *uint  `json:"user_id"`
+		Name   string `json:"name"`
+		Count  int    `json:"count"`
+	}
+
+	report := make([]overdueTask, 0, len(tasks))
+	totals := map[uint]*assigneeTotal{}
+	for _, task := range tasks {
+		if task.PlannedEndTime.IsZero() || !task.PlannedEndTime.Before(now) || !task.ActualEndTime.IsZero() {
+			continue
+		}
+		report = append(report, overdueTask{Task: task, OverdueSeconds: int64(now.Sub(task.PlannedEndTime) / time.Second)})
+
+		var key uint
+		total := &assigneeTotal{Name: "unassigned"}
+		if task.User != nil {
+			key = task.User.ID
+			total = &assigneeTotal{UserID: &task.User.ID, Name: task.User.Username}
+		}
+		if existing, ok := totals[key]; ok {
+			total = existing
+		} else {
+			totals[key] = total
+		}
+		total.Count++
+	}
+
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].PlannedEndTime.Before(report[j].PlannedEndTime)
+	})
+
+	byAssignee := make([]assigneeTotal, 0, len(totals))
+	for _, total := range totals {
+		byAssignee = append(byAssignee, *total)
+	}
+	sort.Slice(byAssignee, func(i, j int) bool {
+		if byAssignee[i].Count != byAssignee[j].Count {
+			return byAssignee[i].Count > byAssignee[j].Count
+		}
+		return byAssignee[i].Name < byAssignee[j].Name
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"generated_at": now,
+		"count":        len(report),
+		"by_assignee":  byAssignee,
+		"tasks":        report,
+	})
+}
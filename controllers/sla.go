@@ -0,0 +1,641 @@
+package controllers
+
+import (
+	"context"
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// matchSLAPolicy returns the most specific policy for task.
+func matchSLAPolicy(task models.Task) (*models.SLAPolicy, error) {
+	var policies []models.SLAPolicy
+	err := config.DB.
+		Where("priority = '' OR priority = ?", task.Priority).
+		Where("project = '' OR project = ?", task.Project).
+		Order("id").Find(&policies).Error
+	if err != nil {
+		return nil, err
+	}
+	return pickSLAPolicy(policies, task), nil
+}
+
+// pickSLAPolicy returns the most specific of policies that applies to task:
+// a project match outweighs a priority match, and ties go to the oldest
+// policy. policies must be ordered by ID.
+func pickSLAPolicy(policies []models.SLAPolicy, task models.Task) *models.SLAPolicy {
+	var best *models.SLAPolicy
+	bestScore := -1
+	for i, policy := range policies {
+		if (policy.Priority != "" && policy.Priority != task.Priority) || (policy.Project != "" && policy.Project != task.Project) {
+			continue
+		}
+		score := 0
+		if policy.Project != "" {
+			score += 2
+		}
+		if policy.Priority != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = &policies[i], score
+		}
+	}
+	return best
+}
+
+// syncTaskSLA brings a task's SLA clock in line with the task at now.
+func syncTaskSLA(task models.Task, now time.Time) (*models.TaskSLA, error) {
+	policy, err := matchSLAPolicy(task)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing []models.TaskSLA
+	if err := config.DB.Where("task_id = ?", task.ID).Limit(1).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	var sla *models.TaskSLA
+	if len(existing) > 0 {
+		sla = &existing[0]
+	}
+	return applyTaskSLA(task, policy, sla, now)
+}
+
+// applyTaskSLA updates sla, the task's clock or nil if it has none, under
+// policy, the policy that applies to the task or nil: it starts the clock
+// when a policy applies, switches policy when priority or project changed,
+// pauses while blocked and stops the response and resolution timers when
+// the task is started or finished.
+func applyTaskSLA(task models.Task, policy *models.SLAPolicy, existing *models.TaskSLA, now time.Time) (*models.TaskSLA, error) {
+	var sla models.TaskSLA
+	switch {
+	case existing == nil:
+		if policy == nil {
+			return nil, nil
+		}
+		sla = models.TaskSLA{TaskID: task.ID, PolicyID: policy.ID, StartedAt: task.CreatedAt}
+		if sla.StartedAt.IsZero() {
+			sla.StartedAt = now
+		}
+	case policy == nil:
+		return nil, config.DB.Delete(existing).Error
+	default:
+		sla = *existing
+		if policy.ID != sla.PolicyID {
+			sla.PolicyID = policy.ID
+			sla.ResponseBreachedAt, sla.ResolutionBreachedAt = nil, nil
+		}
+	}
+
+	blocked := task.Status == models.TaskStatusBlocked
+	if blocked && sla.PausedAt == nil {
+		sla.PausedAt = &now
+	} else if !blocked && sla.PausedAt != nil {
+		sla.PausedSeconds += int64(now.Sub(*sla.PausedAt) / time.Second)
+		sla.PausedAt = nil
+	}
+
+	resolved := task.Status == models.TaskStatusDone || !task.ActualEndTime.IsZero()
+	responded := resolved || (task.Status != "" && task.Status != models.TaskStatusOpen) || !task.ActualStartTime.IsZero()
+	if responded && sla.RespondedAt == nil {
+		sla.RespondedAt = &now
+		sla.ResponseSeconds = int64(slaElapsed(sla, now) / time.Second)
+	}
+	if resolved && sla.ResolvedAt == nil {
+		sla.ResolvedAt = &now
+		sla.ResolutionSeconds = int64(slaElapsed(sla, now) / time.Second)
+	} else if !resolved {
+		sla.ResolvedAt, sla.ResolutionSeconds = nil, 0
+	}
+
+	if err := config.DB.Save(&sla).Error; err != nil {
+		return nil, err
+	}
+	return &sla, nil
+}
+
+// trackTaskSLA updates the SLA clock after a task changed, so that pauses
+// and met targets are timed exactly and late targets are recorded as
+// breaches even if the monitor has not seen them yet.
+func trackTaskSLA(task models.Task) {
+	now := time.Now()
+	sla, err := syncTaskSLA(task, now)
+	if err == nil && sla != nil {
+		err = evaluateSLA(task, *sla, now)
+	}
+	if err != nil {
+		log.Printf("Failed to update SLA of task %d: %v", task.ID, err)
+	}
+}
+
+// slaElapsed is the working clock time of sla at moment at, excluding pauses.
+func slaElapsed(sla models.TaskSLA, at time.Time) time.Duration {
+	elapsed := at.Sub(sla.StartedAt) - time.Duration(sla.PausedSeconds)*time.Second
+	if sla.PausedAt != nil && sla.PausedAt.Before(at) {
+		elapsed -= at.Sub(*sla.PausedAt)
+	}
+	if elapsed < 0 {
+		return 0
+	}
+	return elapsed
+}
+
+type slaTimer struct {
+	Target           string     `json:"target"`
+	TargetSeconds    int64      `json:"target_seconds"`
+	ElapsedSeconds   int64      `json:"elapsed_seconds"`
+	RemainingSeconds int64      `json:"remaining_seconds"`
+	Paused           bool       `json:"paused"`
+	Met              bool       `json:"met"`
+	BreachedAt       *time.Time `json:"breached_at"`
+}
+
+// slaTimers reports the response and resolution timers of sla at now. A
+// timer stops at the moment its target was met.
+func slaTimers(sla models.TaskSLA, policy models.SLAPolicy, now time.Time) []slaTimer {
+	var timers []slaTimer
+	add := func(target string, minutes int64, doneAt *time.Time, doneSeconds int64, breachedAt *time.Time) {
+		if minutes <= 0 {
+			return
+		}
+		elapsed := slaElapsed(sla, now)
+		if doneAt != nil {
+			elapsed = time.Duration(doneSeconds) * time.Second
+		}
+		limit := time.Duration(minutes) * time.Minute
+		timers = append(timers, slaTimer{
+			Target:           target,
+			TargetSeconds:    int64(limit / time.Second),
+			ElapsedSeconds:   int64(elapsed / time.Second),
+			RemainingSeconds: int64((limit - elapsed) / time.Second),
+			Paused:           sla.PausedAt != nil && doneAt == nil,
+			Met:              doneAt != nil && elapsed <= limit,
+			BreachedAt:       breachedAt,
+		})
+	}
+	add(models.SLATargetResponse, policy.ResponseMinutes, sla.RespondedAt, sla.ResponseSeconds, sla.ResponseBreachedAt)
+	add(models.SLATargetResolution, policy.ResolutionMinutes, sla.ResolvedAt, sla.ResolutionSeconds, sla.ResolutionBreachedAt)
+	return timers
+}
+
+// SLAMonitor periodically checks SLA clocks, fires escalation steps and
+// records breaches.
+type SLAMonitor struct {
+	Interval time.Duration
+}
+
+// SLAMonitorFromEnv reads SLA_INTERVAL (default one minute).
+func SLAMonitorFromEnv() (*SLAMonitor, error) {
+	m := &SLAMonitor{Interval: time.Minute}
+	if value := os.Getenv("SLA_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid SLA_INTERVAL %q", value)
+		}
+		m.Interval = interval
+	}
+	return m, nil
+}
+
+// Run checks SLAs every Interval until ctx is cancelled.
+func (m *SLAMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.RunOnce(time.Now()); err != nil {
+			log.Printf("SLA check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// slaBatchSize is how many tasks RunOnce loads at a time.
+const slaBatchSize = 500
+
+// RunOnce attaches policies to tasks that lack a clock and evaluates every
+// clock whose task is not yet resolved. Policies are loaded once and clocks
+// once per batch of tasks. A task that fails is logged and skipped, so that
+// it cannot hold up the others.
+func (m *SLAMonitor) RunOnce(now time.Time) error {
+	var policies []models.SLAPolicy
+	if err := config.DB.Preload("Escalations").Order("id").Find(&policies).Error; err != nil {
+		return err
+	}
+
+	var tasks []models.Task
+	return config.DB.
+		Where("id NOT IN (SELECT task_id FROM task_slas WHERE resolved_at IS NOT NULL)").
+		FindInBatches(&tasks, slaBatchSize, func(tx *gorm.DB, batch int) error {
+			ids := make([]uint, len(tasks))
+			for i, task := range tasks {
+				ids[i] = task.ID
+			}
+			var clocks []models.TaskSLA
+			if err := config.DB.Where("task_id IN ?", ids).Find(&clocks).Error; err != nil {
+				return err
+			}
+			byTask := make(map[uint]*models.TaskSLA, len(clocks))
+			for i := range clocks {
+				byTask[clocks[i].TaskID] = &clocks[i]
+			}
+
+			for _, task := range tasks {
+				policy := pickSLAPolicy(policies, task)
+				sla, err := applyTaskSLA(task, policy, byTask[task.ID], now)
+				if err == nil && sla != nil {
+					err = evaluateSLAPolicy(task, *sla, *policy, now)
+				}
+				if err != nil {
+					log.Printf("Failed to check SLA of task %d: %v", task.ID, err)
+				}
+			}
+			return nil
+		}).Error
+}
+
+// evaluateSLA fires the escalation steps whose threshold has passed and
+// records breaches of missed targets.
+func evaluateSLA(task models.Task, sla models.TaskSLA, now time.Time) error {
+	var policy models.SLAPolicy
+	if err := config.DB.Preload("Escalations").First(&policy, sla.PolicyID).Error; err != nil {
+		return err
+	}
+	return evaluateSLAPolicy(task, sla, policy, now)
+}
+
+// evaluateSLAPolicy is evaluateSLA with the clock's policy, including its
+// escalation steps, already loaded.
+func evaluateSLAPolicy(task models.Task, sla models.TaskSLA, policy models.SLAPolicy, now time.Time) error {
+	for _, timer := range slaTimers(sla, policy, now) {
+		if timer.BreachedAt == nil && timer.ElapsedSeconds > timer.TargetSeconds {
+			if err := recordSLABreach(task, &sla, policy, timer, now); err != nil {
+				return err
+			}
+		}
+
+		// Escalations only matter while the target is still open.
+		if (timer.Target == models.SLATargetResponse && sla.RespondedAt != nil) ||
+			(timer.Target == models.SLATargetResolution && sla.ResolvedAt != nil) {
+			continue
+		}
+		for _, step := range policy.Escalations {
+			if step.Target != timer.Target || timer.ElapsedSeconds*100 < timer.TargetSeconds*int64(step.ThresholdPercent) {
+				continue
+			}
+			if err := fireSLAEscalation(task, step, timer, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func recordSLABreach(task models.Task, sla *models.TaskSLA, policy models.SLAPolicy, timer slaTimer, now time.Time) error {
+	breachedAt := sla.StartedAt.Add(time.Duration(sla.PausedSeconds+timer.TargetSeconds) * time.Second)
+	if breachedAt.After(now) {
+		breachedAt = now
+	}
+	breachedAt = breachedAt.UTC()
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		column := "response_breached_at"
+		if timer.Target == models.SLATargetResolution {
+			column = "resolution_breached_at"
+		}
+		if err := tx.Model(sla).Update(column, breachedAt).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.SLABreach{
+			TaskID:         task.ID,
+			PolicyID:       policy.ID,
+			Target:         timer.Target,
+			Priority:       task.Priority,
+			Project:        task.Project,
+			AssignedTo:     task.AssignedTo,
+			TargetSeconds:  timer.TargetSeconds,
+			ElapsedSeconds: timer.ElapsedSeconds,
+			BreachedAt:     breachedAt,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if loaded, err := loadTaskWithParticipants(task.ID); err == nil {
+		notifyUsers(nil, taskParticipantIDs(*loaded), "sla_breached",
+			fmt.Sprintf("Task %q missed its %s target under SLA policy %q", task.Title, timer.Target, policy.Name), loaded)
+	}
+	return nil
+}
+
+func fireSLAEscalation(task models.Task, step models.SLAEscalationStep, timer slaTimer, now time.Time) error {
+	result := config.DB.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.SLAEscalation{TaskID: task.ID, StepID: step.ID, FiredAt: now})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	recipients, err := escalationRecipients(step)
+	if err != nil {
+		return err
+	}
+	notifyUsers(nil, recipients, "sla_escalation",
+		fmt.Sprintf("Task %q has used %d%% of its %s target", task.Title, timer.ElapsedSeconds*100/timer.TargetSeconds, timer.Target), &task)
+	return nil
+}
+
+func escalationRecipients(step models.SLAEscalationStep) ([]uint, error) {
+	var ids []uint
+	if step.UserID != nil {
+		ids = append(ids, *step.UserID)
+	}
+
+	query := config.DB.Model(&models.User{}).Where("deactivated_at IS NULL")
+	switch {
+	case step.TeamID != nil:
+		query = query.Where("id IN (SELECT user_id FROM team_members WHERE team_id = ?)", *step.TeamID)
+	case step.Role != "":
+		query = query.Where("role = ?", step.Role)
+	default:
+		return ids, nil
+	}
+
+	var members []uint
+	if err := query.Pluck("id", &members).Error; err != nil {
+		return nil, err
+	}
+	return append(ids, members...), nil
+}
+
+type slaPolicyInput struct {
+	Name              string                     `json:"name" binding:"required"`
+	Priority          string                     `json:"priority"`
+	Project           string                     `json:"project"`
+	ResponseMinutes   int64                      `json:"response_minutes"`
+	ResolutionMinutes int64                      `json:"resolution_minutes"`
+	Escalations       []models.SLAEscalationStep `json:"escalations"`
+}
+
+func (input slaPolicyInput) policy() (models.SLAPolicy, error) {
+	policy := models.SLAPolicy{
+		Name:              input.Name,
+		Priority:          input.Priority,
+		Project:           input.Project,
+		ResponseMinutes:   input.ResponseMinutes,
+		ResolutionMinutes: input.ResolutionMinutes,
+	}
+	if err := validateTaskFields(models.Task{Priority: policy.Priority}); err != nil {
+		return policy, err
+	}
+	if policy.ResponseMinutes < 0 || policy.ResolutionMinutes < 0 || policy.ResponseMinutes+policy.ResolutionMinutes == 0 {
+		return policy, errors.New("set a positive response_minutes or resolution_minutes")
+	}
+
+	for _, step := range input.Escalations {
+		if step.Target != models.SLATargetResponse && step.Target != models.SLATargetResolution {
+			return policy, fmt.Errorf("invalid escalation target %q", step.Target)
+		}
+		if step.ThresholdPercent <= 0 {
+			return policy, errors.New("escalation threshold_percent must be positive")
+		}
+		if step.UserID == nil && step.TeamID == nil && step.Role == "" {
+			return policy, errors.New("escalation needs a user_id, team_id or role")
+		}
+		if step.Role != "" && !models.StringList(models.Roles).Contains(step.Role) {
+			return policy, fmt.Errorf("invalid escalation role %q", step.Role)
+		}
+		policy.Escalations = append(policy.Escalations, models.SLAEscalationStep{
+			Target:           step.Target,
+			ThresholdPercent: step.ThresholdPercent,
+			UserID:           step.UserID,
+			TeamID:           step.TeamID,
+			Role:             step.Role,
+		})
+	}
+	return policy, nil
+}
+
+func GetSLAPolicies(c *gin.Context) {
+	var policies []models.SLAPolicy
+	if err := config.DB.Preload("Escalations").Order("id").Find(&policies).Error; err != nil {
+		problem.Internal(c, "Failed to fetch SLA policies", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policies": policies})
+}
+
+func CreateSLAPolicy(c *gin.Context) {
+	var input slaPolicyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	policy, err := input.policy()
+	if err != nil {
+		problem.Validation(c, err)
+		return
+	}
+
+	if err := config.DB.Create(&policy).Error; err != nil {
+		problem.Internal(c, "Failed to create SLA policy", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "SLA policy created successfully", "policy": policy})
+}
+
+// UpdateSLAPolicy replaces a policy and its escalation steps. Running clocks
+// keep their start time and are measured against the new targets. Steps are
+// updated in place, so escalations that already fired do not fire again.
+func UpdateSLAPolicy(c *gin.Context) {
+	var existing models.SLAPolicy
+	if err := config.DB.First(&existing, c.Query("policy_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "sla_policy_not_found", "SLA policy not found")
+		return
+	}
+
+	var input slaPolicyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	policy, err := input.policy()
+	if err != nil {
+		problem.Validation(c, err)
+		return
+	}
+	policy.ID, policy.CreatedAt = existing.ID, existing.CreatedAt
+
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var current []models.SLAEscalationStep
+		if err := tx.Where("policy_id = ?", policy.ID).Order("id").Find(&current).Error; err != nil {
+			return err
+		}
+		removed := reuseEscalationSteps(policy.Escalations, input.Escalations, current)
+		if len(removed) > 0 {
+			if err := tx.Where("step_id IN ?", removed).Delete(&models.SLAEscalation{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&models.SLAEscalationStep{}, removed).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Session(&gorm.Session{FullSaveAssociations: true}).Save(&policy).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to update SLA policy", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "SLA policy updated successfully", "policy": policy})
+}
+
+// reuseEscalationSteps gives each new step the ID of the current step it
+// replaces: the one named by the requested ID, or else one with the same
+// target and threshold. It returns the IDs of current steps left unused.
+func reuseEscalationSteps(steps, requested, current []models.SLAEscalationStep) []uint {
+	unused := make(map[uint]models.SLAEscalationStep, len(current))
+	for _, step := range current {
+		unused[step.ID] = step
+	}
+	for i := range steps {
+		if _, ok := unused[requested[i].ID]; ok {
+			steps[i].ID = requested[i].ID
+			delete(unused, steps[i].ID)
+		}
+	}
+	for i := range steps {
+		if steps[i].ID != 0 {
+			continue
+		}
+		for _, step := range current {
+			if _, ok := unused[step.ID]; ok && step.Target == steps[i].Target && step.ThresholdPercent == steps[i].ThresholdPercent {
+				steps[i].ID = step.ID
+				delete(unused, step.ID)
+				break
+			}
+		}
+	}
+
+	var removed []uint
+	for _, step := range current {
+		if _, ok := unused[step.ID]; ok {
+			removed = append(removed, step.ID)
+		}
+	}
+	return removed
+}
+
+// DeleteSLAPolicy removes a policy. Recorded breaches are kept; clocks move
+// to the next matching policy on the monitor's next run.
+func DeleteSLAPolicy(c *gin.Context) {
+	var policy models.SLAPolicy
+	if err := config.DB.First(&policy, c.Query("policy_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "sla_policy_not_found", "SLA policy not found")
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("policy_id = ?", policy.ID).Delete(&models.SLAEscalationStep{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&policy).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to delete SLA policy", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "SLA policy deleted successfully"})
+}
+
+// GetTaskSLA shows the policy and timers that apply to a task.
+func GetTaskSLA(c *gin.Context) {
+	var task models.Task
+	if err := config.DB.First(&task, idParam(c, "task_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	var sla models.TaskSLA
+	if err := config.DB.First(&sla, "task_id = ?", task.ID).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"task_id": task.ID, "policy": nil, "timers": []slaTimer{}})
+		return
+	}
+
+	var policy models.SLAPolicy
+	if err := config.DB.Preload("Escalations").First(&policy, sla.PolicyID).Error; err != nil {
+		problem.Internal(c, "Failed to load SLA policy", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"task_id":    task.ID,
+		"policy":     policy,
+		"started_at": sla.StartedAt,
+		"timers":     slaTimers(sla, policy, time.Now()),
+	})
+}
+
+// GetSLABreaches lists recorded breaches with totals by target, priority
+// and project. Filter with ?target=, ?priority=, ?project=, ?policy_id= and
+// ?from=/?to= (RFC 3339).
+func GetSLABreaches(c *gin.Context) {
+	query := config.DB.Order("breached_at DESC")
+	for _, field := range []string{"target", "priority", "project", "policy_id"} {
+		if value := c.Query(field); value != "" {
+			query = query.Where(field+" = ?", value)
+		}
+	}
+
+	for _, bound := range []struct{ name, op string }{{"from", ">="}, {"to", "<"}} {
+		if value := c.Query(bound.name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				problem.Respond(c, http.StatusBadRequest, "invalid_time", fmt.Sprintf("Invalid %s: use RFC 3339", bound.name))
+				return
+			}
+			query = query.Where("breached_at "+bound.op+" ?", parsed.UTC())
+		}
+	}
+
+	var breaches []models.SLABreach
+	if err := query.Find(&breaches).Error; err != nil {
+		problem.Internal(c, "Failed to fetch SLA breaches", err)
+		return
+	}
+
+	byTarget, byPriority, byProject := map[string]int{}, map[string]int{}, map[string]int{}
+	for _, breach := range breaches {
+		byTarget[breach.Target]++
+		byPriority[breach.Priority]++
+		byProject[breach.Project]++
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":       len(breaches),
+		"by_target":   byTarget,
+		"by_priority": byPriority,
+		"by_project":  byProject,
+		"breaches":    breaches,
+	})
+}
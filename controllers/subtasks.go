@@ -0,0 +1,273 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/websocket"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errParentNotFound = errors.New("parent task not found")
+	errParentCycle    = errors.New("a task cannot be moved below itself or one of its subtasks")
+)
+
+func taskDone(task models.Task) bool {
+	return task.Status == models.TaskStatusDone || !task.ActualEndTime.IsZero()
+}
+
+// checkParent verifies that parentID can become the parent of taskID: it
+// must exist and must not be taskID or one of its descendants. taskID is 0
+// for new tasks.
+func checkParent(taskID uint, parentID *uint) error {
+	for id := parentID; id != nil; {
+		if *id == taskID {
+			return errParentCycle
+		}
+		var parent models.Task
+		if err := config.DB.Select("id", "parent_id").First(&parent, *id).Error; err != nil {
+			return errParentNotFound
+		}
+		id = parent.ParentID
+	}
+	return nil
+}
+
+// refreshRollup recomputes the rollup of taskID and every ancestor above it.
+// A task's rollup_seconds is its own estimate plus its children's rollups;
+// its progress is 1 when done, else the children's progress weighted by
+// their rollup_seconds (equally when none have estimates). A checklist
+// counts as the task's own work, weighted by its own seconds, with the share
+// of items done as its progress. Other leaves are 0 or 1.
+func refreshRollup(tx *gorm.DB, taskID *uint) error {
+	for id := taskID; id != nil; {
+		var task models.Task
+		if err := tx.First(&task, *id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		var children []models.Task
+		if err := tx.Where("parent_id = ?", task.ID).Find(&children).Error; err != nil {
+			return err
+		}
+
+		rollup := task.Seconds
+		var weighted, weights, plain float64
+		parts := len(children)
+		for _, child := range children {
+			rollup += child.RollupSeconds
+			weighted += child.Progress * float64(child.RollupSeconds)
+			weights += float64(child.RollupSeconds)
+			plain += child.Progress
+		}
+
+		var items, done int64
+		if err := tx.Model(&models.ChecklistItem{}).Where("task_id = ?", task.ID).Count(&items).Error; err != nil {
+			return err
+		}
+		if items > 0 {
+			if err := tx.Model(&models.ChecklistItem{}).Where("task_id = ? AND done = ?", task.ID, true).Count(&done).Error; err != nil {
+				return err
+			}
+			own := float64(done) / float64(items)
+			weighted += own * float64(task.Seconds)
+			weights += float64(task.Seconds)
+			plain += own
+			parts++
+		}
+
+		progress := 0.0
+		switch {
+		case taskDone(task):
+			progress = 1
+		case weights > 0:
+			progress = weighted / weights
+		case parts > 0:
+			progress = plain / float64(parts)
+		}
+		progress = math.Round(progress*1000) / 1000
+
+		if err := tx.Model(&task).UpdateColumns(map[string]interface{}{
+			"rollup_seconds": rollup,
+			"progress":       progress,
+		}).Error; err != nil {
+			return err
+		}
+		id = task.ParentID
+	}
+	return nil
+}
+
+// openDescendants returns the IDs of unfinished tasks below taskID.
+func openDescendants(tx *gorm.DB, taskID uint) ([]uint, error) {
+	var open []uint
+	queue := []uint{taskID}
+	for len(queue) > 0 {
+		var children []models.Task
+		if err := tx.Where("parent_id IN ?", queue).Find(&children).Error; err != nil {
+			return nil, err
+		}
+		queue = queue[:0]
+		for _, child := range children {
+			if !taskDone(child) {
+				open = append(open, child.ID)
+			}
+			queue = append(queue, child.ID)
+		}
+	}
+	return open, nil
+}
+
+// descendantIDs returns every task below taskID.
+func descendantIDs(tx *gorm.DB, taskID uint) ([]uint, error) {
+	var ids []uint
+	queue := []uint{taskID}
+	for len(queue) > 0 {
+		var children []uint
+		if err := tx.Model(&models.Task{}).Where("parent_id IN ?", queue).Pluck("id", &children).Error; err != nil {
+			return nil, err
+		}
+		ids = append(ids, children...)
+		queue = children
+	}
+	return ids, nil
+}
+
+// SetTaskParent moves a task below another one, or makes it a top-level
+// task when parent_id is null.
+func SetTaskParent(c *gin.Context) {
+	var input struct {
+		TaskID   uint  `json:"task_id"`
+		ParentID *uint `json:"parent_id"`
+	}
+	if err := bindTaskInput(c, &input, &input.TaskID); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	var task models.Task
+	if err := config.DB.First(&task, input.TaskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	switch err := checkParent(task.ID, input.ParentID); {
+	case errors.Is(err, errParentNotFound):
+		problem.Respond(c, http.StatusNotFound, "parent_task_not_found", err.Error())
+		return
+	case err != nil:
+		problem.Validation(c, err)
+		return
+	}
+
+	oldParent := task.ParentID
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Task{}).Where("id = ?", task.ID).Updates(map[string]interface{}{"parent_id": input.ParentID, "version": nextVersion}).Error; err != nil {
+			return err
+		}
+		if err := refreshRollup(tx, oldParent); err != nil {
+			return err
+		}
+		if err := refreshRollup(tx, input.ParentID); err != nil {
+			return err
+		}
+		return tx.First(&task, task.ID).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to move task", err)
+		return
+	}
+
+	recordTaskAudit(c, models.AuditTaskUpdated, task.ID, models.FieldChanges{
+		{Field: "parent_id", Before: oldParent, After: input.ParentID},
+	}, "")
+	websocket.GetManager().SendNotification("task_updated", task)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Task moved successfully", "task": task})
+}
+
+// GetTaskTree returns the subtree below task_id, or every top-level task
+// with its subtasks when task_id is omitted. A subtree is loaded one level
+// at a time, so only its own tasks are read.
+func GetTaskTree(c *gin.Context) {
+	if id := idParam(c, "task_id"); id != "" {
+		var root models.Task
+		if err := config.DB.Preload("User").First(&root, id).Error; err != nil {
+			problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+			return
+		}
+
+		tasks := []models.Task{root}
+		for level := []uint{root.ID}; len(level) > 0; {
+			var children []models.Task
+			if err := config.DB.Preload("User").Where("parent_id IN ?", level).Order("id").Find(&children).Error; err != nil {
+				problem.Internal(c, "Failed to fetch tasks", err)
+				return
+			}
+			level = level[:0]
+			for _, child := range children {
+				level = append(level, child.ID)
+			}
+			tasks = append(tasks, children...)
+		}
+		c.JSON(http.StatusOK, gin.H{"task": taskForest(tasks)[0]})
+		return
+	}
+
+	var tasks []models.Task
+	if err := config.DB.Preload("User").Order("id").Find(&tasks).Error; err != nil {
+		problem.Internal(c, "Failed to fetch tasks", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tasks": taskForest(tasks)})
+}
+
+// taskForest nests tasks below their parents and returns those whose parent
+// is not among them, in the order given.
+func taskForest(tasks []models.Task) []models.Task {
+	children := map[uint][]int{}
+	index := map[uint]int{}
+	var roots []int
+	for i, task := range tasks {
+		index[task.ID] = i
+	}
+	for i, task := range tasks {
+		if _, ok := index[derefUint(task.ParentID)]; ok && task.ParentID != nil {
+			children[*task.ParentID] = append(children[*task.ParentID], i)
+		} else {
+			roots = append(roots, i)
+		}
+	}
+
+	var build func(i int) models.Task
+	build = func(i int) models.Task {
+		task := tasks[i]
+		task.Children = []models.Task{}
+		for _, child := range children[task.ID] {
+			task.Children = append(task.Children, build(child))
+		}
+		return task
+	}
+
+	tree := make([]models.Task, 0, len(roots))
+	for _, i := range roots {
+		tree = append(tree, build(i))
+	}
+	return tree
+}
+
+func derefUint(value *uint) uint {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
@@ -0,0 +1,514 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/websocket"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxBatchTasks is the most tasks one batch request may change.
+const maxBatchTasks = 1000
+
+const (
+	batchUpdated   = "updated"
+	batchUnchanged = "unchanged"
+	batchDeleted   = "deleted"
+	batchFailed    = "failed"
+)
+
+// batchInput is the body of POST /api/v1/tasks/batch. The tasks are given by
+// task_ids or by filter, a query string in the syntax of GET /api/v1/tasks
+// such as "project=apollo&labels.any=bug".
+type batchInput struct {
+	TaskIDs      []uint `json:"task_ids"`
+	Filter       string `json:"filter"`
+	Action       string `json:"action" binding:"required,oneof=update delete"`
+	Status       string `json:"status"`
+	Priority     string `json:"priority"`
+	AssignedTo   *uint  `json:"assigned_to"`
+	AddLabels    []uint `json:"add_labels"`
+	RemoveLabels []uint `json:"remove_labels"`
+	DryRun       bool   `json:"dry_run"`
+}
+
+func (in batchInput) hasChanges() bool {
+	return in.Status != "" || in.Priority != "" || in.AssignedTo != nil || len(in.AddLabels)+len(in.RemoveLabels) > 0
+}
+
+// validate checks the request itself and returns the parsed filter, if any.
+func (in batchInput) validate() (*taskQuery, error) {
+	var fields problem.Errors
+	add := func(field, code, message string) {
+		fields = append(fields, problem.FieldError{Field: field, Code: code, Message: message})
+	}
+
+	var query *taskQuery
+	switch {
+	case len(in.TaskIDs) == 0 && in.Filter == "":
+		add("task_ids", "required", "give task_ids or filter")
+	case len(in.TaskIDs) > 0 && in.Filter != "":
+		add("filter", "conflict", "give either task_ids or filter, not both")
+	case len(in.TaskIDs) > maxBatchTasks:
+		add("task_ids", "length", fmt.Sprintf("a batch takes at most %d tasks", maxBatchTasks))
+	case in.Filter != "":
+		values, err := url.ParseQuery(in.Filter)
+		if err == nil {
+			var q taskQuery
+			if q, err = parseTaskQuery(values); err == nil {
+				query = &q
+			}
+		}
+		if err != nil {
+			add("filter", "invalid", err.Error())
+		}
+	}
+
+	switch {
+	case in.Action == "update" && !in.hasChanges():
+		add("action", "required", "an update needs status, priority, assigned_to, add_labels or remove_labels")
+	case in.Action == "delete" && in.hasChanges():
+		add("action", "invalid", "a delete takes no changes")
+	}
+
+	var invalid problem.Errors
+	if err := validateTaskFields(models.Task{Status: in.Status, Priority: in.Priority}); errors.As(err, &invalid) {
+		fields = append(fields, invalid...)
+	}
+
+	if len(fields) > 0 {
+		return nil, fields
+	}
+	return query, nil
+}
+
+// batchResult is the outcome of a batch for one task.
+type batchResult struct {
+	TaskID  uint                `json:"task_id"`
+	Result  string              `json:"result"`
+	Changes models.FieldChanges `json:"changes,omitempty"`
+	Code    string              `json:"code,omitempty"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// batchSummary counts the results of a batch.
+type batchSummary struct {
+	Matched   int `json:"matched"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deleted   int `json:"deleted"`
+	Failed    int `json:"failed"`
+}
+
+func summarizeBatch(results []batchResult) batchSummary {
+	summary := batchSummary{Matched: len(results)}
+	for _, result := range results {
+		switch result.Result {
+		case batchUpdated:
+			summary.Updated++
+		case batchUnchanged:
+			summary.Unchanged++
+		case batchDeleted:
+			summary.Deleted++
+		case batchFailed:
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+// BatchTasks changes the status, priority, assignee or labels of many tasks,
+// or deletes them, in one transaction. Every task is checked first and
+// nothing is changed unless all of them pass; the response lists the result
+// for each task. With dry_run the results are reported without saving
+// anything. Clients are sent a single tasks_batch_updated event instead of
+// one event per task.
+func BatchTasks(c *gin.Context) {
+	var input batchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+	query, err := input.validate()
+	if err != nil {
+		problem.Validation(c, err)
+		return
+	}
+
+	var assignee *models.User
+	if input.AssignedTo != nil {
+		var user models.User
+		if err := config.DB.First(&user, *input.AssignedTo).Error; err != nil {
+			problem.Respond(c, http.StatusNotFound, "user_not_found", "User not found")
+			return
+		}
+		if !user.Active() {
+			problem.Respond(c, http.StatusBadRequest, "user_deactivated", "Cannot assign tasks to a deactivated user")
+			return
+		}
+		assignee = &user
+	}
+
+	var add, remove []models.Label
+	if err := config.DB.Where("id IN ?", input.AddLabels).Find(&add).Error; err != nil {
+		problem.Internal(c, "Failed to fetch labels", err)
+		return
+	}
+	if err := config.DB.Where("id IN ?", input.RemoveLabels).Find(&remove).Error; err != nil {
+		problem.Internal(c, "Failed to fetch labels", err)
+		return
+	}
+	var labelIDs []uint
+	for _, label := range append(append([]models.Label{}, add...), remove...) {
+		labelIDs = append(labelIDs, label.ID)
+	}
+	if missing := missingIDs(append(append([]uint{}, input.AddLabels...), input.RemoveLabels...), labelIDs); len(missing) > 0 {
+		problem.Respond(c, http.StatusNotFound, "label_not_found", "Labels not found", gin.H{"label_ids": missing})
+		return
+	}
+
+	// Tasks named by ID are reported in the order given, and missing ones
+	// fail; tasks found by the filter are reported by ID.
+	var tasks []models.Task
+	var requested []uint
+	if query != nil {
+		if tasks, err = query.find(); err != nil {
+			problem.Internal(c, "Failed to fetch tasks", err)
+			return
+		}
+		if len(tasks) > maxBatchTasks {
+			problem.Respond(c, http.StatusBadRequest, "batch_too_large",
+				fmt.Sprintf("The filter matches %d tasks; a batch takes at most %d", len(tasks), maxBatchTasks),
+				gin.H{"matched": len(tasks)})
+			return
+		}
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+		for _, task := range tasks {
+			requested = append(requested, task.ID)
+		}
+	} else {
+		seen := map[uint]bool{}
+		for _, id := range input.TaskIDs {
+			if !seen[id] {
+				seen[id] = true
+				requested = append(requested, id)
+			}
+		}
+		if err := config.DB.Preload("Labels").Where("id IN ?", requested).Find(&tasks).Error; err != nil {
+			problem.Internal(c, "Failed to fetch tasks", err)
+			return
+		}
+	}
+
+	byID := map[uint]models.Task{}
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+
+	results := make([]batchResult, 0, len(requested))
+	var changed []uint
+	for _, id := range requested {
+		before, found := byID[id]
+		if !found {
+			results = append(results, batchResult{TaskID: id, Result: batchFailed, Code: "task_not_found", Error: "Task not found"})
+			continue
+		}
+		if input.Action == "delete" {
+			results = append(results, batchResult{TaskID: id, Result: batchDeleted})
+			changed = append(changed, id)
+			continue
+		}
+
+		result, err := planBatchUpdate(input, before, assignee, add, remove, byID)
+		if err != nil {
+			problem.Internal(c, "Failed to check subtasks", err)
+			return
+		}
+		if result.Result == batchUpdated {
+			changed = append(changed, id)
+		}
+		results = append(results, result)
+	}
+
+	summary := summarizeBatch(results)
+	if input.DryRun {
+		c.JSON(http.StatusOK, gin.H{
+			"message": fmt.Sprintf("Dry run: %d of %d tasks would change", len(changed), summary.Matched),
+			"dry_run": true,
+			"summary": summary,
+			"results": results,
+		})
+		return
+	}
+	if summary.Failed > 0 {
+		problem.Respond(c, http.StatusUnprocessableEntity, "batch_failed",
+			fmt.Sprintf("%d of %d tasks cannot be changed; nothing was saved", summary.Failed, summary.Matched),
+			gin.H{"summary": summary, "results": results})
+		return
+	}
+
+	if input.Action == "delete" {
+		deleteBatch(c, changed, results, summary)
+		return
+	}
+	updateBatch(c, input, byID, assignee, add, remove, changed, results, summary)
+}
+
+// planBatchUpdate works out what an update would change on one task. A task
+// can only be completed along with its open subtasks, so those must be in
+// the batch too.
+func planBatchUpdate(input batchInput, before models.Task, assignee *models.User, add, remove []models.Label, batch map[uint]models.Task) (batchResult, error) {
+	result := batchResult{TaskID: before.ID}
+
+	after := before
+	if input.Status != "" {
+		after.Status = input.Status
+	}
+	if input.Priority != "" {
+		after.Priority = input.Priority
+	}
+	if assignee != nil {
+		after.AssignedTo = &assignee.ID
+	}
+
+	if taskDone(after) && !taskDone(before) {
+		open, err := openDescendants(config.DB, before.ID)
+		if err != nil {
+			return result, err
+		}
+		var outside []uint
+		for _, id := range open {
+			if _, ok := batch[id]; !ok {
+				outside = append(outside, id)
+			}
+		}
+		if len(outside) > 0 {
+			result.Result = batchFailed
+			result.Code = "open_subtasks"
+			result.Error = fmt.Sprintf("Task has open subtasks outside the batch: %v", outside)
+			return result, nil
+		}
+	}
+
+	result.Changes = taskChanges(before, after)
+	if len(add)+len(remove) > 0 {
+		removed := map[uint]bool{}
+		for _, label := range remove {
+			removed[label.ID] = true
+		}
+		var labels []models.Label
+		present := map[uint]bool{}
+		for _, label := range append(append([]models.Label{}, before.Labels...), add...) {
+			if !removed[label.ID] && !present[label.ID] {
+				present[label.ID] = true
+				labels = append(labels, label)
+			}
+		}
+		old, current := sortedLabelNames(before.Labels), sortedLabelNames(labels)
+		if !reflect.DeepEqual(old, current) {
+			result.Changes = append(result.Changes, models.FieldChange{Field: "labels", Before: old, After: current})
+		}
+	}
+
+	result.Result = batchUpdated
+	if len(result.Changes) == 0 {
+		result.Result = batchUnchanged
+	}
+	return result, nil
+}
+
+// updateBatch saves a checked update of the changed tasks, which are found
+// with their state before the update in tasks.
+func updateBatch(c *gin.Context, input batchInput, tasks map[uint]models.Task, assignee *models.User, add, remove []models.Label, changed []uint, results []batchResult, summary batchSummary) {
+	values := map[string]interface{}{"version": nextVersion}
+	if input.Status != "" {
+		values["status"] = input.Status
+	}
+	if input.Priority != "" {
+		values["priority"] = input.Priority
+	}
+	if assignee != nil {
+		values["assigned_to"] = assignee.ID
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if len(changed) == 0 {
+			return nil
+		}
+		if err := tx.Model(&models.Task{}).Where("id IN ?", changed).Updates(values).Error; err != nil {
+			return err
+		}
+		for _, id := range changed {
+			task := models.Task{}
+			task.ID = id
+			if assignee != nil {
+				if err := replaceAssignee(tx, id, derefUint(tasks[id].AssignedTo), assignee); err != nil {
+					return err
+				}
+			}
+			if len(add) > 0 {
+				if err := tx.Model(&task).Omit("Labels.*").Association("Labels").Append(add); err != nil {
+					return err
+				}
+			}
+			if len(remove) > 0 {
+				if err := tx.Model(&task).Association("Labels").Delete(remove); err != nil {
+					return err
+				}
+			}
+			if err := refreshRollup(tx, &id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to update tasks", err)
+		return
+	}
+
+	var updated []models.Task
+	if len(changed) > 0 {
+		if err := config.DB.Where("id IN ?", changed).Find(&updated).Error; err != nil {
+			problem.Internal(c, "Failed to load tasks", err)
+			return
+		}
+	}
+	versions := map[uint]uint{}
+	for _, task := range updated {
+		versions[task.ID] = task.Version
+		trackTaskSLA(task)
+	}
+	// As with AssignTask, a new assignee is audited as an assignment and
+	// the other changes as an update.
+	details := fmt.Sprintf("Batch update of %d tasks", len(changed))
+	var reassigned []uint
+	for _, result := range results {
+		if result.Result != batchUpdated {
+			continue
+		}
+		var assignment, other models.FieldChanges
+		for _, change := range result.Changes {
+			if change.Field == "assigned_to" {
+				assignment = append(assignment, change)
+			} else {
+				other = append(other, change)
+			}
+		}
+		if len(assignment) > 0 {
+			recordTaskAudit(c, models.AuditTaskAssigned, result.TaskID, assignment, details)
+			reassigned = append(reassigned, result.TaskID)
+		}
+		if len(other) > 0 {
+			recordTaskAudit(c, models.AuditTaskUpdated, result.TaskID, other, details)
+		}
+	}
+	if assignee != nil && len(reassigned) > 0 {
+		notifyBatchAssignment(c, reassigned, *assignee)
+	}
+	if len(changed) > 0 {
+		websocket.GetManager().SendNotification("tasks_batch_updated", gin.H{
+			"action":   input.Action,
+			"task_ids": changed,
+			"versions": versions,
+			"summary":  summary,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Updated %d of %d tasks", len(changed), summary.Matched),
+		"summary": summary,
+		"results": results,
+	})
+}
+
+// deleteBatch deletes the checked tasks. As with DeleteTask, subtasks that
+// are not deleted move up to the deleted task's parent.
+func deleteBatch(c *gin.Context, ids []uint, results []batchResult, summary batchSummary) {
+	var deletion taskDeletion
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		deletion, err = deleteTasks(tx, ids, false)
+		return err
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to delete tasks", err)
+		return
+	}
+	recordTaskDeletion(c, deletion, fmt.Sprintf("Batch delete of %d tasks", len(ids)))
+
+	websocket.GetManager().SendNotification("tasks_batch_updated", gin.H{
+		"action":   "delete",
+		"task_ids": deletion.deleted,
+		"summary":  summary,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Deleted %d tasks", len(deletion.deleted)),
+		"summary": summary,
+		"results": results,
+	})
+}
+
+// notifyBatchAssignment tells everyone involved in the reassigned tasks, as
+// AssignTask does. Each user gets a task_assigned notification per task but
+// a single tasks_assigned WebSocket event for the whole batch.
+func notifyBatchAssignment(c *gin.Context, taskIDs []uint, assignee models.User) {
+	var actorID uint
+	if value, ok := c.Get("user"); ok {
+		actorID = value.(models.User).ID
+	}
+
+	var tasks []models.Task
+	if err := config.DB.Preload("Team.Members").Preload("Assignees").Preload("Reviewers").
+		Where("id IN ?", taskIDs).Order("id").Find(&tasks).Error; err != nil {
+		log.Printf("Failed to load reassigned tasks: %v", err)
+		return
+	}
+
+	var notifications []models.Notification
+	byUser := map[uint][]uint{}
+	var recipients []uint
+	for i := range tasks {
+		seen := map[uint]bool{actorID: true, 0: true}
+		for _, id := range taskParticipantIDs(tasks[i]) {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if byUser[id] == nil {
+				recipients = append(recipients, id)
+			}
+			byUser[id] = append(byUser[id], tasks[i].ID)
+			notifications = append(notifications, models.Notification{
+				UserID:  id,
+				Event:   "task_assigned",
+				Message: fmt.Sprintf("Task %q was assigned to %s", tasks[i].Title, assignee.Username),
+				TaskID:  &tasks[i].ID,
+			})
+		}
+	}
+	if len(notifications) == 0 {
+		return
+	}
+	if err := config.DB.Create(&notifications).Error; err != nil {
+		log.Printf("Failed to store task_assigned notifications: %v", err)
+	}
+
+	for _, id := range recipients {
+		websocket.GetManager().SendUserNotification([]uint{id}, "tasks_assigned", gin.H{
+			"message":  fmt.Sprintf("%d tasks were assigned to %s", len(byUser[id]), assignee.Username),
+			"task_ids": byUser[id],
+		})
+	}
+}
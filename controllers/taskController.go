@@ -3,34 +3,118 @@ package controllers
 import (
 	"dtms/config"
 	"dtms/models"
+	"dtms/problem"
+	"dtms/schedule"
 	"dtms/websocket"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func CreateTask(c *gin.Context) {
-	var task models.Task
+	var input taskInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	task := input.task()
+	if err := validateTask(task, nil); err != nil {
+		problem.Validation(c, err)
+		return
+	}
+
+	switch err := checkParent(0, task.ParentID); {
+	case errors.Is(err, errParentNotFound):
+		problem.Respond(c, http.StatusNotFound, "parent_task_not_found", err.Error())
+		return
+	case err != nil:
+		problem.Validation(c, err)
+		return
+	}
 
-	if err := c.ShouldBindJSON(&task); err != nil {
+	fields, err := projectFields(task.Project)
+	if err != nil {
+		problem.Internal(c, "Failed to load custom fields", err)
+		return
+	}
+	if err := setCustomFields(&task, fields, input.CustomFields); err != nil {
+		problem.Validation(c, err)
+		return
+	}
 
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input", "details": err.Error()})
+	if err := fillPlannedEnd(&task); err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_schedule", "Failed to compute planned end time: "+err.Error())
 		return
 	}
 
-	if err := config.DB.Create(&task).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
+	// The assignee was checked by validateTask and joins the assignee list,
+	// as with AssignTask.
+	var assignee *models.User
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Team", "Assignees", "Reviewers", "Children", "Labels", "Checklist").Create(&task).Error; err != nil {
+			return err
+		}
+		if task.AssignedTo != nil {
+			assignee = &models.User{}
+			if err := tx.First(assignee, *task.AssignedTo).Error; err != nil {
+				return err
+			}
+			if err := replaceAssignee(tx, task.ID, 0, assignee); err != nil {
+				return err
+			}
+		}
+		if err := refreshRollup(tx, &task.ID); err != nil {
+			return err
+		}
+		return tx.First(&task, task.ID).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to create task", err)
 		return
 	}
+	trackTaskSLA(task)
+	recordTaskAudit(c, models.AuditTaskCreated, task.ID, nil, task.Title)
+	if assignee != nil {
+		recordTaskAudit(c, models.AuditTaskAssigned, task.ID, models.FieldChanges{
+			{Field: "assigned_to", After: assignee.ID},
+		}, "")
+		if loaded, err := loadTaskWithParticipants(task.ID); err == nil {
+			notifyUsers(c, taskParticipantIDs(*loaded), "task_assigned", fmt.Sprintf("Task %q was assigned to %s", task.Title, assignee.Username), loaded)
+		}
+	}
 
 	websocket.GetManager().SendNotification("task_created", task)
 
-	c.JSON(http.StatusOK, gin.H{"message": "Task created successfully", "task": task})
+	c.Header("ETag", taskETag(task))
+	respondCreated(c, fmt.Sprintf("/api/v1/tasks/%d", task.ID), gin.H{"message": "Task created successfully", "task": task})
+}
+
+// minBulkColumns is the number of columns every row of a bulk upload needs:
+// title, description, planned start date and time, planned end date and
+// time, and seconds.
+const minBulkColumns = 7
+
+// csvProblem rejects a bulk upload because of the given row of the file,
+// listing the invalid columns when they are known.
+func csvProblem(c *gin.Context, line int, message string, fields ...problem.FieldError) {
+	p := problem.New(c, http.StatusBadRequest, "invalid_csv", fmt.Sprintf("Row %d: %s", line, message))
+	p.Errors = fields
+	problem.Write(c, p, gin.H{"row": line})
+}
+
+// csvColumnProblem rejects a bulk upload because of one cell.
+func csvColumnProblem(c *gin.Context, line int, column, message string) {
+	csvProblem(c, line, message, problem.FieldError{Field: column, Code: "invalid", Message: message})
 }
 
 func CreateTaskBulk(c *gin.Context) {
@@ -40,195 +124,423 @@ func CreateTaskBulk(c *gin.Context) {
 	file_ptr, getErr := c.FormFile("taskBulkUpload")
 
 	if getErr != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Failed to get file",
+		problem.Invalid(c, "Failed to get file", problem.FieldError{
+			Field: "taskBulkUpload", Code: "required", Message: "upload a CSV file",
 		})
 		return
 	}
 
 	file, openErr := file_ptr.Open()
 	if openErr != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Failed to open file",
-		})
+		problem.Internal(c, "Failed to open file", openErr)
 		return
 	}
 
 	defer file.Close()
 
+	// Times in the file are wall-clock times in the declared zone.
+	location, err := schedule.LoadLocation(c.PostForm("time_zone"))
+	if err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_time_zone", "Invalid time zone: "+err.Error())
+		return
+	}
+
 	reader := csv.NewReader(file)
 
 	var tasks []models.Task
 
-	// Skip the header row
-	reader.Read()
+	// Columns after the skills column hold custom fields of the project in
+	// the "project" form field, named by key in the header row.
+	header, err := reader.Read()
+	if err != nil && err != io.EOF {
+		csvProblem(c, 1, "Error reading CSV: "+err.Error())
+		return
+	}
+	project := c.PostForm("project")
+	fields, err := projectFields(project)
+	if err != nil {
+		problem.Internal(c, "Failed to load custom fields", err)
+		return
+	}
 
-	for {
+	for line := 2; ; line++ {
 		row, err := reader.Read()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Error reading CSV",
-			})
+			csvProblem(c, line, "Error reading CSV: "+err.Error())
+			return
+		}
+		if len(row) < minBulkColumns {
+			csvProblem(c, line, fmt.Sprintf("expected at least %d columns, got %d", minBulkColumns, len(row)))
 			return
 		}
 
 		// Parse the row data
 		layout := "2006-01-02 15:04:05"
-		plannedStartTime, err := time.Parse(layout, row[2]+" "+row[3])
+		plannedStartTime, err := time.ParseInLocation(layout, row[2]+" "+row[3], location)
 
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Error parsing planned start time",
-			})
+			csvColumnProblem(c, line, "planned_start_time", "Error parsing planned start time")
 			return
 		}
 
-		plannedEndTime, err := time.Parse(layout, row[4]+" "+row[5])
-
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Error parsing planned end time",
-			})
-			return
+		// An empty end is computed from the seconds estimate below.
+		var plannedEndTime time.Time
+		if strings.TrimSpace(row[4]+row[5]) != "" {
+			plannedEndTime, err = time.ParseInLocation(layout, row[4]+" "+row[5], location)
+			if err != nil {
+				csvColumnProblem(c, line, "planned_end_time", "Error parsing planned end time")
+				return
+			}
 		}
 
 		// String to int64
 		seconds, err := strconv.ParseInt(row[6], 10, 64)
 
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Error parsing seconds",
-			})
+			csvColumnProblem(c, line, "seconds", "Error parsing seconds")
 			return
 		}
 
-		task := models.Task{
+		input := taskInput{
 			Title:            row[0],
 			Description:      row[1],
 			PlannedStartTime: plannedStartTime,
 			PlannedEndTime:   plannedEndTime,
 			Seconds:          seconds,
+			Project:          project,
+		}
+
+		// Optional eighth column: required skills separated by semicolons
+		if len(row) > 7 {
+			for _, skill := range strings.Split(row[7], ";") {
+				if skill = strings.TrimSpace(skill); skill != "" {
+					input.RequiredSkills = append(input.RequiredSkills, skill)
+				}
+			}
+		}
+
+		task := input.task()
+		if err := validateTask(task, nil); err != nil {
+			csvProblem(c, line, err.Error(), problem.FieldErrors(err)...)
+			return
+		}
+
+		values := map[string]interface{}{}
+		for i := 8; i < len(row) && i < len(header); i++ {
+			if cell := strings.TrimSpace(row[i]); cell != "" {
+				values[strings.TrimSpace(header[i])] = cell
+			}
+		}
+		if err := setCustomFields(&task, fields, values); err != nil {
+			csvColumnProblem(c, line, "custom_fields", err.Error())
+			return
+		}
+
+		if err := fillPlannedEnd(&task); err != nil {
+			csvColumnProblem(c, line, "planned_end_time", "Error computing planned end time")
+			return
 		}
 
 		tasks = append(tasks, task)
 	}
 
+	if len(tasks) == 0 {
+		csvProblem(c, 2, "The file has no tasks")
+		return
+	}
+
 	// Bulk insert the tasks into the database
 	insertErr := config.DB.Create(&tasks).Error
 	if insertErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error inserting tasks into the database",
+		problem.Internal(c, "Error inserting tasks into the database", insertErr)
+		return
+	}
+	for _, task := range tasks {
+		trackTaskSLA(task)
+		recordTaskAudit(c, models.AuditTaskCreated, task.ID, nil, task.Title)
+	}
+
+	if c.PostForm("auto_assign") != "true" {
+		c.JSON(createdStatus(c), gin.H{
+			"message": fmt.Sprintf("Successfully uploaded %d tasks", len(tasks)),
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": fmt.Sprintf("Successfully uploaded %d tasks", len(tasks)),
+	// Assign one task at a time so each choice sees the load added by the
+	// previous ones.
+	assignments := make([]gin.H, 0, len(tasks))
+	assigned := 0
+	for i := range tasks {
+		task := &tasks[i]
+		result := gin.H{"task_id": task.ID, "title": task.Title}
+
+		user, explanation, err := pickAssignee(*task, autoAssignOptions{})
+		if err == nil {
+			err = applyAutoAssignment(task, user)
+		}
+		switch {
+		case errors.Is(err, errNoPlannedWindow), errors.Is(err, errNoEligibleAssignee):
+			result["error"] = err.Error()
+		case err != nil:
+			log.Printf("request %s: auto-assigning task %d: %v", c.GetString("request_id"), task.ID, err)
+			result["error"] = "failed to assign"
+		default:
+			assigned++
+			result["assigned_to"] = user.ID
+			recordTaskAudit(c, models.AuditTaskAssigned, task.ID, models.FieldChanges{
+				{Field: "assigned_to", Before: nil, After: user.ID},
+			}, explanation.Summary)
+			notifyUsers(c, []uint{user.ID}, "task_assigned", fmt.Sprintf("Task %q was assigned to %s", task.Title, user.Username), task)
+		}
+		result["explanation"] = explanation.Summary
+		assignments = append(assignments, result)
+	}
+
+	c.JSON(createdStatus(c), gin.H{
+		"message":     fmt.Sprintf("Successfully uploaded %d tasks, auto-assigned %d", len(tasks), assigned),
+		"assignments": assignments,
 	})
 }
 
 func GetTasks(c *gin.Context) {
-	var tasks []models.Task
+	query, err := parseTaskQuery(c.Request.URL.Query())
+	if err != nil {
+		problem.Validation(c, err)
+		return
+	}
 
-	if err := config.DB.Preload("User").Find(&tasks).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
+	tasks, err := query.find()
+	if err != nil {
+		problem.Internal(c, "Failed to fetch tasks", err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"tasks": tasks})
 }
 
-func UpdateTask(c *gin.Context) {
-	task_id := c.Query("task_id")
-
-	var task models.Task
-	err := config.DB.First(&task, task_id).Error
-
-	websocket.GetManager().SendNotification("task_updated", task)
+// ExportTasks writes the tasks matching GetTasks' filters as CSV in the
+// bulk upload format, with times in the "time_zone" query parameter and one
+// column per custom field.
+func ExportTasks(c *gin.Context) {
+	query, err := parseTaskQuery(c.Request.URL.Query())
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Task not found",
-		})
+		problem.Validation(c, err)
 		return
 	}
-
-	var body struct {
-		Title            string `json:"title"`
-		Description      string `json:"description"`
-		PlannedStartTime int64  `json:"planned_start_time"`
-		PlannedEndTime   int64  `json:"planned_end_time"`
-		ActualStartTime  int64  `json:"actual_start_time"`
-		ActualEndTime    int64  `json:"actual_end_time"`
-		Seconds          int64  `json:"seconds"`
+	location, err := schedule.LoadLocation(c.Query("time_zone"))
+	if err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_time_zone", "Invalid time zone: "+err.Error())
+		return
 	}
 
-	if c.Bind(&body) != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Fields are empty",
-		})
+	tasks, err := query.find()
+	if err != nil {
+		problem.Internal(c, "Failed to fetch tasks", err)
 		return
 	}
 
-	if body.Title != "" {
-		task.Title = body.Title
+	var fields []models.CustomField
+	fieldQuery := config.DB.Order("id")
+	if query.project != "" {
+		fieldQuery = fieldQuery.Where("project = ?", query.project)
 	}
-
-	if body.Description != "" {
-		task.Description = body.Description
+	if err := fieldQuery.Find(&fields).Error; err != nil {
+		problem.Internal(c, "Failed to load custom fields", err)
+		return
 	}
 
-	if body.PlannedStartTime != 0 {
-		task.PlannedStartTime = time.Unix(body.PlannedStartTime, 0)
+	header := []string{"title", "description", "start_date", "start_time", "end_date", "end_time", "seconds", "skills"}
+	var keys []string
+	for _, field := range fields {
+		if !models.StringList(keys).Contains(field.Key) {
+			keys = append(keys, field.Key)
+		}
 	}
+	header = append(header, keys...)
 
-	if body.PlannedEndTime != 0 {
-		task.PlannedEndTime = time.Unix(body.PlannedEndTime, 0)
+	formatTime := func(t time.Time, layout string) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.In(location).Format(layout)
 	}
 
-	if body.ActualStartTime != 0 {
-		task.ActualStartTime = time.Unix(body.ActualStartTime, 0)
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="tasks.csv"`)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(header)
+	for _, task := range tasks {
+		row := []string{
+			task.Title,
+			task.Description,
+			formatTime(task.PlannedStartTime, "2006-01-02"),
+			formatTime(task.PlannedStartTime, "15:04:05"),
+			formatTime(task.PlannedEndTime, "2006-01-02"),
+			formatTime(task.PlannedEndTime, "15:04:05"),
+			strconv.FormatInt(task.Seconds, 10),
+			strings.Join(task.RequiredSkills, ";"),
+		}
+		for _, key := range keys {
+			row = append(row, formatFieldValue(task.CustomFields[key]))
+		}
+		writer.Write(row)
 	}
+	writer.Flush()
+}
+
+func UpdateTask(c *gin.Context) {
+	task_id := idParam(c, "task_id")
+
+	var task models.Task
+	err := config.DB.Preload("Checklist", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).First(&task, task_id).Error
 
-	if body.ActualEndTime != 0 {
-		task.ActualEndTime = time.Unix(body.ActualEndTime, 0)
+	if err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
 	}
 
-	if body.Seconds != 0 {
-		task.Seconds = body.Seconds
+	var body taskUpdateInput
+	if err := c.ShouldBind(&body); err != nil {
+		problem.Bind(c, err)
+		return
 	}
 
-	if !task.PlannedStartTime.Before(task.PlannedEndTime) {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf(
-				"Invalid Start Time: cannot be before End Time. Planned Start Time: %s, Planned End Time: %s",
-				task.PlannedStartTime.Format(time.RFC3339),
-				task.PlannedEndTime.Format(time.RFC3339),
-			),
-		})
+	precondition, err := parseVersionPrecondition(c, body.Version)
+	if errors.Is(err, errVersionRequired) {
+		problem.Respond(c, http.StatusPreconditionRequired, "version_required", err.Error())
+		return
+	} else if err != nil {
+		problem.Validation(c, err)
+		return
+	}
+	if !precondition.matches(task) {
+		versionConflict(c, precondition, task.ID)
 		return
 	}
 
-	if !task.ActualStartTime.Before(task.ActualEndTime) {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf(
-				"Invalid Actual Start Time: cannot be before Actual End Time. Actual Start Time: %s, Actual End Time: %s",
-				task.ActualStartTime.Format(time.RFC3339),
-				task.ActualEndTime.Format(time.RFC3339),
-			),
-		})
+	before := task
+	projectChanged := body.apply(&task)
+
+	saveTaskUpdate(c, before, task, taskUpdate{
+		precondition:     precondition,
+		customFields:     body.CustomFields,
+		checkFields:      body.CustomFields != nil || projectChanged,
+		completeSubtasks: body.CompleteSubtasks,
+	})
+}
+
+// taskUpdate describes how saveTaskUpdate checks and saves a task.
+type taskUpdate struct {
+	precondition versionPrecondition
+	// customFields are the changed custom field values, nil to clear one.
+	// They are checked when checkFields is set.
+	customFields     map[string]interface{}
+	checkFields      bool
+	completeSubtasks bool
+}
+
+// saveTaskUpdate validates the changes from before to task and saves them,
+// provided the task still has the version the update was based on.
+func saveTaskUpdate(c *gin.Context, before, task models.Task, update taskUpdate) {
+	precondition := update.precondition
+	wasDone := taskDone(before)
+
+	if err := validateTask(task, &before); err != nil {
+		problem.Validation(c, err)
 		return
 	}
 
-	err = config.DB.Save(&task).Error
+	// Custom fields are checked when they or the project change, so that a
+	// newly required field does not block unrelated updates.
+	if update.checkFields {
+		fields, err := projectFields(task.Project)
+		if err != nil {
+			problem.Internal(c, "Failed to load custom fields", err)
+			return
+		}
+		if err := setCustomFields(&task, fields, update.customFields); err != nil {
+			problem.Validation(c, err)
+			return
+		}
+	}
+
+	// A parent can only be completed with open subtasks when they are
+	// completed along with it.
+	var openSubtasks []uint
+	if taskDone(task) && !wasDone {
+		var err error
+		if openSubtasks, err = openDescendants(config.DB, task.ID); err != nil {
+			problem.Internal(c, "Failed to check subtasks", err)
+			return
+		}
+		if len(openSubtasks) > 0 && !update.completeSubtasks {
+			problem.Respond(c, http.StatusConflict, "open_subtasks",
+				"Task has open subtasks; complete them first or set complete_subtasks",
+				gin.H{"open_subtasks": openSubtasks})
+			return
+		}
+	}
+	var subtasksBefore []models.Task
+	if len(openSubtasks) > 0 {
+		if err := config.DB.Find(&subtasksBefore, openSubtasks).Error; err != nil {
+			problem.Internal(c, "Failed to check subtasks", err)
+			return
+		}
+	}
 
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		// The version is claimed first, so that of two concurrent updates
+		// based on the same version only one is saved.
+		if err := precondition.claimVersion(tx, task.ID); err != nil {
+			return err
+		}
+		if err := tx.Omit("Children", "Checklist", "Version").Save(&task).Error; err != nil {
+			return err
+		}
+		if len(openSubtasks) > 0 {
+			if err := tx.Model(&models.Task{}).Where("id IN ?", openSubtasks).Updates(map[string]interface{}{"status": models.TaskStatusDone, "version": nextVersion}).Error; err != nil {
+				return err
+			}
+			// Deepest first, so that each parent sees its children's new
+			// progress.
+			for i := len(openSubtasks) - 1; i >= 0; i-- {
+				if err := refreshRollup(tx, &openSubtasks[i]); err != nil {
+					return err
+				}
+			}
+		}
+		if err := refreshRollup(tx, &task.ID); err != nil {
+			return err
+		}
+		return tx.First(&task, task.ID).Error
+	})
+
+	if errors.Is(err, errVersionConflict) {
+		versionConflict(c, precondition, task.ID)
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Error updating task",
-		})
+		problem.Internal(c, "Error updating task", err)
 		return
 	}
+	trackTaskSLA(task)
+	if changes := taskChanges(before, task); len(changes) > 0 {
+		recordTaskAudit(c, models.AuditTaskUpdated, task.ID, changes, "")
+	}
+	for _, old := range subtasksBefore {
+		var subtask models.Task
+		if config.DB.First(&subtask, old.ID).Error == nil {
+			trackTaskSLA(subtask)
+			recordTaskAudit(c, models.AuditTaskUpdated, subtask.ID, taskChanges(old, subtask), fmt.Sprintf("Completed with parent task %d", task.ID))
+		}
+	}
+
+	websocket.GetManager().SendNotification("task_updated", task)
+
+	c.Header("ETag", taskETag(task))
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Details added successfully",
 		"task":    task,
@@ -236,65 +548,403 @@ func UpdateTask(c *gin.Context) {
 }
 
 func DeleteTask(c *gin.Context) {
-	task_id := c.Query("task_id")
+	task_id := idParam(c, "task_id")
 
 	// Find the user by ID
 	var task models.Task
 	err := config.DB.First(&task, task_id).Error
 
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Task not found",
-		})
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
 		return
 	}
 
-	// Delete the task
-	result := config.DB.Delete(&models.Task{}, task_id)
+	// Subtasks move up to the deleted task's parent unless the whole subtree
+	// is deleted with subtasks=cascade.
+	cascade := c.Query("subtasks") == "cascade"
+	if mode := c.Query("subtasks"); mode != "" && mode != "cascade" && mode != "orphan" {
+		problem.Invalid(c, "subtasks must be cascade or orphan")
+		return
+	}
 
-	if result.Error != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Error deleting task",
-			"details": result.Error.Error(), // Include error details
-		})
+	var deletion taskDeletion
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		deletion, err = deleteTasks(tx, []uint{task.ID}, cascade)
+		return err
+	})
+	if err != nil {
+		problem.Internal(c, "Error deleting task", err)
 		return
 	}
+	recordTaskDeletion(c, deletion, "")
 
 	// respond
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Task deleted successfully",
+	respondDeleted(c, gin.H{
+		"message":          "Task deleted successfully",
+		"deleted_task_ids": deletion.deleted,
 	})
 }
+
+// taskDeletion lists what deleteTasks deleted and the subtasks it moved.
+type taskDeletion struct {
+	deleted []uint
+	moved   []subtaskMove
+}
+
+// subtaskMove is a subtask that moved up from a deleted parent.
+type subtaskMove struct {
+	taskID, from uint
+	to           *uint
+}
+
+// deleteTasks deletes tasks and their checklists in tx, with their whole
+// subtrees when cascade is set. Otherwise their subtasks move up to the
+// deleted task's parent. Tasks are handled in order, so that a subtask that
+// is deleted too is not reported as moved.
+func deleteTasks(tx *gorm.DB, ids []uint, cascade bool) (taskDeletion, error) {
+	var deletion taskDeletion
+	for _, id := range ids {
+		// The parent is read again, since it may have moved when an earlier
+		// task was deleted.
+		var task models.Task
+		if err := tx.Select("id", "parent_id").First(&task, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return deletion, err
+		}
+
+		deleted := []uint{task.ID}
+		if cascade {
+			descendants, err := descendantIDs(tx, task.ID)
+			if err != nil {
+				return deletion, err
+			}
+			deleted = append(deleted, descendants...)
+		} else {
+			var children []uint
+			if err := tx.Model(&models.Task{}).Where("parent_id = ?", task.ID).Pluck("id", &children).Error; err != nil {
+				return deletion, err
+			}
+			if err := tx.Model(&models.Task{}).Where("parent_id = ?", task.ID).Updates(map[string]interface{}{"parent_id": task.ParentID, "version": nextVersion}).Error; err != nil {
+				return deletion, err
+			}
+			for _, child := range children {
+				deletion.moved = append(deletion.moved, subtaskMove{taskID: child, from: task.ID, to: task.ParentID})
+			}
+		}
+
+		if err := tx.Delete(&models.Task{}, deleted).Error; err != nil {
+			return deletion, err
+		}
+		if err := refreshRollup(tx, task.ParentID); err != nil {
+			return deletion, err
+		}
+		deletion.deleted = append(deletion.deleted, deleted...)
+	}
+
+	if len(deletion.deleted) > 0 {
+		if err := tx.Where("task_id IN ?", deletion.deleted).Delete(&models.ChecklistItem{}).Error; err != nil {
+			return deletion, err
+		}
+	}
+
+	gone := map[uint]bool{}
+	for _, id := range deletion.deleted {
+		gone[id] = true
+	}
+	moved := deletion.moved[:0]
+	for _, move := range deletion.moved {
+		if !gone[move.taskID] {
+			moved = append(moved, move)
+		}
+	}
+	deletion.moved = moved
+	return deletion, nil
+}
+
+// recordTaskDeletion removes the attachments of deleted tasks and audits the
+// deletion once it has been committed.
+func recordTaskDeletion(c *gin.Context, deletion taskDeletion, details string) {
+	removeTaskAttachments(c, deletion.deleted)
+	for _, id := range deletion.deleted {
+		recordTaskAudit(c, models.AuditTaskDeleted, id, nil, details)
+	}
+	for _, move := range deletion.moved {
+		recordTaskAudit(c, models.AuditTaskUpdated, move.taskID, models.FieldChanges{
+			{Field: "parent_id", Before: move.from, After: move.to},
+		}, fmt.Sprintf("Parent task %d was deleted", move.from))
+	}
+}
+
+var errTaskAlreadyClaimed = errors.New("task already claimed")
+
 func AssignTask(c *gin.Context) {
 	var task models.Task
 	var assignData struct {
 		UserID uint `json:"user_id"`
-		TaskID int  `json:"task_id"`
+		TaskID uint `json:"task_id"`
 	}
 
-	if err := c.ShouldBindJSON(&assignData); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+	if err := bindTaskInput(c, &assignData, &assignData.TaskID); err != nil {
+		problem.Bind(c, err)
 		return
 	}
 
-	if err := config.DB.Preload("User").First(&task, assignData.TaskID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+	if err := config.DB.First(&task, assignData.TaskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
 		return
 	}
 
-	task.AssignedTo = &assignData.UserID
+	var user models.User
+	if err := config.DB.First(&user, assignData.UserID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
 
-	if err := config.DB.Save(&task).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign task"})
+	if !user.Active() {
+		problem.Respond(c, http.StatusBadRequest, "user_deactivated", "Cannot assign a task to a deactivated user")
 		return
 	}
 
-	var user models.User
-	if err := config.DB.First(&user, assignData.UserID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user details"})
+	previous := derefUint(task.AssignedTo)
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := setPrimaryAssignee(tx, task.ID, previous, &user); err != nil {
+			return err
+		}
+		return tx.Select("version").First(&task, task.ID).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to assign task", err)
 		return
 	}
+
+	task.AssignedTo = &user.ID
 	task.User = &user
+	recordTaskAudit(c, models.AuditTaskAssigned, task.ID, models.FieldChanges{
+		{Field: "assigned_to", Before: auditID(previous), After: user.ID},
+	}, "")
+
+	if loaded, err := loadTaskWithParticipants(task.ID); err == nil {
+		notifyUsers(c, taskParticipantIDs(*loaded), "task_assigned", fmt.Sprintf("Task %q was assigned to %s", task.Title, user.Username), loaded)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Task assigned successfully", "task": task})
 }
+
+// setPrimaryAssignee makes user the primary assignee of a task in place of
+// previous, the current one, and keeps the assignee list in step: previous
+// is taken off it and user added. A nil user leaves the task unassigned.
+func setPrimaryAssignee(tx *gorm.DB, taskID, previous uint, user *models.User) error {
+	var assignedTo interface{}
+	if user != nil {
+		assignedTo = user.ID
+	}
+	if err := tx.Model(&models.Task{}).Where("id = ?", taskID).Updates(map[string]interface{}{"assigned_to": assignedTo, "version": nextVersion}).Error; err != nil {
+		return err
+	}
+	return replaceAssignee(tx, taskID, previous, user)
+}
+
+// replaceAssignee swaps previous for user in a task's assignee list, for
+// callers that set assigned_to themselves.
+func replaceAssignee(tx *gorm.DB, taskID, previous uint, user *models.User) error {
+	task := models.Task{}
+	task.ID = taskID
+	if previous != 0 && (user == nil || user.ID != previous) {
+		if err := tx.Model(&task).Association("Assignees").Delete(&models.User{ID: previous}); err != nil {
+			return err
+		}
+	}
+	if user == nil {
+		return nil
+	}
+	return tx.Model(&task).Association("Assignees").Append(user)
+}
+
+func loadTaskWithParticipants(taskID interface{}) (*models.Task, error) {
+	var task models.Task
+	err := config.DB.Preload("User").Preload("Team.Members").Preload("Assignees").Preload("Reviewers").
+		First(&task, taskID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// AssignTaskToTeam hands a task to a team so any member can claim it.
+func AssignTaskToTeam(c *gin.Context) {
+	var input struct {
+		TaskID uint `json:"task_id"`
+		TeamID uint `json:"team_id" binding:"required"`
+	}
+	if err := bindTaskInput(c, &input, &input.TaskID); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	var task models.Task
+	if err := config.DB.First(&task, input.TaskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	var team models.Team
+	if err := config.DB.First(&team, input.TeamID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "team_not_found", "Team not found")
+		return
+	}
+
+	// Handing a task to a team unassigns it, so that a member can claim it.
+	previous, previousAssignee := derefUint(task.TeamID), derefUint(task.AssignedTo)
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&task).Update("team_id", team.ID).Error; err != nil {
+			return err
+		}
+		return setPrimaryAssignee(tx, task.ID, previousAssignee, nil)
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to assign task", err)
+		return
+	}
+
+	loaded, err := loadTaskWithParticipants(task.ID)
+	if err != nil {
+		problem.Internal(c, "Failed to load task", err)
+		return
+	}
+
+	changes := models.FieldChanges{{Field: "team_id", Before: auditID(previous), After: team.ID}}
+	if previousAssignee != 0 {
+		changes = append(changes, models.FieldChange{Field: "assigned_to", Before: previousAssignee, After: nil})
+	}
+	recordTaskAudit(c, models.AuditTaskAssigned, task.ID, changes, "")
+
+	notifyUsers(c, taskParticipantIDs(*loaded), "task_assigned_to_team", fmt.Sprintf("Task %q was assigned to team %s", loaded.Title, team.Name), loaded)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Task assigned to team successfully", "task": loaded})
+}
+
+// ClaimTask lets a member of the task's team take an unclaimed team task.
+func ClaimTask(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		TaskID uint `json:"task_id"`
+	}
+	if err := bindTaskInput(c, &input, &input.TaskID); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	var task models.Task
+	if err := config.DB.First(&task, input.TaskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	if task.TeamID == nil || !isTeamMember(*task.TeamID, user.ID) {
+		problem.Respond(c, http.StatusForbidden, "not_team_member", "Only members of the task's team can claim it")
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Task{}).Where("id = ? AND assigned_to IS NULL", task.ID).Updates(map[string]interface{}{"assigned_to": user.ID, "version": nextVersion})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errTaskAlreadyClaimed
+		}
+		return tx.Model(&task).Association("Assignees").Append(&user)
+	})
+	if errors.Is(err, errTaskAlreadyClaimed) {
+		problem.Respond(c, http.StatusConflict, "task_already_claimed", "Task has already been claimed")
+		return
+	}
+	if err != nil {
+		problem.Internal(c, "Failed to claim task", err)
+		return
+	}
+
+	loaded, err := loadTaskWithParticipants(task.ID)
+	if err != nil {
+		problem.Internal(c, "Failed to load task", err)
+		return
+	}
+
+	recordTaskAudit(c, models.AuditTaskAssigned, task.ID, models.FieldChanges{
+		{Field: "assigned_to", Before: nil, After: user.ID},
+	}, "Claimed by a team member")
+
+	notifyUsers(c, taskParticipantIDs(*loaded), "task_claimed", fmt.Sprintf("%s claimed task %q", user.Username, loaded.Title), loaded)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Task claimed successfully", "task": loaded})
+}
+
+// SetTaskParticipants replaces a task's assignees and reviewers. The first
+// assignee becomes the primary assignee reported in assigned_to.
+func SetTaskParticipants(c *gin.Context) {
+	var input struct {
+		TaskID      uint   `json:"task_id"`
+		AssigneeIDs []uint `json:"assignee_ids"`
+		ReviewerIDs []uint `json:"reviewer_ids"`
+	}
+	if err := bindTaskInput(c, &input, &input.TaskID); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	before, err := loadTaskWithParticipants(input.TaskID)
+	if err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	assignees, err := loadActiveUsers(input.AssigneeIDs)
+	if err != nil {
+		respondUsersError(c, "assignee_ids", "Invalid assignees", err)
+		return
+	}
+	reviewers, err := loadActiveUsers(input.ReviewerIDs)
+	if err != nil {
+		respondUsersError(c, "reviewer_ids", "Invalid reviewers", err)
+		return
+	}
+
+	var primary *uint
+	if len(assignees) > 0 {
+		primary = &assignees[0].ID
+	}
+
+	task := models.Task{}
+	task.ID = before.ID
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&task).Updates(map[string]interface{}{"assigned_to": primary, "version": nextVersion}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&task).Association("Assignees").Replace(assignees); err != nil {
+			return err
+		}
+		return tx.Model(&task).Association("Reviewers").Replace(reviewers)
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to update task participants", err)
+		return
+	}
+
+	loaded, err := loadTaskWithParticipants(task.ID)
+	if err != nil {
+		problem.Internal(c, "Failed to load task", err)
+		return
+	}
+
+	if changes := participantChanges(*before, *loaded); len(changes) > 0 {
+		recordTaskAudit(c, models.AuditTaskAssigned, loaded.ID, changes, "")
+	}
+
+	involved := append(taskParticipantIDs(*before), taskParticipantIDs(*loaded)...)
+	notifyUsers(c, involved, "task_participants_updated", fmt.Sprintf("Assignees and reviewers of task %q changed", loaded.Title), loaded)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Task participants updated successfully", "task": loaded})
+}
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	maxTaskTitleLength       = 200
+	maxTaskDescriptionLength = 10000
+	maxTaskProjectLength     = 100
+	maxRequiredSkills        = 20
+	maxSkillLength           = 50
+)
+
+// taskInput is a new task as sent to POST /task/create or read from a row
+// of a bulk upload. Fields the server manages, such as the ID, timestamps,
+// rollups and version, cannot be set.
+type taskInput struct {
+	Title            string                 `json:"title"`
+	Description      string                 `json:"description"`
+	AssignedTo       *uint                  `json:"assigned_to"`
+	TeamID           *uint                  `json:"team_id"`
+	PlannedStartTime time.Time              `json:"planned_start_time"`
+	PlannedEndTime   time.Time              `json:"planned_end_time"`
+	ActualStartTime  time.Time              `json:"actual_start_time"`
+	ActualEndTime    time.Time              `json:"actual_end_time"`
+	Seconds          int64                  `json:"seconds"`
+	RequiredSkills   []string               `json:"required_skills"`
+	Status           string                 `json:"status"`
+	Priority         string                 `json:"priority"`
+	Project          string                 `json:"project"`
+	ParentID         *uint                  `json:"parent_id"`
+	CustomFields     map[string]interface{} `json:"custom_fields"`
+}
+
+// task builds the task to create. Custom fields are left to setCustomFields.
+func (in taskInput) task() models.Task {
+	return models.Task{
+		Title:            strings.TrimSpace(in.Title),
+		Description:      in.Description,
+		AssignedTo:       in.AssignedTo,
+		TeamID:           in.TeamID,
+		PlannedStartTime: in.PlannedStartTime,
+		PlannedEndTime:   in.PlannedEndTime,
+		ActualStartTime:  in.ActualStartTime,
+		ActualEndTime:    in.ActualEndTime,
+		Seconds:          in.Seconds,
+		RollupSeconds:    in.Seconds,
+		RequiredSkills:   in.RequiredSkills,
+		Status:           in.Status,
+		Priority:         in.Priority,
+		Project:          strings.TrimSpace(in.Project),
+		ParentID:         in.ParentID,
+	}
+}
+
+// taskUpdateInput is the body of PUT /task/update. Empty fields leave the
+// task as it is.
+type taskUpdateInput struct {
+	Title            string                 `json:"title"`
+	Description      string                 `json:"description"`
+	PlannedStartTime taskTime               `json:"planned_start_time"`
+	PlannedEndTime   taskTime               `json:"planned_end_time"`
+	ActualStartTime  taskTime               `json:"actual_start_time"`
+	ActualEndTime    taskTime               `json:"actual_end_time"`
+	Seconds          int64                  `json:"seconds"`
+	Status           string                 `json:"status"`
+	Priority         string                 `json:"priority"`
+	Project          string                 `json:"project"`
+	CustomFields     map[string]interface{} `json:"custom_fields"`
+	CompleteSubtasks bool                   `json:"complete_subtasks"`
+	Version          *uint                  `json:"version"`
+}
+
+// apply copies the fields that were sent onto task and reports whether the
+// project changed.
+func (in taskUpdateInput) apply(task *models.Task) bool {
+	if title := strings.TrimSpace(in.Title); title != "" {
+		task.Title = title
+	}
+	if in.Description != "" {
+		task.Description = in.Description
+	}
+	if !in.PlannedStartTime.IsZero() {
+		task.PlannedStartTime = in.PlannedStartTime.Time
+	}
+	if !in.PlannedEndTime.IsZero() {
+		task.PlannedEndTime = in.PlannedEndTime.Time
+	}
+	if !in.ActualStartTime.IsZero() {
+		task.ActualStartTime = in.ActualStartTime.Time
+	}
+	if !in.ActualEndTime.IsZero() {
+		task.ActualEndTime = in.ActualEndTime.Time
+	}
+	if in.Seconds != 0 {
+		task.Seconds = in.Seconds
+	}
+	if in.Status != "" {
+		task.Status = in.Status
+	}
+	if in.Priority != "" {
+		task.Priority = in.Priority
+	}
+
+	project := strings.TrimSpace(in.Project)
+	changed := project != "" && project != task.Project
+	if project != "" {
+		task.Project = project
+	}
+	return changed
+}
+
+// validateTask checks a task before it is created or saved and reports
+// every invalid field. before is the saved task, or nil for a new one; the
+// assignee and team are only checked when they change, so that tasks of a
+// deactivated user can still be edited.
+func validateTask(task models.Task, before *models.Task) error {
+	var fields problem.Errors
+	add := func(field, code, message string) {
+		fields = append(fields, problem.FieldError{Field: field, Code: code, Message: message})
+	}
+
+	switch title := strings.TrimSpace(task.Title); {
+	case title == "":
+		add("title", "required", "title is required")
+	case len(title) > maxTaskTitleLength:
+		add("title", "length", fmt.Sprintf("title must be at most %d characters", maxTaskTitleLength))
+	}
+	if len(task.Description) > maxTaskDescriptionLength {
+		add("description", "length", fmt.Sprintf("description must be at most %d characters", maxTaskDescriptionLength))
+	}
+	if len(task.Project) > maxTaskProjectLength {
+		add("project", "length", fmt.Sprintf("project must be at most %d characters", maxTaskProjectLength))
+	}
+	if task.Seconds < 0 {
+		add("seconds", "negative", "seconds must not be negative")
+	}
+	if len(task.RequiredSkills) > maxRequiredSkills {
+		add("required_skills", "length", fmt.Sprintf("a task needs at most %d skills", maxRequiredSkills))
+	}
+	for _, skill := range task.RequiredSkills {
+		if strings.TrimSpace(skill) == "" || len(skill) > maxSkillLength {
+			add("required_skills", "invalid", fmt.Sprintf("skills must be 1 to %d characters", maxSkillLength))
+			break
+		}
+	}
+
+	var invalid problem.Errors
+	if errors.As(validateTaskFields(task), &invalid) {
+		fields = append(fields, invalid...)
+	}
+
+	// Time pairs are only checked once the end is known, so that tasks can be
+	// created and updated before they are planned or finished.
+	if !task.PlannedEndTime.IsZero() && !task.PlannedStartTime.Before(task.PlannedEndTime) {
+		add("planned_start_time", "after_end", "planned_start_time must be before planned_end_time")
+	}
+	if !task.ActualEndTime.IsZero() && !task.ActualStartTime.Before(task.ActualEndTime) {
+		add("actual_start_time", "after_end", "actual_start_time must be before actual_end_time")
+	}
+
+	if task.AssignedTo != nil && (before == nil || derefUint(before.AssignedTo) != *task.AssignedTo) {
+		var user models.User
+		if err := config.DB.First(&user, *task.AssignedTo).Error; err != nil {
+			add("assigned_to", "user_not_found", fmt.Sprintf("user %d not found", *task.AssignedTo))
+		} else if !user.Active() {
+			add("assigned_to", "user_deactivated", fmt.Sprintf("user %d is deactivated", *task.AssignedTo))
+		}
+	}
+	if task.TeamID != nil && (before == nil || derefUint(before.TeamID) != *task.TeamID) {
+		var count int64
+		config.DB.Model(&models.Team{}).Where("id = ?", *task.TeamID).Count(&count)
+		if count == 0 {
+			add("team_id", "team_not_found", fmt.Sprintf("team %d not found", *task.TeamID))
+		}
+	}
+
+	if len(fields) > 0 {
+		return fields
+	}
+	return nil
+}
+
+// validateTaskFields checks the status and priority of a task.
+func validateTaskFields(task models.Task) error {
+	var fields problem.Errors
+	if task.Status != "" && !models.StringList(models.TaskStatuses).Contains(task.Status) {
+		fields = append(fields, problem.FieldError{Field: "status", Code: "invalid", Message: fmt.Sprintf("invalid status %q", task.Status)})
+	}
+	if task.Priority != "" && !models.StringList(models.Priorities).Contains(task.Priority) {
+		fields = append(fields, problem.FieldError{Field: "priority", Code: "invalid", Message: fmt.Sprintf("invalid priority %q", task.Priority)})
+	}
+	if len(fields) > 0 {
+		return fields
+	}
+	return nil
+}
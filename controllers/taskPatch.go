@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/jsonpatch"
+	"dtms/models"
+	"dtms/problem"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// taskTime is a task time in a request body. It is read as RFC 3339, the
+// format of every task response, or as Unix seconds, which PUT /task/update
+// has always taken. Null, "" and 0 mean no time.
+type taskTime struct {
+	time.Time
+}
+
+func (t *taskTime) UnmarshalJSON(data []byte) error {
+	raw := strings.TrimSpace(string(data))
+	if strings.HasPrefix(raw, `"`) {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		return t.UnmarshalParam(text)
+	}
+	if raw == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	return t.UnmarshalParam(raw)
+}
+
+// UnmarshalParam reads a time from a form field.
+func (t *taskTime) UnmarshalParam(param string) error {
+	param = strings.TrimSpace(param)
+	if param == "" || param == "0" {
+		t.Time = time.Time{}
+		return nil
+	}
+	if seconds, err := strconv.ParseInt(param, 10, 64); err == nil {
+		t.Time = time.Unix(seconds, 0)
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return fmt.Errorf("invalid time %q: use RFC 3339 or Unix seconds", param)
+	}
+	t.Time = parsed
+	return nil
+}
+
+func (t taskTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.Time.Format(time.RFC3339Nano))
+}
+
+// taskDocument is the JSON document that PATCH /task/update edits: the
+// task's own fields, with unset times as null.
+type taskDocument struct {
+	Title            string                 `json:"title"`
+	Description      string                 `json:"description"`
+	PlannedStartTime taskTime               `json:"planned_start_time"`
+	PlannedEndTime   taskTime               `json:"planned_end_time"`
+	ActualStartTime  taskTime               `json:"actual_start_time"`
+	ActualEndTime    taskTime               `json:"actual_end_time"`
+	Seconds          int64                  `json:"seconds"`
+	Status           string                 `json:"status"`
+	Priority         string                 `json:"priority"`
+	Project          string                 `json:"project"`
+	RequiredSkills   []string               `json:"required_skills"`
+	CustomFields     map[string]interface{} `json:"custom_fields"`
+	Version          uint                   `json:"version"`
+}
+
+func newTaskDocument(task models.Task) map[string]interface{} {
+	doc := taskDocument{
+		Title:            task.Title,
+		Description:      task.Description,
+		PlannedStartTime: taskTime{task.PlannedStartTime},
+		PlannedEndTime:   taskTime{task.PlannedEndTime},
+		ActualStartTime:  taskTime{task.ActualStartTime},
+		ActualEndTime:    taskTime{task.ActualEndTime},
+		Seconds:          task.Seconds,
+		Status:           task.Status,
+		Priority:         task.Priority,
+		Project:          task.Project,
+		RequiredSkills:   task.RequiredSkills,
+		CustomFields:     task.CustomFields,
+		Version:          task.Version,
+	}
+	if doc.RequiredSkills == nil {
+		doc.RequiredSkills = []string{}
+	}
+	if doc.CustomFields == nil {
+		doc.CustomFields = map[string]interface{}{}
+	}
+
+	var generic map[string]interface{}
+	data, _ := json.Marshal(doc)
+	json.Unmarshal(data, &generic)
+	return generic
+}
+
+// decodeDocumentValue converts a value of the patched document into target.
+func decodeDocumentValue(value, target interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+// applyTaskDocument copies the fields that differ between doc and patched
+// onto task. Missing and null fields are cleared. Custom field changes are
+// returned in the form setCustomFields takes.
+func applyTaskDocument(task *models.Task, doc, patched map[string]interface{}) (map[string]interface{}, error) {
+	var unknown []string
+	for name := range patched {
+		if _, ok := doc[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown task fields: %s", strings.Join(unknown, ", "))
+	}
+
+	var customFields map[string]interface{}
+	for name, old := range doc {
+		value := patched[name]
+		if reflect.DeepEqual(old, value) {
+			continue
+		}
+
+		var err error
+		switch name {
+		case "title", "status", "priority":
+			var text string
+			if err = decodeDocumentValue(value, &text); err == nil && strings.TrimSpace(text) == "" {
+				err = errors.New("cannot be empty")
+			}
+			switch name {
+			case "title":
+				task.Title = text
+			case "status":
+				task.Status = text
+			case "priority":
+				task.Priority = text
+			}
+		case "description":
+			task.Description = ""
+			err = decodeDocumentValue(value, &task.Description)
+		case "project":
+			task.Project = ""
+			err = decodeDocumentValue(value, &task.Project)
+		case "planned_start_time", "planned_end_time", "actual_start_time", "actual_end_time":
+			var t taskTime
+			err = decodeDocumentValue(value, &t)
+			switch name {
+			case "planned_start_time":
+				task.PlannedStartTime = t.Time
+			case "planned_end_time":
+				task.PlannedEndTime = t.Time
+			case "actual_start_time":
+				task.ActualStartTime = t.Time
+			case "actual_end_time":
+				task.ActualEndTime = t.Time
+			}
+		case "seconds":
+			task.Seconds = 0
+			err = decodeDocumentValue(value, &task.Seconds)
+		case "required_skills":
+			var skills []string
+			err = decodeDocumentValue(value, &skills)
+			task.RequiredSkills = skills
+		case "custom_fields":
+			var values map[string]interface{}
+			if err = decodeDocumentValue(value, &values); err == nil {
+				customFields = map[string]interface{}{}
+				for key := range old.(map[string]interface{}) {
+					customFields[key] = nil
+				}
+				for key, fieldValue := range values {
+					customFields[key] = fieldValue
+				}
+			}
+		case "version":
+			err = errors.New("is read-only; send the version in If-Match or a test operation")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return customFields, nil
+}
+
+// PatchTask edits a task with an RFC 7396 merge patch (Content-Type
+// application/merge-patch+json or application/json) or an RFC 6902 JSON
+// Patch (application/json-patch+json). Unlike PUT, null and removed fields
+// are cleared.
+func PatchTask(c *gin.Context) {
+	var task models.Task
+	if err := config.DB.Preload("Checklist", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).First(&task, idParam(c, "task_id")).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+	before := task
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_patch", "Failed to read the patch")
+		return
+	}
+
+	// The version the patch is based on comes from If-Match, a "version"
+	// member of a merge patch or a test operation on /version.
+	var version *uint
+	var apply func(doc interface{}) (interface{}, error)
+	switch contentType := c.ContentType(); contentType {
+	case jsonpatch.MergePatchType, "application/json":
+		var patch map[string]interface{}
+		if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+			problem.Respond(c, http.StatusBadRequest, "invalid_patch", "A merge patch must be a JSON object")
+			return
+		}
+		if raw, ok := patch["version"]; ok {
+			var v uint
+			if err := decodeDocumentValue(raw, &v); err != nil {
+				problem.Respond(c, http.StatusBadRequest, "invalid_version", "version must be a number")
+				return
+			}
+			version = &v
+			delete(patch, "version")
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return jsonpatch.MergePatch(doc, patch), nil
+		}
+	case jsonpatch.JSONPatchType:
+		ops, err := jsonpatch.Decode(body)
+		if err != nil {
+			problem.Respond(c, http.StatusBadRequest, "invalid_patch", "Invalid JSON Patch: "+err.Error())
+			return
+		}
+		for _, op := range ops {
+			if op.Op == "test" && op.Path == "/version" {
+				var v uint
+				if err := json.Unmarshal(op.Value, &v); err != nil {
+					problem.Respond(c, http.StatusBadRequest, "invalid_version", "version must be a number")
+					return
+				}
+				version = &v
+				break
+			}
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return jsonpatch.Apply(doc, ops)
+		}
+	default:
+		problem.Respond(c, http.StatusUnsupportedMediaType, "unsupported_media_type",
+			fmt.Sprintf("Send a patch as %s or %s", jsonpatch.MergePatchType, jsonpatch.JSONPatchType))
+		return
+	}
+
+	precondition, err := parseVersionPrecondition(c, version)
+	if errors.Is(err, errVersionRequired) {
+		problem.Respond(c, http.StatusPreconditionRequired, "version_required", err.Error())
+		return
+	} else if err != nil {
+		problem.Validation(c, err)
+		return
+	}
+	if !precondition.matches(task) {
+		versionConflict(c, precondition, task.ID)
+		return
+	}
+
+	doc := newTaskDocument(task)
+	result, err := apply(doc)
+	if err != nil {
+		problem.Respond(c, http.StatusUnprocessableEntity, "patch_failed", "The patch cannot be applied: "+err.Error())
+		return
+	}
+	patched, ok := result.(map[string]interface{})
+	if !ok {
+		problem.Respond(c, http.StatusUnprocessableEntity, "patch_failed", "The patched task must be a JSON object")
+		return
+	}
+
+	customFields, err := applyTaskDocument(&task, doc, patched)
+	if err != nil {
+		problem.Respond(c, http.StatusUnprocessableEntity, "invalid_patched_task", err.Error())
+		return
+	}
+
+	saveTaskUpdate(c, before, task, taskUpdate{
+		precondition:     precondition,
+		customFields:     customFields,
+		checkFields:      customFields != nil || task.Project != before.Project,
+		completeSubtasks: c.Query("complete_subtasks") == "true",
+	})
+}
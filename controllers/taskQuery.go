@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const customFieldParam = "field."
+
+// fieldFilter matches tasks by a custom field value. Op is "" for equality,
+// or "min" or "max" for an inclusive bound.
+type fieldFilter struct {
+	key   string
+	op    string
+	value string
+}
+
+// taskQuery holds the filters and order of a task listing.
+type taskQuery struct {
+	project    string
+	filters    []fieldFilter
+	labelsAny  []string
+	labelsAll  []string
+	labelsNone []string
+	sortField  string
+	descending bool
+}
+
+// labelNames splits a comma separated list of label names.
+func labelNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !models.StringList(names).Contains(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseTaskQuery reads the query parameters of GetTasks and ExportTasks:
+// project, field.<key>, field.<key>.min, field.<key>.max, labels.any,
+// labels.all, labels.none and sort=field.<key> (prefix "-" to sort
+// descending).
+func parseTaskQuery(query url.Values) (taskQuery, error) {
+	q := taskQuery{
+		project:    query.Get("project"),
+		labelsAny:  labelNames(query.Get("labels.any")),
+		labelsAll:  labelNames(query.Get("labels.all")),
+		labelsNone: labelNames(query.Get("labels.none")),
+	}
+
+	for param, values := range query {
+		if !strings.HasPrefix(param, customFieldParam) {
+			continue
+		}
+		key, op := strings.TrimPrefix(param, customFieldParam), ""
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			key, op = key[:i], key[i+1:]
+		}
+		if op != "" && op != "min" && op != "max" {
+			return q, fmt.Errorf("invalid filter %q; use field.<key>, field.<key>.min or field.<key>.max", param)
+		}
+		for _, value := range values {
+			q.filters = append(q.filters, fieldFilter{key: key, op: op, value: value})
+		}
+	}
+
+	if order := query.Get("sort"); order != "" {
+		q.descending = strings.HasPrefix(order, "-")
+		order = strings.TrimPrefix(order, "-")
+		if !strings.HasPrefix(order, customFieldParam) {
+			return q, fmt.Errorf("invalid sort %q; use field.<key> or -field.<key>", query.Get("sort"))
+		}
+		q.sortField = strings.TrimPrefix(order, customFieldParam)
+	}
+	return q, nil
+}
+
+// preloadTaskListing loads the associations a task listing shows.
+func preloadTaskListing(db *gorm.DB) *gorm.DB {
+	return db.Preload("User").Preload("Team").Preload("Assignees").Preload("Reviewers").Preload("Labels")
+}
+
+// find loads the matching tasks. The project, label filters and the
+// projects that define each filtered field are applied in SQL. Custom
+// field values are then compared in Go because their type depends on each
+// task's project; tasks without a value never match a field filter and
+// sort last. That pass reads every remaining task of those projects, so
+// with field filters or a field sort the associations are only loaded once
+// the tasks that match are known.
+func (q taskQuery) find() ([]models.Task, error) {
+	inGo := len(q.filters) > 0 || q.sortField != ""
+
+	db := config.DB
+	if !inGo {
+		db = preloadTaskListing(db)
+	}
+	if q.project != "" {
+		db = db.Where("project = ?", q.project)
+	}
+	for _, filter := range q.filters {
+		db = db.Where("project IN (SELECT project FROM custom_fields WHERE key = ?)", filter.key)
+	}
+
+	const labeled = "SELECT task_labels.task_id FROM task_labels JOIN labels ON labels.id = task_labels.label_id WHERE LOWER(labels.name) IN ?"
+	if len(q.labelsAny) > 0 {
+		db = db.Where("id IN ("+labeled+")", q.labelsAny)
+	}
+	if len(q.labelsAll) > 0 {
+		db = db.Where("id IN ("+labeled+" GROUP BY task_labels.task_id HAVING COUNT(DISTINCT labels.id) = ?)", q.labelsAll, len(q.labelsAll))
+	}
+	if len(q.labelsNone) > 0 {
+		db = db.Where("id NOT IN ("+labeled+")", q.labelsNone)
+	}
+
+	var tasks []models.Task
+	if err := db.Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	if !inGo {
+		return tasks, nil
+	}
+
+	var definitions []models.CustomField
+	if err := config.DB.Find(&definitions).Error; err != nil {
+		return nil, err
+	}
+	fields := map[string]map[string]models.CustomField{}
+	for _, field := range definitions {
+		if fields[field.Project] == nil {
+			fields[field.Project] = map[string]models.CustomField{}
+		}
+		fields[field.Project][field.Key] = field
+	}
+
+	// Filter values are normalized once per project, since user values may
+	// need a lookup.
+	type normalized struct {
+		value interface{}
+		ok    bool
+	}
+	cache := map[string]normalized{}
+	matches := func(task models.Task, filter fieldFilter) bool {
+		field, defined := fields[task.Project][filter.key]
+		stored, set := task.CustomFields[filter.key]
+		if !defined || !set {
+			return false
+		}
+
+		cacheKey := task.Project + "\x00" + filter.key + "\x00" + filter.value
+		want, cached := cache[cacheKey]
+		if !cached {
+			value, err := normalizeFieldValue(field, filter.value)
+			want = normalized{value: value, ok: err == nil}
+			cache[cacheKey] = want
+		}
+		if !want.ok {
+			return false
+		}
+
+		cmp := compareFieldValues(field, stored, want.value)
+		switch filter.op {
+		case "min":
+			return cmp >= 0
+		case "max":
+			return cmp <= 0
+		}
+		return cmp == 0
+	}
+
+	filtered := tasks[:0]
+	for _, task := range tasks {
+		keep := true
+		for _, filter := range q.filters {
+			if !matches(task, filter) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			filtered = append(filtered, task)
+		}
+	}
+
+	if q.sortField != "" {
+		sort.SliceStable(filtered, func(i, j int) bool {
+			a, aSet := filtered[i].CustomFields[q.sortField]
+			b, bSet := filtered[j].CustomFields[q.sortField]
+			aField, aDefined := fields[filtered[i].Project][q.sortField]
+			bField, bDefined := fields[filtered[j].Project][q.sortField]
+			aSet, bSet = aSet && aDefined, bSet && bDefined
+			if !aSet || !bSet {
+				return aSet
+			}
+			// Projects may define the key with different types, or enums
+			// with different options: group those before comparing values.
+			cmp := strings.Compare(aField.Type, bField.Type)
+			if cmp == 0 && aField.Type == models.FieldTypeEnum && filtered[i].Project != filtered[j].Project {
+				cmp = strings.Compare(filtered[i].Project, filtered[j].Project)
+			}
+			if cmp == 0 {
+				cmp = compareFieldValues(aField, a, b)
+			}
+			if q.descending {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+	return loadTaskListing(filtered)
+}
+
+// loadTaskListing reloads tasks with the associations of a listing, keeping
+// their order.
+func loadTaskListing(tasks []models.Task) ([]models.Task, error) {
+	if len(tasks) == 0 {
+		return tasks, nil
+	}
+	ids := make([]uint, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+
+	var loaded []models.Task
+	if err := preloadTaskListing(config.DB).Where("id IN ?", ids).Find(&loaded).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.Task, len(loaded))
+	for _, task := range loaded {
+		byID[task.ID] = task
+	}
+
+	ordered := make([]models.Task, 0, len(loaded))
+	for _, id := range ids {
+		if task, ok := byID[id]; ok {
+			ordered = append(ordered, task)
+		}
+	}
+	return ordered, nil
+}
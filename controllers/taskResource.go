@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// versionedAPI reports whether c came in through /api/v1 rather than the
+// legacy routes.
+func versionedAPI(c *gin.Context) bool {
+	return c.GetString("api_version") != ""
+}
+
+// idParam returns an ID from the path of the versioned API, or from the
+// query string of the legacy routes.
+func idParam(c *gin.Context, name string) string {
+	if id := c.Param(name); id != "" {
+		return id
+	}
+	return c.Query(name)
+}
+
+// bindTaskInput binds a JSON body that names its task in task_id. On the
+// versioned API the task comes from the path instead.
+func bindTaskInput(c *gin.Context, input interface{}, taskID *uint) error {
+	if err := c.ShouldBindJSON(input); err != nil {
+		return err
+	}
+	if id := c.Param("task_id"); id != "" {
+		parsed, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return err
+		}
+		*taskID = uint(parsed)
+	}
+	if *taskID == 0 {
+		return problem.FieldError{Field: "task_id", Code: "required", Message: "task_id is required"}
+	}
+	return nil
+}
+
+// inPathTask reports whether a comment, checklist item or attachment of
+// taskID may be reached through the path, which on the versioned API names
+// the task it belongs to.
+func inPathTask(c *gin.Context, taskID uint) bool {
+	id := c.Param("task_id")
+	return id == "" || id == strconv.FormatUint(uint64(taskID), 10)
+}
+
+// createdStatus is 201 on the versioned API and 200 on the legacy routes.
+func createdStatus(c *gin.Context) int {
+	if versionedAPI(c) {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
+
+// respondCreated answers a request that created a resource. The versioned
+// API adds its location, if there is one.
+func respondCreated(c *gin.Context, location string, body gin.H) {
+	if versionedAPI(c) && location != "" {
+		c.Header("Location", location)
+	}
+	c.JSON(createdStatus(c), body)
+}
+
+// respondDeleted answers a successful delete: 204 without a body on the
+// versioned API, 200 with body on the legacy routes.
+func respondDeleted(c *gin.Context, body gin.H) {
+	if versionedAPI(c) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// GetTask returns one task with its participants, labels and checklist.
+func GetTask(c *gin.Context) {
+	var task models.Task
+	err := config.DB.Preload("User").Preload("Team").Preload("Assignees").Preload("Reviewers").Preload("Labels").
+		Preload("Checklist", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		First(&task, idParam(c, "task_id")).Error
+	if err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	c.JSON(http.StatusOK, gin.H{"task": task})
+}
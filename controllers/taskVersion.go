@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errVersionConflict = errors.New("task was changed by someone else")
+	errVersionRequired = errors.New("send the task's version in If-Match or the version field")
+)
+
+// nextVersion bumps a task's version as part of an update. Every change to
+// a task's own columns or associations uses it, so that edits based on the
+// previous version are rejected.
+var nextVersion = gorm.Expr("version + 1")
+
+// bumpVersion records a change to a task made outside its own columns, such
+// as to its checklist.
+func bumpVersion(tx *gorm.DB, taskID uint) error {
+	return tx.Model(&models.Task{}).Where("id = ?", taskID).UpdateColumn("version", nextVersion).Error
+}
+
+// taskETag is the entity tag of a task version.
+func taskETag(task models.Task) string {
+	return fmt.Sprintf(`"%d"`, task.Version)
+}
+
+// versionPrecondition is the version an update was based on, taken from the
+// If-Match header or the version field of the body.
+type versionPrecondition struct {
+	version uint
+	any     bool // If-Match: *
+	header  bool
+}
+
+// parseVersionPrecondition reads the expected version of an update. The
+// If-Match header wins over the body; one of them is required.
+func parseVersionPrecondition(c *gin.Context, bodyVersion *uint) (versionPrecondition, error) {
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	switch {
+	case ifMatch == "*":
+		return versionPrecondition{any: true, header: true}, nil
+	case ifMatch != "":
+		tag := strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`)
+		version, err := strconv.ParseUint(tag, 10, 32)
+		if err != nil {
+			return versionPrecondition{}, errors.New(`If-Match must be a task ETag such as "3"`)
+		}
+		return versionPrecondition{version: uint(version), header: true}, nil
+	case bodyVersion != nil:
+		return versionPrecondition{version: *bodyVersion}, nil
+	}
+	return versionPrecondition{}, errVersionRequired
+}
+
+func (p versionPrecondition) matches(task models.Task) bool {
+	return p.any || p.version == task.Version
+}
+
+// claimVersion bumps the version of a task inside tx, provided it still has
+// the version the update was based on.
+func (p versionPrecondition) claimVersion(tx *gorm.DB, taskID uint) error {
+	query := tx.Model(&models.Task{}).Where("id = ?", taskID)
+	if !p.any {
+		query = query.Where("version = ?", p.version)
+	}
+	result := query.UpdateColumn("version", nextVersion)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errVersionConflict
+	}
+	return nil
+}
+
+// versionConflict answers a stale update with the task's current state:
+// 412 when the version came from If-Match, 409 when it came from the body.
+func versionConflict(c *gin.Context, p versionPrecondition, taskID uint) {
+	status := http.StatusConflict
+	if p.header {
+		status = http.StatusPreconditionFailed
+	}
+
+	var current models.Task
+	if err := config.DB.Preload("Checklist", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).First(&current, taskID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "task_not_found", "Task not found")
+		return
+	}
+	c.Header("ETag", taskETag(current))
+	problem.Respond(c, status, "version_conflict",
+		"Task was changed by someone else; apply your changes to the current version",
+		gin.H{"version": current.Version, "task": current})
+}
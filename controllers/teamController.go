@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// respondUsersError answers a failed loadActiveUsers for the users listed
+// in field.
+func respondUsersError(c *gin.Context, field, detail string, err error) {
+	var invalid problem.FieldError
+	if !errors.As(err, &invalid) {
+		problem.Internal(c, "Failed to load users", err)
+		return
+	}
+	invalid.Field = field
+	problem.Invalid(c, detail+": "+invalid.Message, invalid)
+}
+
+// loadActiveUsers fetches users by ID and fails if any is missing or
+// deactivated.
+func loadActiveUsers(ids []uint) ([]models.User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var users []models.User
+	if err := config.DB.Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	found := make(map[uint]models.User, len(users))
+	for _, user := range users {
+		found[user.ID] = user
+	}
+
+	ordered := make([]models.User, 0, len(ids))
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		user, ok := found[id]
+		if !ok {
+			return nil, problem.FieldError{Code: "user_not_found", Message: fmt.Sprintf("user %d not found", id)}
+		}
+		if !user.Active() {
+			return nil, problem.FieldError{Code: "user_deactivated", Message: fmt.Sprintf("user %d is deactivated", id)}
+		}
+		if !seen[id] {
+			seen[id] = true
+			ordered = append(ordered, user)
+		}
+	}
+	return ordered, nil
+}
+
+func GetTeams(c *gin.Context) {
+	var teams []models.Team
+	if err := config.DB.Preload("Members").Find(&teams).Error; err != nil {
+		problem.Internal(c, "Failed to fetch teams", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"teams": teams})
+}
+
+func CreateTeam(c *gin.Context) {
+	var input struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+		MemberIDs   []uint `json:"member_ids"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	members, err := loadActiveUsers(input.MemberIDs)
+	if err != nil {
+		respondUsersError(c, "member_ids", "Invalid members", err)
+		return
+	}
+
+	team := models.Team{Name: input.Name, Description: input.Description, Members: members}
+	if err := config.DB.Create(&team).Error; err != nil {
+		problem.Internal(c, "Failed to create team", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Team created successfully", "team": team})
+}
+
+type teamMemberInput struct {
+	TeamID uint `json:"team_id" form:"team_id" binding:"required"`
+	UserID uint `json:"user_id" form:"user_id" binding:"required"`
+}
+
+func AddTeamMember(c *gin.Context) {
+	var input teamMemberInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	var team models.Team
+	if err := config.DB.First(&team, input.TeamID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "team_not_found", "Team not found")
+		return
+	}
+
+	members, err := loadActiveUsers([]uint{input.UserID})
+	if err != nil {
+		respondUsersError(c, "user_id", "Invalid member", err)
+		return
+	}
+
+	if err := config.DB.Model(&team).Association("Members").Append(members); err != nil {
+		problem.Internal(c, "Failed to add member", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member added successfully"})
+}
+
+func RemoveTeamMember(c *gin.Context) {
+	var input teamMemberInput
+	if err := c.ShouldBindQuery(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	var team models.Team
+	if err := config.DB.First(&team, input.TeamID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "team_not_found", "Team not found")
+		return
+	}
+
+	if err := config.DB.Model(&team).Association("Members").Delete(&models.User{ID: input.UserID}); err != nil {
+		problem.Internal(c, "Failed to remove member", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+}
+
+// DeleteTeam removes a team. Its tasks stay, without a team.
+func DeleteTeam(c *gin.Context) {
+	teamID := c.Query("team_id")
+
+	var team models.Team
+	if err := config.DB.First(&team, teamID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "team_not_found", "Team not found")
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Task{}).Where("team_id = ?", team.ID).Updates(map[string]interface{}{"team_id": nil, "version": nextVersion}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&team).Association("Members").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(&team).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to delete team", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Team deleted successfully"})
+}
+
+func isTeamMember(teamID, userID uint) bool {
+	var count int64
+	config.DB.Table("team_members").Where("team_id = ? AND user_id = ?", teamID, userID).Count(&count)
+	return count > 0
+}
@@ -0,0 +1,320 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/totp"
+	"encoding/base32"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	twoFactorChallengePurpose = "2fa_challenge"
+	twoFactorChallengeTTL     = 5 * time.Minute
+	recoveryCodeCount         = 10
+	totpIssuer                = "DTMS"
+)
+
+type secondFactorInput struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the
+// new plaintext codes, which are shown once and never stored.
+func generateRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	records := make([]models.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		records[i] = models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(raw)}
+	}
+
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code. Accepted TOTP steps and recovery codes cannot be replayed.
+func verifySecondFactor(user *models.User, input secondFactorInput) bool {
+	if input.Code != "" {
+		step, ok := totp.Validate(user.TOTPSecret, input.Code, time.Now())
+		if !ok || step <= user.TOTPLastStep {
+			return false
+		}
+		result := config.DB.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil || result.RowsAffected != 1 {
+			return false
+		}
+		user.TOTPLastStep = step
+		return true
+	}
+
+	if input.RecoveryCode != "" {
+		var codes []models.RecoveryCode
+		config.DB.Where("user_id = ? AND used_at IS NULL", user.ID).Find(&codes)
+
+		hash := hashRecoveryCode(input.RecoveryCode)
+		for _, code := range codes {
+			if subtle.ConstantTimeCompare([]byte(code.CodeHash), []byte(hash)) != 1 {
+				continue
+			}
+			result := config.DB.Model(&models.RecoveryCode{}).
+				Where("id = ? AND used_at IS NULL", code.ID).
+				Update("used_at", time.Now())
+			return result.Error == nil && result.RowsAffected == 1
+		}
+	}
+
+	return false
+}
+
+// EnrollTwoFactor starts enrollment by generating a new secret. 2FA is not
+// enforced until the secret is confirmed with ConfirmTwoFactor.
+func EnrollTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	if user.TwoFactorEnabled {
+		problem.Respond(c, http.StatusConflict, "two_factor_enabled", "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		problem.Internal(c, "Failed to generate secret", err)
+		return
+	}
+
+	if err := config.DB.Model(&user).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		problem.Internal(c, "Failed to start enrollment", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+	})
+}
+
+func ConfirmTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		problem.Respond(c, http.StatusConflict, "two_factor_enabled", "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TOTPSecret == "" {
+		problem.Respond(c, http.StatusBadRequest, "enrollment_not_started", "Two-factor enrollment has not been started")
+		return
+	}
+
+	if !verifySecondFactor(&user, secondFactorInput{Code: input.Code}) {
+		problem.Respond(c, http.StatusUnauthorized, "invalid_verification_code", "Invalid verification code")
+		return
+	}
+
+	var codes []string
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("two_factor_enabled", true).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = generateRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to enable two-factor authentication", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+func DisableTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input secondFactorInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		problem.Respond(c, http.StatusBadRequest, "two_factor_not_enabled", "Two-factor authentication is not enabled")
+		return
+	}
+
+	if user.OrganizationID != nil {
+		var org models.Organization
+		if err := config.DB.First(&org, *user.OrganizationID).Error; err == nil && org.RequireTwoFactor {
+			problem.Respond(c, http.StatusForbidden, "two_factor_required", "Two-factor authentication is required by your organization")
+			return
+		}
+	}
+
+	if !verifySecondFactor(&user, input) {
+		problem.Respond(c, http.StatusUnauthorized, "invalid_verification_code", "Invalid verification code")
+		return
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"two_factor_enabled": false,
+			"totp_secret":        "",
+			"totp_last_step":     0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		problem.Internal(c, "Failed to disable two-factor authentication", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		problem.Respond(c, http.StatusBadRequest, "two_factor_not_enabled", "Two-factor authentication is not enabled")
+		return
+	}
+
+	if !verifySecondFactor(&user, secondFactorInput{Code: input.Code}) {
+		problem.Respond(c, http.StatusUnauthorized, "invalid_verification_code", "Invalid verification code")
+		return
+	}
+
+	codes, err := generateRecoveryCodes(config.DB, user.ID)
+	if err != nil {
+		problem.Internal(c, "Failed to generate recovery codes", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// LoginTwoFactor completes a login that Login answered with a challenge.
+func LoginTwoFactor(c *gin.Context) {
+	var input struct {
+		Challenge string `json:"challenge" binding:"required"`
+		secondFactorInput
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	token, err := jwt.Parse(input.Challenge, config.Keys.Keyfunc)
+	if err != nil || !token.Valid {
+		problem.Respond(c, http.StatusUnauthorized, "invalid_challenge", "Invalid or expired challenge")
+		return
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != twoFactorChallengePurpose {
+		problem.Respond(c, http.StatusUnauthorized, "invalid_challenge", "Invalid or expired challenge")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, "id = ?", claims["user_id"]).Error; err != nil || !user.TwoFactorEnabled {
+		problem.Respond(c, http.StatusUnauthorized, "invalid_challenge", "Invalid or expired challenge")
+		return
+	}
+
+	key := twoFactorThrottleKey(user.ID)
+	wait, lockedOut := reserveAttempt(time.Now(), throttledKey{key, accountThrottle})
+	if wait > 0 {
+		respondThrottled(c, wait)
+		return
+	}
+
+	if !verifySecondFactor(&user, input.secondFactorInput) {
+		recordLoginFailure(c, key, "wrong verification code", lockedOut)
+		problem.Respond(c, http.StatusUnauthorized, "invalid_verification_code", "Invalid verification code")
+		return
+	}
+
+	clearThrottle(key)
+	issueSession(c, user)
+}
+
+func twoFactorStatus(user models.User) string {
+	if user.TwoFactorEnabled {
+		return "enabled"
+	}
+	if user.TOTPSecret != "" {
+		return "pending"
+	}
+	return "disabled"
+}
+
+// GetTwoFactorStatus reports whether 2FA is enabled and how many recovery
+// codes remain.
+func GetTwoFactorStatus(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var remaining int64
+	config.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&remaining)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":                   twoFactorStatus(user),
+		"recovery_codes_remaining": remaining,
+	})
+}
@@ -0,0 +1,259 @@
+package controllers
+
+import (
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"dtms/schedule"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// GetUsers lists active users, e.g. to pick an assignee. q filters by name
+// or email. Administrators may pass include_inactive=true.
+func GetUsers(c *gin.Context) {
+	current := c.MustGet("user").(models.User)
+
+	query := config.DB.Model(&models.User{}).Order("username")
+	if c.Query("include_inactive") != "true" || current.Role != models.RoleAdmin {
+		query = query.Where("deactivated_at IS NULL")
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := "%" + strings.ToLower(q) + "%"
+		query = query.Where("LOWER(username) LIKE ? OR LOWER(email) LIKE ?", pattern, pattern)
+	}
+
+	var users []models.User
+	if err := query.Find(&users).Error; err != nil {
+		problem.Internal(c, "Failed to fetch users", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+func GetProfile(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"user": c.MustGet("user").(models.User)})
+}
+
+// UpdateProfile changes the current user's name, email, skills, working
+// hours or time zone. A new email must be verified again.
+func UpdateProfile(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		Username  string             `json:"username"`
+		Email     string             `json:"email" binding:"omitempty,email"`
+		Skills    *models.StringList `json:"skills"`
+		WorkStart string             `json:"work_start"`
+		WorkEnd   string             `json:"work_end"`
+		WorkDays  string             `json:"work_days"`
+		TimeZone  string             `json:"time_zone"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if input.Username != "" {
+		user.Username = input.Username
+	}
+	if input.Skills != nil {
+		user.Skills = *input.Skills
+	}
+	if input.WorkStart != "" {
+		user.WorkStart = input.WorkStart
+	}
+	if input.WorkEnd != "" {
+		user.WorkEnd = input.WorkEnd
+	}
+	if input.WorkDays != "" {
+		user.WorkDays = input.WorkDays
+	}
+	if _, err := schedule.Parse(user.WorkStart, user.WorkEnd, user.WorkDays); err != nil {
+		problem.Respond(c, http.StatusBadRequest, "invalid_working_hours", "Invalid working hours: "+err.Error())
+		return
+	}
+	if input.TimeZone != "" {
+		if _, err := schedule.LoadLocation(input.TimeZone); err != nil {
+			problem.Respond(c, http.StatusBadRequest, "invalid_time_zone", "Invalid time zone: "+err.Error())
+			return
+		}
+		user.TimeZone = input.TimeZone
+	}
+
+	emailChanged := input.Email != "" && !strings.EqualFold(input.Email, user.Email)
+	if emailChanged {
+		var existing models.User
+		if err := config.DB.Where("email = ? AND id <> ?", input.Email, user.ID).First(&existing).Error; err == nil {
+			problem.Respond(c, http.StatusBadRequest, "email_taken", "Email already registered")
+			return
+		}
+		user.Email = input.Email
+		user.EmailVerifiedAt = nil
+	}
+
+	if err := config.DB.Save(&user).Error; err != nil {
+		problem.Internal(c, "Failed to update profile", err)
+		return
+	}
+
+	if emailChanged {
+		if err := sendVerificationEmail(user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Profile updated successfully", "user": user})
+}
+
+func ChangePassword(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var input struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		Password        string `json:"password" binding:"required,min=8"`
+		ConfirmPassword string `json:"confirm_password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if input.Password != input.ConfirmPassword {
+		problem.Respond(c, http.StatusBadRequest, "password_mismatch", "Passwords do not match")
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.CurrentPassword)); err != nil {
+		problem.Respond(c, http.StatusUnauthorized, "invalid_password", "Current password is incorrect")
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), passwordHashCost)
+	if err != nil {
+		problem.Internal(c, "Failed to hash password", err)
+		return
+	}
+
+	// Other sessions, including any opened with the old password, are
+	// revoked; this one continues with the token sent back.
+	err = config.DB.Model(&user).Updates(map[string]interface{}{
+		"password":           string(hashedPassword),
+		"session_generation": gorm.Expr("session_generation + 1"),
+	}).Error
+	if err == nil {
+		err = config.DB.Select("session_generation").First(&user, user.ID).Error
+	}
+	if err != nil {
+		problem.Internal(c, "Failed to change password", err)
+		return
+	}
+
+	token, err := signSession(c, user)
+	if err != nil {
+		problem.Internal(c, "Failed to generate token", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully", "token": token})
+}
+
+type userIDInput struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+// DeactivateUser stops a user from authenticating or being assigned tasks.
+// Their existing data is kept.
+func DeactivateUser(c *gin.Context) {
+	current := c.MustGet("user").(models.User)
+
+	var input userIDInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	if input.UserID == current.ID {
+		problem.Respond(c, http.StatusBadRequest, "cannot_deactivate_self", "You cannot deactivate your own account")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, input.UserID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+
+	if user.DeactivatedAt == nil {
+		now := time.Now()
+		user.DeactivatedAt = &now
+		if err := config.DB.Model(&user).Update("deactivated_at", now).Error; err != nil {
+			problem.Internal(c, "Failed to deactivate user", err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deactivated successfully", "user": user})
+}
+
+func ActivateUser(c *gin.Context) {
+	var input userIDInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, input.UserID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+
+	user.DeactivatedAt = nil
+	if err := config.DB.Model(&user).Update("deactivated_at", nil).Error; err != nil {
+		problem.Internal(c, "Failed to activate user", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User activated successfully", "user": user})
+}
+
+func SetUserRole(c *gin.Context) {
+	var input struct {
+		UserID uint   `json:"user_id" binding:"required"`
+		Role   string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Bind(c, err)
+		return
+	}
+
+	valid := false
+	for _, role := range models.Roles {
+		valid = valid || role == input.Role
+	}
+	if !valid {
+		problem.Respond(c, http.StatusBadRequest, "unknown_role", "Unknown role")
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, input.UserID).Error; err != nil {
+		problem.Respond(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+
+	if err := config.DB.Model(&user).Update("role", input.Role).Error; err != nil {
+		problem.Internal(c, "Failed to update role", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully", "user": user})
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"dtms/config"
 	"dtms/controllers"
+	"dtms/mailer"
+	"dtms/middleware"
+	"dtms/problem"
 	"dtms/routes"
+	"dtms/storage"
 	"dtms/websocket"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 )
@@ -13,17 +21,68 @@ import (
 func main() {
 
 	config.ConnectDatabase()
-	r := gin.Default()
+	if err := config.LoadJWTKeys(); err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+	go reloadKeysOnSignal()
+
+	r := gin.New()
+	r.Use(middleware.RequestID(), gin.Logger(), gin.CustomRecovery(problem.Recover))
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(problem.NotFound)
+	r.NoMethod(problem.MethodNotAllowed)
 
 	routes.SetupAuthRoutes(r)
 	routes.SetupTaskRoutes(r)
+	routes.SetupAPIRoutes(r)
+	routes.SetupUserRoutes(r)
+	routes.SetupTeamRoutes(r)
+	routes.SetupCalendarRoutes(r)
+	routes.SetupSLARoutes(r)
+	routes.SetupProjectRoutes(r)
+	routes.SetupLabelRoutes(r)
+	routes.SetupNotificationRoutes(r)
+	routes.SetupAdminRoutes(r)
 
 	websocket.InitWebSocketManager()
+	mailer.InitMailer(mailer.FromEnv())
+
+	backend, err := storage.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid storage configuration: %v", err)
+	}
+	storage.InitBackend(backend)
 
-	r.POST("/tasks", controllers.CreateTask)
-	r.GET("/ws", websocket.HandleConnections)
+	reminders, err := controllers.ReminderSchedulerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid reminder configuration: %v", err)
+	}
+	go reminders.Run(context.Background())
+
+	slaMonitor, err := controllers.SLAMonitorFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid SLA configuration: %v", err)
+	}
+	go slaMonitor.Run(context.Background())
+
+	r.GET("/attachments/download", controllers.DownloadAttachment)
+	r.GET("/ws", middleware.OptionalAuthMiddleware(), websocket.HandleConnections)
 
 	if err := r.Run(":8080"); err != nil {
 		log.Fatalf("Failed to start the server: %v", err)
 	}
 }
+
+// reloadKeysOnSignal re-reads JWT_KEYS_DIR on SIGHUP so keys can be rotated
+// without restarting the server.
+func reloadKeysOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := config.LoadJWTKeys(); err != nil {
+			log.Printf("Failed to reload JWT signing keys: %v", err)
+			continue
+		}
+		log.Println("JWT signing keys reloaded")
+	}
+}
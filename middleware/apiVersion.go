@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"dtms/problem"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIVersion marks requests to a versioned API. Handlers shared with the
+// legacy routes read it to answer with the versioned status codes.
+func APIVersion(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("api_version", version)
+		c.Next()
+	}
+}
+
+// Deprecated marks the responses of legacy routes as deprecated (RFC 9745)
+// and links to the routes that replace them.
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		c.Next()
+	}
+}
+
+// NumericIDs answers 404 for paths whose parameters are not positive
+// integers, so that handlers only look up well-formed IDs.
+func NumericIDs() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, param := range c.Params {
+			if id, err := strconv.ParseUint(param.Value, 10, 64); err != nil || id == 0 {
+				problem.Respond(c, http.StatusNotFound, "not_found", "Not found")
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -3,51 +3,114 @@ package middleware
 import (
 	"dtms/config"
 	"dtms/models"
-	"fmt"
+	"dtms/problem"
 	"net/http"
-	"os"
+	"strings"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 )
 
+// tokenFromRequest prefers an Authorization: Bearer header and falls back to
+// the jwt cookie set by Login.
+func tokenFromRequest(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+
+	tokenString, err := c.Cookie("jwt")
+	if err != nil {
+		return ""
+	}
+	return tokenString
+}
+
+// authenticate resolves the user behind the request's token. On failure it
+// returns the message to report.
+func authenticate(c *gin.Context) (models.User, string) {
+	var user models.User
+
+	tokenString := tokenFromRequest(c)
+	if tokenString == "" {
+		return user, "Authorization token not found"
+	}
+
+	token, err := jwt.Parse(tokenString, config.Keys.Keyfunc)
+
+	if err != nil || !token.Valid {
+		return user, "Invalid or expired token"
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	// Tokens carrying a purpose (such as a pending 2FA challenge) are not
+	// session tokens.
+	if !ok || claims["user_id"] == nil || claims["purpose"] != nil {
+		return user, "Invalid token claims"
+	}
+
+	if err := config.DB.First(&user, "id = ?", claims["user_id"]).Error; err != nil {
+		return user, "User not found"
+	}
+
+	if !user.Active() {
+		return user, "Account is deactivated"
+	}
+
+	// Tokens from before the generation was raised have been revoked.
+	generation, _ := claims["generation"].(float64)
+	if uint(generation) != user.SessionGeneration {
+		return user, "Session has been revoked"
+	}
+
+	return user, ""
+}
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenString, err := c.Cookie("jwt")
-		if err != nil || tokenString == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization token not found"})
+		user, failure := authenticate(c)
+		if failure != "" {
+			problem.Respond(c, http.StatusUnauthorized, "unauthorized", failure)
 			c.Abort()
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
+		c.Set("user", user)
+		c.Next()
+	}
+}
 
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
-			c.Abort()
-			return
+// OptionalAuthMiddleware sets the user when the request carries a valid token
+// and lets anonymous requests through.
+func OptionalAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if user, failure := authenticate(c); failure == "" {
+			c.Set("user", user)
 		}
+		c.Next()
+	}
+}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || claims["user_id"] == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
-			c.Abort()
+// RequireTwoFactor blocks users whose organization enforces 2FA until they
+// have enrolled. It must run after AuthMiddleware.
+func RequireTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(models.User)
+		if user.TwoFactorEnabled || user.OrganizationID == nil {
+			c.Next()
 			return
 		}
 
-		var user models.User
-		if err := config.DB.First(&user, "id = ?", claims["user_id"]).Error; err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		var org models.Organization
+		if err := config.DB.First(&org, *user.OrganizationID).Error; err == nil && org.RequireTwoFactor {
+			problem.Respond(c, http.StatusForbidden, "two_factor_required", "Two-factor authentication is required by your organization")
 			c.Abort()
 			return
 		}
 
-		c.Set("user", user)
 		c.Next()
 	}
 }
@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"dtms/config"
+	"dtms/models"
+	"dtms/problem"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+	defaultIdempotencyWindow = 24 * time.Hour
+	maxIdempotentFormMemory  = 32 << 20
+)
+
+var idempotencyKeyPattern = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// idempotencyWindow is IDEMPOTENCY_WINDOW, a duration such as "12h",
+// default 24 hours.
+func idempotencyWindow() time.Duration {
+	if value, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_WINDOW")); err == nil && value > 0 {
+		return value
+	}
+	return defaultIdempotencyWindow
+}
+
+// recordingWriter keeps a copy of the response body.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotent makes a route safe to retry. The first response to a request
+// with an Idempotency-Key header is stored for IDEMPOTENCY_WINDOW and
+// replayed for later requests with the same key, which are not handled
+// again. Reusing a key for a different request answers 422, and a repeat
+// that arrives while the first is still running answers 409. Server errors
+// are not stored, so the request can be retried. It runs after
+// authentication: keys belong to the user.
+func Idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if !idempotencyKeyPattern.MatchString(key) {
+			problem.Respond(c, http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key must be 1 to 255 printable ASCII characters")
+			return
+		}
+
+		hash, err := requestHash(c)
+		if err != nil {
+			problem.Respond(c, http.StatusBadRequest, "invalid_input", "Failed to read the request body")
+			return
+		}
+
+		var userID uint
+		if user, ok := c.Get("user"); ok {
+			userID = user.(models.User).ID
+		}
+
+		now := time.Now()
+		record := models.IdempotencyKey{
+			UserID:      userID,
+			Key:         key,
+			RequestHash: hash,
+			ExpiresAt:   now.Add(idempotencyWindow()),
+		}
+		config.DB.Where("expires_at < ?", now).Delete(&models.IdempotencyKey{})
+
+		// The unique index settles a race between two requests with a new key:
+		// the one that loses sees the other's record.
+		var existing models.IdempotencyKey
+		owner := map[string]interface{}{"user_id": userID, "key": key}
+		if config.DB.Where(owner).Limit(1).Find(&existing).RowsAffected > 0 {
+			replayIdempotent(c, existing, hash)
+			return
+		}
+		if err := config.DB.Create(&record).Error; err != nil {
+			if err := config.DB.Where(owner).First(&existing).Error; err != nil {
+				problem.Internal(c, "Failed to store the idempotency key", err)
+				return
+			}
+			replayIdempotent(c, existing, hash)
+			return
+		}
+
+		// Until the response is stored, a failure releases the key so that
+		// the request can be retried.
+		stored := false
+		defer func() {
+			if !stored {
+				config.DB.Delete(&record)
+			}
+		}()
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		status := writer.Status()
+		if status >= http.StatusInternalServerError {
+			return
+		}
+		header := writer.Header()
+		err = config.DB.Model(&record).Updates(models.IdempotencyKey{
+			StatusCode:  status,
+			ContentType: header.Get("Content-Type"),
+			Location:    header.Get("Location"),
+			ETag:        header.Get("ETag"),
+			Body:        writer.body.Bytes(),
+		}).Error
+		if err != nil {
+			log.Printf("request %s: failed to store the response for idempotency key %q: %v", c.GetString("request_id"), key, err)
+			return
+		}
+		stored = true
+	}
+}
+
+// replayIdempotent answers a repeated key with the stored response.
+func replayIdempotent(c *gin.Context, record models.IdempotencyKey, hash string) {
+	switch {
+	case record.RequestHash != hash:
+		problem.Respond(c, http.StatusUnprocessableEntity, "idempotency_key_mismatch",
+			"This Idempotency-Key was already used for a different request")
+	case record.StatusCode == 0:
+		c.Header("Retry-After", "1")
+		problem.Respond(c, http.StatusConflict, "idempotency_key_in_use",
+			"A request with this Idempotency-Key is still being processed")
+	default:
+		for name, value := range map[string]string{"Location": record.Location, "ETag": record.ETag} {
+			if value != "" {
+				c.Header(name, value)
+			}
+		}
+		c.Header(IdempotencyReplayedHeader, "true")
+		c.Data(record.StatusCode, record.ContentType, record.Body)
+		c.Abort()
+	}
+}
+
+// requestHash fingerprints the method, path, query and body of a request
+// and leaves the body readable for the handler. Multipart forms are hashed
+// by their fields and files, since their boundaries change between retries.
+func requestHash(c *gin.Context) (string, error) {
+	sum := sha256.New()
+	io.WriteString(sum, c.Request.Method+" "+c.Request.URL.Path+"?"+c.Request.URL.Query().Encode()+"\n")
+
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		if err := c.Request.ParseMultipartForm(maxIdempotentFormMemory); err != nil {
+			return "", err
+		}
+		form := c.Request.MultipartForm
+		for _, name := range sortedKeys(form.Value) {
+			for _, value := range form.Value[name] {
+				io.WriteString(sum, "field "+name+"="+value+"\n")
+			}
+		}
+		for _, name := range sortedKeys(form.File) {
+			for _, header := range form.File[name] {
+				file, err := header.Open()
+				if err != nil {
+					return "", err
+				}
+				io.WriteString(sum, "file "+name+"="+header.Filename+"\n")
+				_, err = io.Copy(sum, file)
+				file.Close()
+				if err != nil {
+					return "", err
+				}
+			}
+		}
+		return hex.EncodeToString(sum.Sum(nil)), nil
+	}
+
+	if c.Request.Body != nil {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return "", err
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		sum.Write(body)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"dtms/models"
+	"dtms/problem"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole allows the request through only if the authenticated user has
+// one of roles. It must run after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(models.User)
+		for _, role := range roles {
+			if user.Role == role {
+				c.Next()
+				return
+			}
+		}
+
+		problem.Respond(c, http.StatusForbidden, "insufficient_permissions", "Insufficient permissions")
+		c.Abort()
+	}
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Blob is stored file content, identified by its SHA-256 hash so that
+// identical uploads are kept once.
+type Blob struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SHA256      string    `gorm:"column:sha256;uniqueIndex" json:"sha256"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	StorageKey  string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Attachment is a file attached to a task.
+type Attachment struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	TaskID     uint      `gorm:"index" json:"task_id"`
+	BlobID     uint      `gorm:"index" json:"-"`
+	Blob       *Blob     `json:"blob,omitempty"`
+	FileName   string    `json:"file_name"`
+	UploaderID uint      `json:"uploader_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
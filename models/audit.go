@@ -0,0 +1,86 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	AuditLoginLockout = "login_lockout"
+	AuditLoginUnlock  = "login_unlock"
+	AuditLogin        = "login"
+	AuditLoginFailed  = "login_failed"
+	AuditTaskCreated  = "task_created"
+	AuditTaskUpdated  = "task_updated"
+	AuditTaskAssigned = "task_assigned"
+	AuditTaskDeleted  = "task_deleted"
+)
+
+var ErrAuditImmutable = errors.New("audit events cannot be changed or deleted")
+
+// AuditEvent records a security relevant action or a change to a task.
+// ActorID is the user who performed it, when known, and RequestID ties it to
+// the request's X-Request-ID. Events are written once and never changed.
+type AuditEvent struct {
+	ID        uint         `gorm:"primaryKey" json:"id"`
+	Action    string       `gorm:"index" json:"action"`
+	ActorID   *uint        `gorm:"index" json:"actor_id"`
+	Subject   string       `json:"subject"`
+	TaskID    *uint        `gorm:"index" json:"task_id"`
+	IP        string       `json:"ip"`
+	RequestID string       `gorm:"index" json:"request_id"`
+	Details   string       `json:"details"`
+	Changes   FieldChanges `gorm:"type:text" json:"changes,omitempty"`
+	CreatedAt time.Time    `gorm:"index" json:"created_at"`
+}
+
+func (AuditEvent) BeforeUpdate(*gorm.DB) error {
+	return ErrAuditImmutable
+}
+
+func (AuditEvent) BeforeDelete(*gorm.DB) error {
+	return ErrAuditImmutable
+}
+
+// FieldChange is the value of one field before and after a change.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// FieldChanges is stored as a JSON array in a text column.
+type FieldChanges []FieldChange
+
+func (c FieldChanges) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal([]FieldChange(c))
+	return string(data), err
+}
+
+func (c *FieldChanges) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into FieldChanges", value)
+	}
+	if len(data) == 0 {
+		*c = nil
+		return nil
+	}
+	return json.Unmarshal(data, (*[]FieldChange)(c))
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// ChecklistItem is one step of a task's checklist. Items are ordered by
+// Position, counting from 0.
+type ChecklistItem struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	TaskID    uint       `gorm:"index" json:"task_id"`
+	Position  int        `json:"position"`
+	Text      string     `json:"text"`
+	Done      bool       `json:"done"`
+	DoneAt    *time.Time `json:"done_at"`
+	DoneByID  *uint      `json:"done_by_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
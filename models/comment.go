@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Comment is a markdown comment on a task. Replies point to the comment
+// they answer through ParentID. Deleted comments keep their place in the
+// thread with an empty body.
+type Comment struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	TaskID    uint       `gorm:"index" json:"task_id"`
+	ParentID  *uint      `gorm:"index" json:"parent_id"`
+	AuthorID  uint       `json:"author_id"`
+	Author    *User      `json:"author,omitempty" gorm:"foreignKey:AuthorID"`
+	Body      string     `json:"body"`
+	Mentions  []User     `json:"mentions" gorm:"many2many:comment_mentions"`
+	Replies   []Comment  `json:"replies,omitempty" gorm:"foreignKey:ParentID"`
+	EditedAt  *time.Time `json:"edited_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+const (
+	CommentEdited  = "edited"
+	CommentDeleted = "deleted"
+)
+
+// CommentRevision keeps the body a comment had before an edit or deletion.
+type CommentRevision struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CommentID uint      `gorm:"index" json:"comment_id"`
+	Action    string    `json:"action"`
+	Body      string    `json:"body"`
+	EditorID  uint      `json:"editor_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+const (
+	FieldTypeText   = "text"
+	FieldTypeNumber = "number"
+	FieldTypeDate   = "date"
+	FieldTypeEnum   = "enum"
+	FieldTypeUser   = "user"
+)
+
+var FieldTypes = []string{FieldTypeText, FieldTypeNumber, FieldTypeDate, FieldTypeEnum, FieldTypeUser}
+
+// CustomField defines an extra field for the tasks of one project. Values
+// are kept in Task.CustomFields under Key: text and enum values as strings,
+// numbers as numbers, dates as YYYY-MM-DD and users as user IDs.
+type CustomField struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Project   string     `json:"project" gorm:"uniqueIndex:idx_custom_field_key"`
+	Key       string     `json:"key" gorm:"uniqueIndex:idx_custom_field_key"`
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Options   StringList `json:"options" gorm:"type:text"`
+	Required  bool       `json:"required"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
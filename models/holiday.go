@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Holiday is a non-working date. Holidays without a UserID apply to
+// everyone; the others are personal time off.
+type Holiday struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Date      string    `gorm:"index" json:"date"`
+	Name      string    `json:"name"`
+	UserID    *uint     `gorm:"index" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// IdempotencyKey holds the first response to a request sent with an
+// Idempotency-Key header, so that a retry gets the same answer instead of
+// repeating the change. Keys belong to the user who sent them.
+type IdempotencyKey struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	UserID uint   `gorm:"uniqueIndex:idx_idempotency_user_key" json:"user_id"`
+	Key    string `gorm:"uniqueIndex:idx_idempotency_user_key" json:"key"`
+	// RequestHash fingerprints the method, path, query and body, so that a
+	// key cannot be reused for a different request.
+	RequestHash string `json:"request_hash"`
+	// StatusCode is 0 while the first request is still being handled.
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type"`
+	Location    string    `json:"location"`
+	ETag        string    `json:"etag"`
+	Body        []byte    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at" gorm:"index"`
+}
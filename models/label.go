@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Label tags tasks across projects. Names are unique regardless of case,
+// which the NOCASE index enforces.
+type Label struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Name        string    `json:"name" gorm:"uniqueIndex:idx_labels_name_nocase,collate:NOCASE"`
+	Color       string    `json:"color"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// LoginThrottle tracks failed logins for one key: an email address, a client
+// IP or a user completing a 2FA challenge.
+type LoginThrottle struct {
+	Key            string     `gorm:"primaryKey" json:"key"`
+	Failures       int        `json:"failures"`
+	LastFailureAt  time.Time  `json:"last_failure_at"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LockedUntil    *time.Time `json:"locked_until"`
+	LockoutsIssued int        `json:"lockouts_issued"`
+}
@@ -0,0 +1,32 @@
+package models
+
+// All lists every model that has a table, for migrations. Add new models
+// here so that the server and the tests migrate the same schema.
+func All() []interface{} {
+	return []interface{}{
+		&User{},
+		&Task{},
+		&UserToken{},
+		&Organization{},
+		&RecoveryCode{},
+		&LoginThrottle{},
+		&AuditEvent{},
+		&Team{},
+		&Notification{},
+		&Holiday{},
+		&TaskReminder{},
+		&SLAPolicy{},
+		&SLAEscalationStep{},
+		&TaskSLA{},
+		&SLAEscalation{},
+		&SLABreach{},
+		&Comment{},
+		&CommentRevision{},
+		&Blob{},
+		&Attachment{},
+		&CustomField{},
+		&Label{},
+		&ChecklistItem{},
+		&IdempotencyKey{},
+	}
+}
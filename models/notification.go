@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Notification is a message for one user, kept so that users who were
+// offline when it was pushed over the WebSocket can still read it.
+type Notification struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"index" json:"user_id"`
+	Event     string     `json:"event"`
+	Message   string     `json:"message"`
+	TaskID    *uint      `json:"task_id"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
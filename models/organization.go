@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+type Organization struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	Name             string    `json:"name"`
+	RequireTwoFactor bool      `json:"require_two_factor"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
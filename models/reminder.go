@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+const (
+	ReminderUpcoming = "upcoming"
+	ReminderOverdue  = "overdue"
+)
+
+// TaskReminder records a reminder sent over one channel, so that it is not
+// sent again, even after a restart. DueAt is part of the key: moving a
+// task's planned end makes its reminders due again. SentAt is nil while the
+// reminder is being sent.
+type TaskReminder struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	TaskID        uint       `gorm:"uniqueIndex:idx_task_reminder" json:"task_id"`
+	Kind          string     `gorm:"uniqueIndex:idx_task_reminder" json:"kind"`
+	OffsetSeconds int64      `gorm:"uniqueIndex:idx_task_reminder" json:"offset_seconds"`
+	DueAt         time.Time  `gorm:"uniqueIndex:idx_task_reminder" json:"due_at"`
+	Channel       string     `gorm:"uniqueIndex:idx_task_reminder" json:"channel"`
+	SentAt        *time.Time `json:"sent_at"`
+}
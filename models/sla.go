@@ -0,0 +1,75 @@
+package models
+
+import "time"
+
+const (
+	SLATargetResponse   = "response"
+	SLATargetResolution = "resolution"
+)
+
+// SLAPolicy sets response and resolution targets for tasks. Empty Priority
+// or Project match any task; the most specific matching policy applies.
+type SLAPolicy struct {
+	ID                uint                `gorm:"primaryKey" json:"id"`
+	Name              string              `json:"name"`
+	Priority          string              `json:"priority"`
+	Project           string              `json:"project"`
+	ResponseMinutes   int64               `json:"response_minutes"`
+	ResolutionMinutes int64               `json:"resolution_minutes"`
+	Escalations       []SLAEscalationStep `json:"escalations" gorm:"foreignKey:PolicyID;constraint:OnDelete:CASCADE"`
+	CreatedAt         time.Time           `json:"created_at"`
+	UpdatedAt         time.Time           `json:"updated_at"`
+}
+
+// SLAEscalationStep notifies a user, a team or everyone with a role once
+// ThresholdPercent of a target's time has elapsed. Steps over 100 keep
+// escalating after the breach.
+type SLAEscalationStep struct {
+	ID               uint   `gorm:"primaryKey" json:"id"`
+	PolicyID         uint   `gorm:"index" json:"policy_id"`
+	Target           string `json:"target"`
+	ThresholdPercent int    `json:"threshold_percent"`
+	UserID           *uint  `json:"user_id"`
+	TeamID           *uint  `json:"team_id"`
+	Role             string `json:"role"`
+}
+
+// TaskSLA is the SLA clock of one task. Time spent blocked is excluded:
+// PausedAt marks a running pause and PausedSeconds sums the finished ones.
+// ResponseSeconds and ResolutionSeconds freeze the clock when a target is
+// met.
+type TaskSLA struct {
+	TaskID               uint       `gorm:"primaryKey" json:"task_id"`
+	PolicyID             uint       `json:"policy_id"`
+	StartedAt            time.Time  `json:"started_at"`
+	PausedAt             *time.Time `json:"paused_at"`
+	PausedSeconds        int64      `json:"paused_seconds"`
+	RespondedAt          *time.Time `json:"responded_at"`
+	ResponseSeconds      int64      `json:"response_seconds"`
+	ResolvedAt           *time.Time `json:"resolved_at"`
+	ResolutionSeconds    int64      `json:"resolution_seconds"`
+	ResponseBreachedAt   *time.Time `json:"response_breached_at"`
+	ResolutionBreachedAt *time.Time `json:"resolution_breached_at"`
+}
+
+// SLAEscalation records that a step fired for a task, so that it fires once.
+type SLAEscalation struct {
+	ID      uint      `gorm:"primaryKey" json:"id"`
+	TaskID  uint      `gorm:"uniqueIndex:idx_sla_escalation" json:"task_id"`
+	StepID  uint      `gorm:"uniqueIndex:idx_sla_escalation" json:"step_id"`
+	FiredAt time.Time `json:"fired_at"`
+}
+
+// SLABreach is a missed target, kept for reporting.
+type SLABreach struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	TaskID         uint      `gorm:"index" json:"task_id"`
+	PolicyID       uint      `gorm:"index" json:"policy_id"`
+	Target         string    `json:"target"`
+	Priority       string    `json:"priority"`
+	Project        string    `json:"project"`
+	AssignedTo     *uint     `json:"assigned_to"`
+	TargetSeconds  int64     `json:"target_seconds"`
+	ElapsedSeconds int64     `json:"elapsed_seconds"`
+	BreachedAt     time.Time `json:"breached_at"`
+}
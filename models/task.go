@@ -6,15 +6,51 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	TaskStatusOpen       = "open"
+	TaskStatusInProgress = "in_progress"
+	TaskStatusBlocked    = "blocked"
+	TaskStatusDone       = "done"
+)
+
+var TaskStatuses = []string{TaskStatusOpen, TaskStatusInProgress, TaskStatusBlocked, TaskStatusDone}
+
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+var Priorities = []string{PriorityLow, PriorityNormal, PriorityHigh, PriorityUrgent}
+
 type Task struct {
 	gorm.Model
-	Title            string    `json:"title"`
-	Description      string    `json:"description"`
-	AssignedTo       *uint     `json:"assigned_to"`
-	User             *User     `json:"user" gorm:"foreignKey:AssignedTo"`
-	PlannedStartTime time.Time `json:"planned_start_time"`
-	PlannedEndTime   time.Time `json:"planned_end_time"`
-	ActualStartTime  time.Time `json:"actual_start_time"`
-	ActualEndTime    time.Time `json:"actual_end_time"`
-	Seconds          int64     `json:"seconds"`
+	Title            string          `json:"title"`
+	Description      string          `json:"description"`
+	AssignedTo       *uint           `json:"assigned_to"`
+	User             *User           `json:"user" gorm:"foreignKey:AssignedTo"`
+	TeamID           *uint           `json:"team_id"`
+	Team             *Team           `json:"team,omitempty" gorm:"foreignKey:TeamID"`
+	Assignees        []User          `json:"assignees" gorm:"many2many:task_assignees"`
+	Reviewers        []User          `json:"reviewers" gorm:"many2many:task_reviewers"`
+	PlannedStartTime time.Time       `json:"planned_start_time"`
+	PlannedEndTime   time.Time       `json:"planned_end_time" gorm:"index"`
+	ActualStartTime  time.Time       `json:"actual_start_time"`
+	ActualEndTime    time.Time       `json:"actual_end_time"`
+	Seconds          int64           `json:"seconds"`
+	RequiredSkills   StringList      `json:"required_skills" gorm:"type:text"`
+	Status           string          `json:"status" gorm:"default:open"`
+	Priority         string          `json:"priority" gorm:"default:normal"`
+	Project          string          `json:"project" gorm:"index"`
+	ParentID         *uint           `json:"parent_id" gorm:"index"`
+	Children         []Task          `json:"children,omitempty" gorm:"foreignKey:ParentID"`
+	RollupSeconds    int64           `json:"rollup_seconds"`
+	Progress         float64         `json:"progress"`
+	CustomFields     FieldValues     `json:"custom_fields" gorm:"type:text"`
+	Labels           []Label         `json:"labels" gorm:"many2many:task_labels"`
+	Checklist        []ChecklistItem `json:"checklist,omitempty" gorm:"foreignKey:TaskID"`
+	// Version counts the changes to the task. Updates must name the version
+	// they were based on, so that concurrent edits are detected.
+	Version uint `json:"version" gorm:"not null;default:1"`
 }
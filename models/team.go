@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+type Team struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Members     []User    `json:"members" gorm:"many2many:team_members"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
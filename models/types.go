@@ -0,0 +1,81 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// StringList is a list of strings stored as a JSON array in a text column.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]string(l))
+	return string(data), err
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into StringList", value)
+	}
+	if len(data) == 0 {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// Contains reports whether value is in the list, ignoring case.
+func (l StringList) Contains(value string) bool {
+	for _, item := range l {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldValues holds a task's custom field values by field key, stored as a
+// JSON object in a text column.
+type FieldValues map[string]interface{}
+
+func (v FieldValues) Value() (driver.Value, error) {
+	if v == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(map[string]interface{}(v))
+	return string(data), err
+}
+
+func (v *FieldValues) Scan(value interface{}) error {
+	var data []byte
+	switch raw := value.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		data = []byte(raw)
+	case []byte:
+		data = raw
+	default:
+		return fmt.Errorf("cannot scan %T into FieldValues", value)
+	}
+	if len(data) == 0 {
+		*v = nil
+		return nil
+	}
+	return json.Unmarshal(data, (*map[string]interface{})(v))
+}
@@ -1,8 +1,51 @@
 package models
 
+import "time"
+
+const (
+	RoleAdmin   = "admin"
+	RoleManager = "manager"
+	RoleMember  = "member"
+)
+
+// Roles lists every role from most to least privileged.
+var Roles = []string{RoleAdmin, RoleManager, RoleMember}
+
 type User struct {
-	ID       uint   `gorm:"primaryKey"`
-	Username string `json:"name"`
-	Email    string `json:"email"`
-	Password string `json:"-"`
+	ID               uint       `gorm:"primaryKey"`
+	Username         string     `json:"name"`
+	Email            string     `json:"email"`
+	Password         string     `json:"-"`
+	Role             string     `json:"role" gorm:"default:member"`
+	OrganizationID   *uint      `json:"organization_id"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at"`
+	DeactivatedAt    *time.Time `json:"deactivated_at"`
+	Skills           StringList `json:"skills" gorm:"type:text"`
+	WorkStart        string     `json:"work_start" gorm:"default:09:00"`
+	WorkEnd          string     `json:"work_end" gorm:"default:17:00"`
+	WorkDays         string     `json:"work_days" gorm:"default:1,2,3,4,5"`
+	TimeZone         string     `json:"time_zone" gorm:"default:UTC"`
+	LastAssignedAt   *time.Time `json:"-"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	TOTPSecret       string     `json:"-"`
+	TOTPLastStep     int64      `json:"-"`
+	OIDCIssuer       string     `json:"-" gorm:"column:oidc_issuer;index:idx_users_oidc"`
+	OIDCSubject      string     `json:"-" gorm:"column:oidc_subject;index:idx_users_oidc"`
+	// SessionGeneration is signed into session tokens; raising it revokes
+	// every session issued before, e.g. after a password reset.
+	SessionGeneration uint `json:"-" gorm:"not null;default:0"`
+}
+
+func (u User) Active() bool {
+	return u.DeactivatedAt == nil
+}
+
+// RecoveryCode is a single-use fallback for a lost authenticator. Only the
+// SHA-256 hash is stored.
+type RecoveryCode struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    uint `gorm:"index"`
+	CodeHash  string
+	UsedAt    *time.Time
+	CreatedAt time.Time
 }
@@ -0,0 +1,266 @@
+// Package problem writes error responses as RFC 7807 problem documents
+// (application/problem+json). Every problem carries a stable, machine-readable
+// code, the request ID and, for invalid input, one entry per bad field.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+const ContentType = "application/problem+json"
+
+// Codes used by the helpers below. Handlers pass their own codes, such as
+// "task_not_found", to Respond.
+const (
+	CodeInvalidInput     = "invalid_input"
+	CodeValidationFailed = "validation_failed"
+	CodeNotFound         = "not_found"
+	CodeInternal         = "internal_error"
+)
+
+// FieldError describes one invalid field of a request. Validators return
+// it as an error so handlers can report the field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Message
+}
+
+// Errors reports several invalid fields as one error.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, field := range e {
+		messages[i] = field.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Problem is an RFC 7807 problem document with the extension members code,
+// request_id and errors. Error repeats Detail for clients written against
+// the old {"error": "..."} responses.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Error     string       `json:"error"`
+}
+
+// New builds the problem for the current request.
+func New(c *gin.Context, status int, code, detail string) Problem {
+	return Problem{
+		Type:      "/problems/" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  c.Request.URL.Path,
+		Code:      code,
+		RequestID: c.GetString("request_id"),
+		Error:     detail,
+	}
+}
+
+// Write sends p and aborts the request. Members of extra, such as the IDs
+// that were not found, are added to the document.
+func Write(c *gin.Context, p Problem, extra ...gin.H) {
+	body := gin.H{}
+	data, _ := json.Marshal(p)
+	json.Unmarshal(data, &body)
+	for _, members := range extra {
+		for name, value := range members {
+			body[name] = value
+		}
+	}
+
+	c.Header("Content-Type", ContentType)
+	c.AbortWithStatusJSON(p.Status, body)
+}
+
+// Respond sends a problem with the given status, code and detail.
+func Respond(c *gin.Context, status int, code, detail string, extra ...gin.H) {
+	Write(c, New(c, status, code, detail), extra...)
+}
+
+// Internal sends a 500 with a generic detail. The cause is logged with the
+// request ID instead of being shown to the client.
+func Internal(c *gin.Context, detail string, err error) {
+	if err != nil {
+		log.Printf("request %s: %s: %v", c.GetString("request_id"), detail, err)
+	}
+	Respond(c, http.StatusInternalServerError, CodeInternal, detail)
+}
+
+// Invalid sends a 400 listing the fields that failed validation.
+func Invalid(c *gin.Context, detail string, fields ...FieldError) {
+	p := New(c, http.StatusBadRequest, CodeValidationFailed, detail)
+	p.Errors = fields
+	Write(c, p)
+}
+
+// Validation sends a 400 for an error from a validator, listing its fields
+// when it is a FieldError or Errors.
+func Validation(c *gin.Context, err error) {
+	Invalid(c, err.Error(), FieldErrors(err)...)
+}
+
+// Bind sends a 400 for an error from binding a request. Validation failures
+// and fields of the wrong type are listed by their JSON names.
+func Bind(c *gin.Context, err error) {
+	if fields := FieldErrors(err); len(fields) > 0 {
+		Invalid(c, "Invalid input", fields...)
+		return
+	}
+	p := New(c, http.StatusBadRequest, CodeInvalidInput, "Invalid input")
+	var syntax *json.SyntaxError
+	switch {
+	case errors.Is(err, io.EOF):
+		p.Detail = "Invalid input: the request body is empty"
+	case errors.As(err, &syntax):
+		p.Detail = "Invalid input: the request body is not valid JSON"
+	case err != nil:
+		p.Detail = "Invalid input: " + err.Error()
+	}
+	p.Error = p.Detail
+	Write(c, p)
+}
+
+// FieldErrors lists the fields behind a binding error, if it names any.
+func FieldErrors(err error) []FieldError {
+	var validation validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	var field FieldError
+	var list Errors
+	switch {
+	case errors.As(err, &list):
+		return list
+	case errors.As(err, &field):
+		return []FieldError{field}
+	case errors.As(err, &validation):
+		fields := make([]FieldError, 0, len(validation))
+		for _, fe := range validation {
+			fields = append(fields, FieldError{
+				Field:   fieldPath(fe),
+				Code:    fe.Tag(),
+				Message: validationMessage(fe),
+			})
+		}
+		return fields
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return []FieldError{{
+			Field:   typeErr.Field,
+			Code:    "invalid_type",
+			Message: fmt.Sprintf("must be a %s", jsonType(typeErr.Type)),
+		}}
+	}
+	return nil
+}
+
+// fieldPath is the JSON path of a failed field without the struct name,
+// e.g. "assignees[0]".
+func fieldPath(fe validator.FieldError) string {
+	namespace := fe.Namespace()
+	if i := strings.Index(namespace, "."); i >= 0 {
+		return namespace[i+1:]
+	}
+	return fe.Field()
+}
+
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be an email address"
+	case "min":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at least %s characters", fe.Param())
+		}
+		return "must be at least " + fe.Param()
+	case "max":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at most %s characters", fe.Param())
+		}
+		return "must be at most " + fe.Param()
+	case "oneof":
+		return "must be one of " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "gte":
+		return "must be at least " + fe.Param()
+	case "lte":
+		return "must be at most " + fe.Param()
+	case "eqfield":
+		return "must match " + fe.Param()
+	}
+	return fmt.Sprintf("failed the %q check", fe.Tag())
+}
+
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "whole number"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "non-negative whole number"
+	}
+	return "number"
+}
+
+// NotFound answers requests for unknown routes.
+func NotFound(c *gin.Context) {
+	Respond(c, http.StatusNotFound, CodeNotFound, "Not found")
+}
+
+// MethodNotAllowed answers requests with a method the route does not take.
+func MethodNotAllowed(c *gin.Context) {
+	Respond(c, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
+
+// Recover turns a panic in a handler into a 500 problem.
+func Recover(c *gin.Context, recovered interface{}) {
+	Internal(c, "Internal server error", fmt.Errorf("panic: %v", recovered))
+}
+
+func init() {
+	// Report fields by their JSON names rather than their Go names.
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			for _, tag := range []string{"json", "form"} {
+				name := strings.Split(field.Tag.Get(tag), ",")[0]
+				if name == "-" {
+					return ""
+				}
+				if name != "" {
+					return name
+				}
+			}
+			return field.Name
+		})
+	}
+}
@@ -1,11 +1,12 @@
 package routes
 
 import (
+	"dtms/middleware"
 	"dtms/websocket"
 
 	"github.com/gin-gonic/gin"
 )
 
 func WebSocketRoutes(r *gin.Engine) {
-	r.GET("/ws", websocket.HandleConnections)
+	r.GET("/ws", middleware.OptionalAuthMiddleware(), websocket.HandleConnections)
 }
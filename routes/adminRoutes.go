@@ -0,0 +1,25 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+	"dtms/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupAdminRoutes(r *gin.Engine) {
+	admin := r.Group("/admin", middleware.AuthMiddleware(), middleware.RequireTwoFactor(), middleware.RequireRole(models.RoleAdmin))
+	{
+		admin.GET("/organizations", controllers.GetOrganizations)
+		admin.POST("/organizations", controllers.CreateOrganization)
+		admin.PUT("/organizations", controllers.UpdateOrganization)
+		admin.PUT("/organizations/members", controllers.AddOrganizationMember)
+		admin.PUT("/users/deactivate", controllers.DeactivateUser)
+		admin.PUT("/users/activate", controllers.ActivateUser)
+		admin.PUT("/users/role", controllers.SetUserRole)
+		admin.GET("/lockouts", controllers.GetLoginLockouts)
+		admin.POST("/lockouts/unlock", controllers.UnlockLogin)
+		admin.GET("/audit", controllers.GetAuditEvents)
+	}
+}
@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupAPIRoutes registers the versioned task resources under /api/v1. They
+// share their handlers with the legacy /task routes.
+func SetupAPIRoutes(r *gin.Engine) {
+	v1 := r.Group("/api/v1", middleware.AuthMiddleware(), middleware.RequireTwoFactor(), middleware.APIVersion("v1"), middleware.NumericIDs())
+
+	tasks := v1.Group("/tasks")
+	{
+		tasks.GET("", controllers.GetTasks)
+		tasks.POST("", middleware.Idempotent(), controllers.CreateTask)
+		tasks.POST("/bulk", middleware.Idempotent(), controllers.CreateTaskBulk)
+		tasks.POST("/batch", middleware.Idempotent(), controllers.BatchTasks)
+		tasks.GET("/export", controllers.ExportTasks)
+		tasks.GET("/overdue", controllers.GetOverdueReport)
+		tasks.GET("/tree", controllers.GetTaskTree)
+		tasks.PUT("/labels", controllers.UpdateTaskLabels)
+
+		tasks.GET("/:task_id", controllers.GetTask)
+		tasks.PUT("/:task_id", controllers.UpdateTask)
+		tasks.PATCH("/:task_id", controllers.PatchTask)
+		tasks.DELETE("/:task_id", middleware.Idempotent(), controllers.DeleteTask)
+
+		tasks.PUT("/:task_id/assignee", middleware.Idempotent(), controllers.AssignTask)
+		tasks.PUT("/:task_id/team", middleware.Idempotent(), controllers.AssignTaskToTeam)
+		tasks.POST("/:task_id/auto-assign", middleware.Idempotent(), controllers.AutoAssignTask)
+		tasks.PUT("/:task_id/participants", controllers.SetTaskParticipants)
+		tasks.POST("/:task_id/claim", controllers.ClaimTask)
+		tasks.PUT("/:task_id/parent", controllers.SetTaskParent)
+		tasks.GET("/:task_id/tree", controllers.GetTaskTree)
+		tasks.GET("/:task_id/history", controllers.GetTaskHistory)
+		tasks.GET("/:task_id/sla", controllers.GetTaskSLA)
+
+		tasks.GET("/:task_id/checklist", controllers.GetChecklist)
+		tasks.POST("/:task_id/checklist", controllers.AddChecklistItem)
+		tasks.PUT("/:task_id/checklist/:item_id", controllers.UpdateChecklistItem)
+		tasks.DELETE("/:task_id/checklist/:item_id", controllers.DeleteChecklistItem)
+		tasks.POST("/:task_id/checklist/:item_id/convert", controllers.ConvertChecklistItem)
+
+		tasks.GET("/:task_id/comments", controllers.GetComments)
+		tasks.POST("/:task_id/comments", controllers.CreateComment)
+		tasks.PUT("/:task_id/comments/:comment_id", controllers.UpdateComment)
+		tasks.DELETE("/:task_id/comments/:comment_id", controllers.DeleteComment)
+		tasks.GET("/:task_id/comments/:comment_id/history", controllers.GetCommentHistory)
+
+		tasks.GET("/:task_id/attachments", controllers.GetAttachments)
+		tasks.POST("/:task_id/attachments", controllers.UploadAttachment)
+		tasks.DELETE("/:task_id/attachments/:attachment_id", controllers.DeleteAttachment)
+	}
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"dtms/controllers"
+	"dtms/middleware"
 
 	"github.com/gin-gonic/gin"
 )
@@ -11,5 +12,25 @@ func SetupAuthRoutes(r *gin.Engine) {
 	{
 		auth.POST("/register", controllers.Register)
 		auth.POST("/login", controllers.Login)
+		auth.POST("/login/2fa", controllers.LoginTwoFactor)
+		auth.POST("/password/forgot", controllers.RequestPasswordReset)
+		auth.GET("/password/reset", controllers.CheckPasswordResetToken)
+		auth.POST("/password/reset", controllers.ResetPassword)
+		auth.POST("/verify-email/request", controllers.RequestEmailVerification)
+		auth.GET("/verify-email", controllers.VerifyEmail)
+		auth.POST("/verify-email", controllers.VerifyEmail)
+		auth.GET("/oidc/login", controllers.OIDCLogin)
+		auth.GET("/oidc/callback", controllers.OIDCCallback)
 	}
+
+	twoFactor := r.Group("/auth/2fa", middleware.AuthMiddleware())
+	{
+		twoFactor.GET("/", controllers.GetTwoFactorStatus)
+		twoFactor.POST("/enroll", controllers.EnrollTwoFactor)
+		twoFactor.POST("/confirm", controllers.ConfirmTwoFactor)
+		twoFactor.POST("/disable", controllers.DisableTwoFactor)
+		twoFactor.POST("/recovery-codes", controllers.RegenerateRecoveryCodes)
+	}
+
+	r.GET("/.well-known/jwks.json", controllers.JWKS)
 }
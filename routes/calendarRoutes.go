@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupCalendarRoutes(r *gin.Engine) {
+	calendar := r.Group("/calendar", middleware.AuthMiddleware(), middleware.RequireTwoFactor())
+	{
+		calendar.GET("/holidays", controllers.GetHolidays)
+		calendar.POST("/holidays", controllers.CreateHoliday)
+		calendar.DELETE("/holidays", controllers.DeleteHoliday)
+		calendar.GET("/working-time", controllers.GetWorkingTime)
+	}
+}
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+	"dtms/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupLabelRoutes(r *gin.Engine) {
+	labels := r.Group("/labels", middleware.AuthMiddleware(), middleware.RequireTwoFactor())
+	{
+		labels.GET("/", controllers.GetLabels)
+		labels.POST("/", controllers.CreateLabel)
+		labels.GET("/stats", controllers.GetLabelStats)
+
+		manage := labels.Group("", middleware.RequireRole(models.RoleAdmin, models.RoleManager))
+		manage.PUT("/", controllers.UpdateLabel)
+		manage.DELETE("/", controllers.DeleteLabel)
+	}
+}
@@ -0,0 +1,16 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupNotificationRoutes(r *gin.Engine) {
+	notifications := r.Group("/notifications", middleware.AuthMiddleware(), middleware.RequireTwoFactor())
+	{
+		notifications.GET("/", controllers.GetNotifications)
+		notifications.PUT("/read", controllers.MarkNotificationsRead)
+	}
+}
@@ -0,0 +1,21 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+	"dtms/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupProjectRoutes(r *gin.Engine) {
+	projects := r.Group("/projects", middleware.AuthMiddleware(), middleware.RequireTwoFactor())
+	{
+		projects.GET("/fields", controllers.GetCustomFields)
+
+		manage := projects.Group("", middleware.RequireRole(models.RoleAdmin, models.RoleManager))
+		manage.POST("/fields", controllers.CreateCustomField)
+		manage.PUT("/fields", controllers.UpdateCustomField)
+		manage.DELETE("/fields", controllers.DeleteCustomField)
+	}
+}
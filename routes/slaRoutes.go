@@ -0,0 +1,23 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+	"dtms/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupSLARoutes(r *gin.Engine) {
+	sla := r.Group("/sla", middleware.AuthMiddleware(), middleware.RequireTwoFactor())
+	{
+		sla.GET("/policies", controllers.GetSLAPolicies)
+		sla.GET("/task", middleware.Deprecated("/api/v1/tasks/{id}/sla"), controllers.GetTaskSLA)
+
+		manage := sla.Group("", middleware.RequireRole(models.RoleAdmin, models.RoleManager))
+		manage.POST("/policies", controllers.CreateSLAPolicy)
+		manage.PUT("/policies", controllers.UpdateSLAPolicy)
+		manage.DELETE("/policies", controllers.DeleteSLAPolicy)
+		manage.GET("/breaches", controllers.GetSLABreaches)
+	}
+}
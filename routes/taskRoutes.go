@@ -7,14 +7,40 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// SetupTaskRoutes registers the legacy task routes, which take IDs in the
+// query string or body. They are deprecated in favor of /api/v1/tasks.
 func SetupTaskRoutes(r *gin.Engine) {
-	tasks := r.Group("/task", middleware.AuthMiddleware())
+	tasks := r.Group("/task", middleware.AuthMiddleware(), middleware.RequireTwoFactor(), middleware.Deprecated("/api/v1/tasks"))
 	{
-		tasks.POST("/create", controllers.CreateTask)
-		tasks.POST("/bulkupload", controllers.CreateTaskBulk)
+		tasks.POST("/create", middleware.Idempotent(), controllers.CreateTask)
+		tasks.POST("/bulkupload", middleware.Idempotent(), controllers.CreateTaskBulk)
 		tasks.GET("/", controllers.GetTasks)
+		tasks.GET("/export", controllers.ExportTasks)
+		tasks.GET("/overdue", controllers.GetOverdueReport)
 		tasks.PUT("/update", controllers.UpdateTask)
-		tasks.PUT("/assign", controllers.AssignTask)
-		tasks.DELETE("/delete", controllers.DeleteTask)
+		tasks.PATCH("/update", controllers.PatchTask)
+		tasks.PUT("/assign", middleware.Idempotent(), controllers.AssignTask)
+		tasks.PUT("/assign/team", middleware.Idempotent(), controllers.AssignTaskToTeam)
+		tasks.PUT("/assign/auto", middleware.Idempotent(), controllers.AutoAssignTask)
+		tasks.PUT("/participants", controllers.SetTaskParticipants)
+		tasks.PUT("/claim", controllers.ClaimTask)
+		tasks.PUT("/parent", controllers.SetTaskParent)
+		tasks.GET("/tree", controllers.GetTaskTree)
+		tasks.GET("/history", controllers.GetTaskHistory)
+		tasks.PUT("/labels", controllers.UpdateTaskLabels)
+		tasks.GET("/checklist", controllers.GetChecklist)
+		tasks.POST("/checklist", controllers.AddChecklistItem)
+		tasks.PUT("/checklist", controllers.UpdateChecklistItem)
+		tasks.DELETE("/checklist", controllers.DeleteChecklistItem)
+		tasks.POST("/checklist/convert", controllers.ConvertChecklistItem)
+		tasks.GET("/comments", controllers.GetComments)
+		tasks.POST("/comments", controllers.CreateComment)
+		tasks.PUT("/comments", controllers.UpdateComment)
+		tasks.DELETE("/comments", controllers.DeleteComment)
+		tasks.GET("/comments/history", controllers.GetCommentHistory)
+		tasks.GET("/attachments", controllers.GetAttachments)
+		tasks.POST("/attachments", controllers.UploadAttachment)
+		tasks.DELETE("/attachments", controllers.DeleteAttachment)
+		tasks.DELETE("/delete", middleware.Idempotent(), controllers.DeleteTask)
 	}
 }
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+	"dtms/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupTeamRoutes(r *gin.Engine) {
+	teams := r.Group("/teams", middleware.AuthMiddleware(), middleware.RequireTwoFactor())
+	{
+		teams.GET("/", controllers.GetTeams)
+
+		manage := teams.Group("", middleware.RequireRole(models.RoleAdmin, models.RoleManager))
+		manage.POST("/create", controllers.CreateTeam)
+		manage.PUT("/members", controllers.AddTeamMember)
+		manage.DELETE("/members", controllers.RemoveTeamMember)
+		manage.DELETE("/delete", controllers.DeleteTeam)
+	}
+}
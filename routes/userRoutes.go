@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"dtms/controllers"
+	"dtms/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetupUserRoutes(r *gin.Engine) {
+	users := r.Group("/users", middleware.AuthMiddleware(), middleware.RequireTwoFactor())
+	{
+		users.GET("/", controllers.GetUsers)
+		users.GET("/me", controllers.GetProfile)
+		users.PUT("/me", controllers.UpdateProfile)
+		users.PUT("/me/password", controllers.ChangePassword)
+	}
+}
@@ -0,0 +1,176 @@
+// Package schedule does working-time arithmetic over weekly working hours.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Embed the zone database so time zones work in minimal containers.
+	_ "time/tzdata"
+)
+
+const (
+	DefaultStart = "09:00"
+	DefaultEnd   = "17:00"
+	DefaultDays  = "1,2,3,4,5"
+
+	// DateLayout is the format of holiday dates.
+	DateLayout = "2006-01-02"
+
+	// maxSearchDays bounds how far AddWorkingTime looks ahead and how many
+	// days Overlap counts.
+	maxSearchDays = 366 * 5
+)
+
+var ErrNoWorkingTime = errors.New("calendar has no working time")
+
+// WorkingHours is a weekly schedule: the same daily window on each working
+// day, interpreted in Location. Dates in Holidays are skipped entirely.
+type WorkingHours struct {
+	Start    time.Duration
+	End      time.Duration
+	Days     [7]bool
+	Location *time.Location
+	Holidays map[string]bool
+}
+
+// LoadLocation resolves an IANA zone name, treating "" as UTC.
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// Parse builds working hours from "HH:MM" start and end times and a comma
+// separated list of ISO weekdays (1 = Monday ... 7 = Sunday). Empty values
+// fall back to 09:00-17:00, Monday to Friday.
+func Parse(start, end, days string) (WorkingHours, error) {
+	h := WorkingHours{Location: time.UTC}
+	if start == "" {
+		start = DefaultStart
+	}
+	if end == "" {
+		end = DefaultEnd
+	}
+	if days == "" {
+		days = DefaultDays
+	}
+
+	var err error
+	if h.Start, err = parseClock(start); err != nil {
+		return h, err
+	}
+	if h.End, err = parseClock(end); err != nil {
+		return h, err
+	}
+	if h.End <= h.Start {
+		return h, fmt.Errorf("working hours end %s must be after start %s", end, start)
+	}
+
+	for _, field := range strings.Split(days, ",") {
+		day, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || day < 1 || day > 7 {
+			return h, fmt.Errorf("invalid weekday %q: use 1 (Monday) to 7 (Sunday)", field)
+		}
+		h.Days[time.Weekday(day%7)] = true
+	}
+	return h, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: use HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Overlap returns how much working time falls within [from, to). Only the
+// first maxSearchDays days after from are counted, so that a far-off end
+// cannot make it walk the calendar for long.
+func (h WorkingHours) Overlap(from, to time.Time) time.Duration {
+	if !from.Before(to) {
+		return 0
+	}
+	if limit := from.AddDate(0, 0, maxSearchDays); to.After(limit) {
+		to = limit
+	}
+
+	loc := h.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	from, to = from.In(loc), to.In(loc)
+
+	var total time.Duration
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	for day.Before(to) {
+		if h.isWorkingDay(day) {
+			windowStart := clockOn(day, h.Start)
+			windowEnd := clockOn(day, h.End)
+			if windowStart.Before(from) {
+				windowStart = from
+			}
+			if windowEnd.After(to) {
+				windowEnd = to
+			}
+			if windowStart.Before(windowEnd) {
+				total += windowEnd.Sub(windowStart)
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return total
+}
+
+// AddWorkingTime returns the moment at which d of working time has elapsed
+// after from, e.g. the due date of a task that starts at from and takes d.
+func (h WorkingHours) AddWorkingTime(from time.Time, d time.Duration) (time.Time, error) {
+	loc := h.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	from = from.In(loc)
+	if d <= 0 {
+		return from, nil
+	}
+
+	remaining := d
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	for i := 0; i < maxSearchDays; i++ {
+		if h.isWorkingDay(day) {
+			windowStart := clockOn(day, h.Start)
+			windowEnd := clockOn(day, h.End)
+			if windowStart.Before(from) {
+				windowStart = from
+			}
+			if available := windowEnd.Sub(windowStart); available > 0 {
+				if remaining <= available {
+					return windowStart.Add(remaining), nil
+				}
+				remaining -= available
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}, ErrNoWorkingTime
+}
+
+func (h WorkingHours) isWorkingDay(day time.Time) bool {
+	return h.Days[day.Weekday()] && !h.Holidays[day.Format(DateLayout)]
+}
+
+// clockOn returns the wall clock time offset after midnight of day, which
+// stays correct across daylight saving changes.
+func clockOn(day time.Time, offset time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(),
+		int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, day.Location())
+}
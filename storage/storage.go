@@ -0,0 +1,132 @@
+// Package storage keeps uploaded files on local disk or in an S3-compatible
+// object store.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Backend stores objects by key. Handlers use the process-wide instance
+// returned by GetBackend.
+type Backend interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	current Backend
+	mu      sync.RWMutex
+)
+
+func InitBackend(b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = b
+}
+
+func GetBackend() Backend {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// FromEnv returns an S3 backend when S3_BUCKET is set and otherwise a local
+// backend writing to STORAGE_DIR (default "uploads").
+func FromEnv() (Backend, error) {
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		endpoint := os.Getenv("S3_ENDPOINT")
+		if endpoint == "" {
+			return nil, errors.New("S3_ENDPOINT is not set")
+		}
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &S3Backend{
+			Endpoint:  strings.TrimRight(endpoint, "/"),
+			Region:    region,
+			Bucket:    bucket,
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		}, nil
+	}
+
+	dir := os.Getenv("STORAGE_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+	return &LocalBackend{Dir: dir}, nil
+}
+
+// LocalBackend stores each object as a file below Dir.
+type LocalBackend struct {
+	Dir string
+}
+
+func (b *LocalBackend) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(b.Dir, filepath.FromSlash(clean)), nil
+}
+
+// Put writes to a temporary file first so readers never see partial objects.
+func (b *LocalBackend) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, bytes.NewReader(data)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (b *LocalBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (b *LocalBackend) Delete(ctx context.Context, key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"dtms/models"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -16,8 +17,10 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// WebSocketManager tracks open connections and the user each belongs to.
+// Anonymous connections have user ID 0 and only receive broadcasts.
 type WebSocketManager struct {
-	clients map[*websocket.Conn]bool
+	clients map[*websocket.Conn]uint
 	mu      sync.Mutex
 }
 
@@ -25,7 +28,7 @@ var manager *WebSocketManager
 
 func InitWebSocketManager() {
 	manager = &WebSocketManager{
-		clients: make(map[*websocket.Conn]bool),
+		clients: make(map[*websocket.Conn]uint),
 	}
 }
 
@@ -44,7 +47,12 @@ func HandleConnections(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	manager.AddClient(conn)
+	var userID uint
+	if user, ok := c.Get("user"); ok {
+		userID = user.(models.User).ID
+	}
+
+	manager.AddUserClient(conn, userID)
 	defer manager.RemoveClient(conn)
 
 	for {
@@ -56,9 +64,13 @@ func HandleConnections(c *gin.Context) {
 }
 
 func (m *WebSocketManager) AddClient(conn *websocket.Conn) {
+	m.AddUserClient(conn, 0)
+}
+
+func (m *WebSocketManager) AddUserClient(conn *websocket.Conn, userID uint) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.clients[conn] = true
+	m.clients[conn] = userID
 }
 
 func (m *WebSocketManager) RemoveClient(conn *websocket.Conn) {
@@ -80,6 +92,55 @@ func (m *WebSocketManager) Broadcast(message []byte) {
 	}
 }
 
+// BroadcastAuthenticated delivers message to every signed-in connection,
+// skipping anonymous ones.
+func (m *WebSocketManager) BroadcastAuthenticated(message []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for client, userID := range m.clients {
+		if userID == 0 {
+			continue
+		}
+		err := client.WriteMessage(websocket.TextMessage, message)
+		if err != nil {
+			client.Close()
+			delete(m.clients, client)
+		}
+	}
+}
+
+// SendToUsers delivers message only to connections of the given users.
+func (m *WebSocketManager) SendToUsers(userIDs []uint, message []byte) {
+	targets := make(map[uint]bool, len(userIDs))
+	for _, id := range userIDs {
+		targets[id] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for client, userID := range m.clients {
+		if userID == 0 || !targets[userID] {
+			continue
+		}
+		err := client.WriteMessage(websocket.TextMessage, message)
+		if err != nil {
+			client.Close()
+			delete(m.clients, client)
+		}
+	}
+}
+
+func (m *WebSocketManager) SendUserNotification(userIDs []uint, event string, data interface{}) {
+	message := map[string]interface{}{
+		"event": event,
+		"data":  data,
+	}
+	msgBytes, _ := json.Marshal(message)
+	m.SendToUsers(userIDs, msgBytes)
+}
+
 func (m *WebSocketManager) SendNotification(event string, data interface{}) {
 	message := map[string]interface{}{
 		"event": event,
@@ -88,3 +149,14 @@ func (m *WebSocketManager) SendNotification(event string, data interface{}) {
 	msgBytes, _ := json.Marshal(message)
 	m.Broadcast(msgBytes)
 }
+
+// SendAuthenticatedNotification is SendNotification for events that must not
+// reach anonymous connections, such as comment bodies.
+func (m *WebSocketManager) SendAuthenticatedNotification(event string, data interface{}) {
+	message := map[string]interface{}{
+		"event": event,
+		"data":  data,
+	}
+	msgBytes, _ := json.Marshal(message)
+	m.BroadcastAuthenticated(msgBytes)
+}